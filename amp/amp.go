@@ -0,0 +1,31 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+// Package amp controls amplifiers.
+package amp
+
+// A Backend is one amp, or one zone of one, that can be switched on
+// and off and asked what it's doing.
+type Backend interface {
+	// Addr identifies the amp in logs and events, e.g. "10.0.0.20:23".
+	Addr() string
+
+	// PowerCommands returns the commands that turn the amp on or
+	// off, to be sent in order with SendCommand.
+	PowerCommands(on bool) []string
+	SendCommand(cmd string) error
+
+	// QueryPower asks the amp whether it's on.
+	QueryPower() (on bool, err error)
+
+	// QuerySource returns the amp's currently selected input, such
+	// as "CD" or "AUX1".
+	QuerySource() (string, error)
+}
+
+// A VolumeQuerier is a Backend that can also report its volume.
+type VolumeQuerier interface {
+	// QueryVolume returns the volume as the amp shows it, like
+	// "45.5".
+	QueryVolume() (string, error)
+}
@@ -0,0 +1,161 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broadlink is a Broadlink RM IR blaster on the local network,
+// sending codes as learned by the Broadlink app or python-broadlink,
+// in hex.
+type Broadlink struct {
+	Host    string // host or host:port; the port defaults to 80
+	MAC     net.HardwareAddr
+	DevType uint16 // from discovery; 0 for 0x2737, an RM mini 3
+	RM4     bool   // RM4 models frame codes differently
+
+	mu    sync.Mutex
+	count uint16
+	id    uint32
+	key   []byte // nil until authenticated
+}
+
+var (
+	broadlinkKey = []byte{0x09, 0x76, 0x28, 0x34, 0x3f, 0xe9, 0x9e, 0x23, 0x76, 0x5c, 0x15, 0x13, 0xac, 0xcf, 0x8b, 0x02}
+	broadlinkIV  = []byte{0x56, 0x2e, 0x17, 0x99, 0x6d, 0x09, 0x3d, 0x28, 0xdd, 0xb3, 0xba, 0x69, 0x5a, 0x2e, 0x6f, 0x58}
+)
+
+const broadlinkTimeout = 5 * time.Second
+
+func (b *Broadlink) Addr() string { return "broadlink:" + b.Host }
+
+func (b *Broadlink) SendIR(code string) error {
+	data, err := hex.DecodeString(strings.TrimSpace(code))
+	if err != nil {
+		return fmt.Errorf("broadlink: code isn't hex: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.key == nil {
+		if err := b.auth(); err != nil {
+			return err
+		}
+	}
+	var payload []byte
+	if b.RM4 {
+		payload = binary.LittleEndian.AppendUint16(nil, uint16(len(data)+4))
+		payload = binary.LittleEndian.AppendUint32(payload, 2)
+	} else {
+		payload = []byte{2, 0, 0, 0}
+	}
+	_, err = b.send(0x6a, append(payload, data...))
+	if err != nil {
+		b.key = nil // authenticate afresh next time
+	}
+	return err
+}
+
+// auth gets a session ID and key from the device.
+func (b *Broadlink) auth() error {
+	b.key, b.id = broadlinkKey, 0
+	payload := make([]byte, 0x50)
+	copy(payload[0x04:0x14], bytes.Repeat([]byte{'1'}, 16))
+	payload[0x1e] = 0x01
+	payload[0x2d] = 0x01
+	copy(payload[0x30:], "sonden")
+	resp, err := b.send(0x65, payload)
+	if err != nil {
+		b.key = nil
+		return fmt.Errorf("broadlink: authenticating: %v", err)
+	}
+	if len(resp) < 0x14 {
+		b.key = nil
+		return errors.New("broadlink: short auth reply")
+	}
+	b.id = binary.LittleEndian.Uint32(resp[0:4])
+	b.key = append([]byte(nil), resp[4:0x14]...)
+	return nil
+}
+
+// send sends a command packet with payload, encrypted, and returns
+// the decrypted payload of the reply.
+func (b *Broadlink) send(command byte, payload []byte) ([]byte, error) {
+	block, err := aes.NewCipher(b.key)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(payload) % 16; n != 0 {
+		payload = append(payload, make([]byte, 16-n)...)
+	}
+	b.count++
+	devType := b.DevType
+	if devType == 0 {
+		devType = 0x2737
+	}
+	p := make([]byte, 0x38, 0x38+len(payload))
+	copy(p, []byte{0x5a, 0xa5, 0xaa, 0x55, 0x5a, 0xa5, 0xaa, 0x55})
+	binary.LittleEndian.PutUint16(p[0x24:], devType)
+	p[0x26] = command
+	binary.LittleEndian.PutUint16(p[0x28:], b.count)
+	for i := 0; i < 6 && i < len(b.MAC); i++ {
+		p[0x2a+i] = b.MAC[len(b.MAC)-1-i]
+	}
+	binary.LittleEndian.PutUint32(p[0x30:], b.id)
+	binary.LittleEndian.PutUint16(p[0x34:], broadlinkSum(payload))
+	enc := make([]byte, len(payload))
+	cipher.NewCBCEncrypter(block, broadlinkIV).CryptBlocks(enc, payload)
+	p = append(p, enc...)
+	binary.LittleEndian.PutUint16(p[0x20:], broadlinkSum(p))
+
+	host := b.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	c, err := net.DialTimeout("udp", host, broadlinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(broadlinkTimeout))
+	if _, err := c.Write(p); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 2048)
+	n, err := c.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	resp = resp[:n]
+	if len(resp) < 0x38 {
+		return nil, errors.New("broadlink: short reply")
+	}
+	if code := binary.LittleEndian.Uint16(resp[0x22:]); code != 0 {
+		return nil, fmt.Errorf("broadlink: error %#x", code)
+	}
+	body := resp[0x38:]
+	if len(body)%16 != 0 {
+		return nil, errors.New("broadlink: bad reply length")
+	}
+	cipher.NewCBCDecrypter(block, broadlinkIV).CryptBlocks(body, body)
+	return body, nil
+}
+
+func broadlinkSum(b []byte) uint16 {
+	s := uint16(0xbeaf)
+	for _, c := range b {
+		s += uint16(c)
+	}
+	return s
+}
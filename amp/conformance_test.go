@@ -0,0 +1,257 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The transcripts in testdata/denon and testdata/heos record what
+// receivers of one model say to the commands and queries sonden sends,
+// quirks and all, one file per model. Each is replayed against the
+// backend, which must send what's recorded and make of the replies what
+// the transcript says. Add a model's by capturing a session with its
+// telnet port (23) or HEOS CLI port (1255).
+//
+// A Denon transcript's lines are:
+//
+//	zone 2                  use zone 2 for what follows; 1 to start with
+//	power on                QueryPower returns on, after the exchange that follows
+//	input CD                QuerySource returns CD
+//	volume 45.5             QueryVolume returns 45.5
+//	send ZMON               SendCommand("ZMON") succeeds
+//	> Z2?                   the backend sends this
+//	< Z2ON                  and the receiver replies this
+//	event Z2CD => input CD  StatusChange says the line sets the input to CD
+//	event Z2MUON => -       StatusChange says the line isn't about the zone
+//
+// A HEOS transcript's lines are:
+//
+//	< {"heos": ...}         the player sends this
+//	> player/get_mute?pid=1 and the backend replies this, in order
+//	state song=So What      and its State's song (by JSON name) is so
+//
+// Blank lines and lines starting with # are ignored.
+
+// A transcriptLine is a line of a transcript and where it's from.
+type transcriptLine struct {
+	pos  string // file:line
+	text string
+}
+
+func readTranscript(t *testing.T, file string) []transcriptLine {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []transcriptLine
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, transcriptLine{fmt.Sprintf("%s:%d", filepath.Base(file), n), text})
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func transcripts(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join("testdata", dir, "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no %s transcripts: %v", dir, err)
+	}
+	return files
+}
+
+func TestDenonTranscripts(t *testing.T) {
+	for _, file := range transcripts(t, "denon") {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			lines := readTranscript(t, file)
+			r := newTranscriptReceiver(t, lines)
+			a := NewDenon(r.addr, 1)
+			for _, l := range lines {
+				verb, arg, _ := strings.Cut(l.text, " ")
+				var got string
+				var err error
+				switch verb {
+				case ">", "<":
+					continue
+				case "zone":
+					zone, err := strconv.Atoi(arg)
+					if err != nil {
+						t.Fatalf("%s: bad zone", l.pos)
+					}
+					a = NewDenon(r.addr, zone)
+					continue
+				case "power":
+					var on bool
+					on, err = a.QueryPower()
+					got = "off"
+					if on {
+						got = "on"
+					}
+				case "input":
+					got, err = a.QuerySource()
+				case "volume":
+					got, err = a.QueryVolume()
+				case "send":
+					got, err = arg, a.SendCommand(arg)
+				case "event":
+					line, want, _ := strings.Cut(arg, " => ")
+					what, v, ok := a.StatusChange(line)
+					got = what + " " + v
+					if !ok {
+						got = "-"
+					}
+					if got != want {
+						t.Errorf("%s: StatusChange(%q) = %s; want %s", l.pos, line, got, want)
+					}
+					continue
+				default:
+					t.Fatalf("%s: unknown line %q", l.pos, l.text)
+				}
+				if err != nil {
+					t.Errorf("%s: %s: %v", l.pos, verb, err)
+				} else if got != arg {
+					t.Errorf("%s: %s = %q; want %q", l.pos, verb, got, arg)
+				}
+			}
+			if rest := r.unsent(); rest != "" {
+				t.Errorf("backend never sent %s", rest)
+			}
+		})
+	}
+}
+
+// A transcriptReceiver is a receiver's telnet port that follows a
+// transcript's > and < lines.
+type transcriptReceiver struct {
+	t    *testing.T
+	addr string
+
+	mu    sync.Mutex
+	lines []transcriptLine // the > and < still to come
+}
+
+func newTranscriptReceiver(t *testing.T, lines []transcriptLine) *transcriptReceiver {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &transcriptReceiver{t: t, addr: ln.Addr().String()}
+	for _, l := range lines {
+		if strings.HasPrefix(l.text, "> ") || strings.HasPrefix(l.text, "< ") {
+			r.lines = append(r.lines, l)
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *transcriptReceiver) serve(c net.Conn) {
+	defer c.Close()
+	s := bufio.NewScanner(c)
+	s.Split(scanCRLines)
+	for s.Scan() {
+		got := s.Text()
+		r.mu.Lock()
+		if len(r.lines) == 0 || r.lines[0].text != "> "+got {
+			want := "nothing"
+			if len(r.lines) > 0 {
+				want = fmt.Sprintf("%s (%s)", r.lines[0].text, r.lines[0].pos)
+			}
+			r.t.Errorf("backend sent %q; want %s", got, want)
+			r.mu.Unlock()
+			continue
+		}
+		r.lines = r.lines[1:]
+		var reply strings.Builder
+		for len(r.lines) > 0 && strings.HasPrefix(r.lines[0].text, "< ") {
+			reply.WriteString(r.lines[0].text[2:] + "\r")
+			r.lines = r.lines[1:]
+		}
+		r.mu.Unlock()
+		c.Write([]byte(reply.String()))
+	}
+}
+
+// unsent returns the first line the backend was to send and didn't,
+// if any.
+func (r *transcriptReceiver) unsent() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s (%s)", r.lines[0].text, r.lines[0].pos)
+}
+
+func TestHEOSTranscripts(t *testing.T) {
+	for _, file := range transcripts(t, "heos") {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			h := &HEOS{host: "10.0.0.5"}
+			var next []string
+			for _, l := range readTranscript(t, file) {
+				verb, arg, _ := strings.Cut(l.text, " ")
+				switch verb {
+				case "<":
+					if len(next) > 0 {
+						t.Errorf("%s: backend never sent %q", l.pos, next[0])
+					}
+					var m heosMessage
+					if err := json.Unmarshal([]byte(arg), &m); err != nil {
+						t.Fatalf("%s: %v", l.pos, err)
+					}
+					next = h.handle(&m, h.host)
+				case ">":
+					if len(next) == 0 || next[0] != arg {
+						t.Errorf("%s: backend sent %q; want %q", l.pos, next, arg)
+						continue
+					}
+					next = next[1:]
+				case "state":
+					b, _ := json.Marshal(h.State())
+					var st map[string]interface{}
+					json.Unmarshal(b, &st)
+					k, want, _ := strings.Cut(arg, "=")
+					got := ""
+					if v, ok := st[k]; ok {
+						got = fmt.Sprint(v)
+					}
+					if got != want {
+						t.Errorf("%s: state %s = %q; want %q", l.pos, k, got, want)
+					}
+				default:
+					t.Fatalf("%s: unknown line %q", l.pos, l.text)
+				}
+			}
+			if len(next) > 0 {
+				t.Errorf("backend never sent %q", next)
+			}
+		})
+	}
+}
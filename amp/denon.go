@@ -0,0 +1,218 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Denon is a Denon receiver, or one zone of one, controlled over its
+// telnet port.
+type Denon struct {
+	conn *denonConn
+	Zone int // 1 is the main zone
+}
+
+// NewDenon returns the Backend for zone of the Denon receiver at addr.
+func NewDenon(addr string, zone int) *Denon {
+	return &Denon{conn: getDenonConn(addr), Zone: zone}
+}
+
+func (a *Denon) Addr() string { return a.conn.addr }
+
+// SendCommand sends cmd, like "ZMON", and waits for the receiver to
+// echo its new state, as it does once it's ready for another command.
+// A missing echo isn't an error: receivers don't always send one.
+func (a *Denon) SendCommand(cmd string) error {
+	prefix := cmd
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	_, err := a.conn.do(cmd, denonEchoWait, func(line string) bool {
+		return strings.HasPrefix(line, prefix)
+	})
+	if err == errNoReply {
+		err = nil
+	}
+	return err
+}
+
+// Watch calls f with every line the receiver sends other than replies
+// to our own queries and commands, including the status changes it
+// reports when someone uses its remote or front panel. As a reply can
+// come late, or in several lines, f may still see one. f is called
+// from the connection's read loop and must not block.
+func (a *Denon) Watch(f func(line string)) {
+	a.conn.watch(f)
+}
+
+// StatusChange reports what of the amp's zone a line from Watch says
+// changed, "power", "input" or "volume", and to what: "on" or "off",
+// an input as from QuerySource, or a volume as from QueryVolume. ok is
+// false for lines about other zones or other things.
+func (a *Denon) StatusChange(line string) (what, value string, ok bool) {
+	z := a.zonePrefix()
+	if z == "ZM" {
+		switch {
+		case line == "PWON", line == "ZMON":
+			return "power", "on", true
+		case line == "PWSTANDBY", line == "ZMOFF":
+			return "power", "off", true
+		case strings.HasPrefix(line, "SI"):
+			return "input", line[2:], true
+		case strings.HasPrefix(line, "MV") && isDigits(line[2:]):
+			return "volume", denonVolume(line[2:]), true
+		}
+		return "", "", false
+	}
+	rest, found := strings.CutPrefix(line, z)
+	switch {
+	case !found || rest == "":
+		return "", "", false
+	case rest == "ON":
+		return "power", "on", true
+	case rest == "OFF":
+		return "power", "off", true
+	case isDigits(rest):
+		return "volume", denonVolume(rest), true
+	case strings.HasPrefix(rest, "MU"), strings.HasPrefix(rest, "CS"), strings.HasPrefix(rest, "CV"), strings.HasPrefix(rest, "SLP"), strings.HasPrefix(rest, "PS"), strings.HasPrefix(rest, "QUICK"):
+		// Mute, channel setting, channel volume, sleep, tone and
+		// quick select aren't the input.
+		return "", "", false
+	}
+	return "input", rest, true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// query sends a Denon status query such as "PW?" and returns the first
+// reply line for which match returns true.
+func (a *Denon) query(q string, match func(line string) bool) (string, error) {
+	line, err := a.conn.do(q, denonTimeout, match)
+	if err == errNoReply {
+		err = fmt.Errorf("no reply to %q from %s", q, a.Addr())
+	}
+	return line, err
+}
+
+// zonePrefix returns the Denon command prefix for the amp's zone:
+// "ZM" for the main zone, else "Z2", "Z3".
+func (a *Denon) zonePrefix() string {
+	if a.Zone <= 1 {
+		return "ZM"
+	}
+	return "Z" + strconv.Itoa(a.Zone)
+}
+
+// PowerCommands returns the commands that turn the amp's zone on or
+// off. The main zone also takes the whole unit in and out of standby.
+func (a *Denon) PowerCommands(on bool) []string {
+	z := a.zonePrefix()
+	if z == "ZM" {
+		if on {
+			return []string{"ZMON", "PWON"}
+		}
+		return []string{"ZMOFF", "PWSTANDBY"}
+	}
+	if on {
+		return []string{z + "ON"}
+	}
+	return []string{z + "OFF"}
+}
+
+// QueryPower asks the amp whether its zone is powered on.
+func (a *Denon) QueryPower() (on bool, err error) {
+	z := a.zonePrefix()
+	query, onReply, offReply := "PW?", "PWON", "PWSTANDBY"
+	if z != "ZM" {
+		query, onReply, offReply = z+"?", z+"ON", z+"OFF"
+	}
+	line, err := a.query(query, func(line string) bool {
+		return line == onReply || line == offReply
+	})
+	if err != nil {
+		return false, err
+	}
+	return line == onReply, nil
+}
+
+// QuerySource returns the amp zone's currently selected input, such
+// as "CD" or "AUX1".
+func (a *Denon) QuerySource() (string, error) {
+	z := a.zonePrefix()
+	if z == "ZM" {
+		line, err := a.query("SI?", func(line string) bool {
+			return strings.HasPrefix(line, "SI")
+		})
+		return strings.TrimPrefix(line, "SI"), err
+	}
+	// Other zones reply to "Z2?" with their power, input and
+	// volume on separate lines: "Z2ON", "Z2CD", "Z245".
+	line, err := a.query(z+"?", func(line string) bool {
+		rest := strings.TrimPrefix(line, z)
+		if rest == line || rest == "" || rest == "ON" || rest == "OFF" {
+			return false
+		}
+		_, err := strconv.Atoi(rest)
+		return err != nil
+	})
+	return strings.TrimPrefix(line, z), err
+}
+
+// QueryVolume returns the amp zone's volume on Denon's 0-98 scale,
+// like "45" or "45.5".
+func (a *Denon) QueryVolume() (string, error) {
+	z := a.zonePrefix()
+	q, prefix := z+"?", z
+	if z == "ZM" {
+		q, prefix = "MV?", "MV"
+	}
+	line, err := a.query(q, func(line string) bool {
+		_, err := strconv.Atoi(strings.TrimPrefix(line, prefix))
+		return strings.HasPrefix(line, prefix) && err == nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return denonVolume(strings.TrimPrefix(line, prefix)), nil
+}
+
+// denonVolume formats a volume as the receiver sends it, like "45" or
+// "455", as QueryVolume returns it.
+func denonVolume(v string) string {
+	if len(v) == 3 {
+		// A half step: "455" is 45.5.
+		v = v[:2] + "." + v[2:]
+	}
+	return v
+}
+
+// scanCRLines is a bufio.SplitFunc for Denon replies, which are
+// terminated by a bare carriage return.
+func scanCRLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		if b == '\r' || b == '\n' {
+			if i == 0 {
+				return 1, nil, nil
+			}
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
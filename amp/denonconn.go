@@ -0,0 +1,200 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Denon receivers take one telnet client at a time, and are slow to
+// accept a new one, so each receiver gets a single long-lived
+// connection shared by all its zones, kept alive while idle and
+// redialed when it breaks.
+
+const (
+	denonTimeout   = 5 * time.Second  // to dial, or wait for a query's reply
+	denonEchoWait  = time.Second      // most to wait for a command's echo
+	denonKeepalive = 30 * time.Second // query the idle connection this often
+)
+
+var (
+	denonConnsMu sync.Mutex
+	denonConns   = make(map[string]*denonConn) // by addr
+)
+
+// A denonConn is the connection to one receiver.
+type denonConn struct {
+	addr string
+
+	mu       sync.Mutex // serializes requests; guards the following
+	sess     *denonSession
+	lastUsed time.Time
+
+	watchMu  sync.Mutex
+	watchers []func(line string)
+	asking   bool // a request is waiting for its reply; see readLoop
+}
+
+// A denonSession is one TCP connection. Its read loop delivers reply
+// lines on lines, dropping them if nobody's waiting, and closes done
+// when the connection fails.
+type denonSession struct {
+	c     net.Conn
+	lines chan string
+	done  chan struct{}
+	err   error // set before done is closed
+}
+
+// getDenonConn returns the shared connection to addr.
+func getDenonConn(addr string) *denonConn {
+	denonConnsMu.Lock()
+	defer denonConnsMu.Unlock()
+	dc, ok := denonConns[addr]
+	if !ok {
+		dc = &denonConn{addr: addr}
+		denonConns[addr] = dc
+		go dc.keepalive()
+	}
+	return dc
+}
+
+// session returns the current session, dialing a new one if needed.
+// dc.mu must be held.
+func (dc *denonConn) session() (*denonSession, error) {
+	if s := dc.sess; s != nil {
+		select {
+		case <-s.done:
+			dc.sess = nil
+		default:
+			return s, nil
+		}
+	}
+	c, err := net.DialTimeout("tcp", dc.addr, denonTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+	s := &denonSession{c: c, lines: make(chan string, 16), done: make(chan struct{})}
+	go dc.readLoop(s)
+	dc.sess = s
+	return s, nil
+}
+
+func (dc *denonConn) readLoop(s *denonSession) {
+	sc := bufio.NewScanner(s.c)
+	sc.Split(scanCRLines)
+	for sc.Scan() {
+		line := sc.Text()
+		dc.watchMu.Lock()
+		watchers := dc.watchers
+		if dc.asking {
+			// Most likely the reply, which the watchers needn't
+			// hear about: whoever asked already knows.
+			watchers = nil
+		}
+		dc.watchMu.Unlock()
+		for _, f := range watchers {
+			f(line)
+		}
+		select {
+		case s.lines <- line:
+		default:
+		}
+	}
+	s.err = sc.Err()
+	if s.err == nil {
+		s.err = errors.New("connection closed by amp")
+	}
+	s.c.Close()
+	close(s.done)
+}
+
+// drop closes s after an error, so the next request redials.
+func (dc *denonConn) drop(s *denonSession) {
+	s.c.Close()
+	if dc.sess == s {
+		dc.sess = nil
+	}
+}
+
+// do writes msg and waits up to wait for a reply line for which match
+// returns true. If the connection turns out to be dead, it's redialed
+// and msg is sent once more.
+func (dc *denonConn) do(msg string, wait time.Duration, match func(string) bool) (line string, err error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.lastUsed = time.Now()
+	dc.setAsking(true)
+	defer dc.setAsking(false)
+	for attempt := 0; attempt < 2; attempt++ {
+		var s *denonSession
+		if s, err = dc.session(); err != nil {
+			return "", err
+		}
+		// Discard unsolicited status lines from before.
+		for len(s.lines) > 0 {
+			<-s.lines
+		}
+		s.c.SetWriteDeadline(time.Now().Add(denonTimeout))
+		if _, err = fmt.Fprintf(s.c, "%s\r", msg); err != nil {
+			dc.drop(s)
+			continue
+		}
+		timeout := time.NewTimer(wait)
+		defer timeout.Stop()
+		for {
+			select {
+			case line := <-s.lines:
+				if match(line) {
+					return line, nil
+				}
+				continue
+			case <-s.done:
+				err = s.err
+				dc.drop(s)
+			case <-timeout.C:
+				return "", errNoReply
+			}
+			break
+		}
+	}
+	return "", err
+}
+
+var errNoReply = errors.New("no reply")
+
+func (dc *denonConn) setAsking(v bool) {
+	dc.watchMu.Lock()
+	defer dc.watchMu.Unlock()
+	dc.asking = v
+}
+
+// watch calls f with every line the receiver sends while no request
+// is waiting for its reply, including status changes made with its
+// remote or front panel.
+func (dc *denonConn) watch(f func(line string)) {
+	dc.watchMu.Lock()
+	defer dc.watchMu.Unlock()
+	dc.watchers = append(dc.watchers, f)
+}
+
+// keepalive queries the connection when it's been idle for a while,
+// so a dead one is noticed and redialed before it's needed.
+func (dc *denonConn) keepalive() {
+	for range time.Tick(denonKeepalive) {
+		dc.mu.Lock()
+		idle := dc.sess != nil && time.Since(dc.lastUsed) >= denonKeepalive
+		dc.mu.Unlock()
+		if idle {
+			dc.do("PW?", denonTimeout, func(line string) bool { return len(line) > 2 && line[:2] == "PW" })
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GPIO is an amp switched by a GPIO output, through a relay or its
+// 12V trigger input, using the Linux sysfs GPIO interface. On
+// kernels that number the Raspberry Pi's header pins from an offset
+// (see /sys/class/gpio/gpiochip*/base), add it to the pin.
+type GPIO struct {
+	Pin   int
+	value string // sysfs value file
+}
+
+// NewGPIO returns the Backend for the amp on GPIO output pin. If
+// activeLow, the amp is on while the pin is low. An output that's
+// already set up keeps its state.
+func NewGPIO(pin int, activeLow bool) (*GPIO, error) {
+	value, err := ExportGPIO(pin, "out", activeLow)
+	if err != nil {
+		return nil, err
+	}
+	return &GPIO{Pin: pin, value: value}, nil
+}
+
+func (g *GPIO) Addr() string { return "gpio" + strconv.Itoa(g.Pin) }
+
+// PowerCommands returns the value to set the pin to.
+func (g *GPIO) PowerCommands(on bool) []string {
+	if on {
+		return []string{"1"}
+	}
+	return []string{"0"}
+}
+
+func (g *GPIO) SendCommand(cmd string) error {
+	return os.WriteFile(g.value, []byte(cmd), 0)
+}
+
+// QueryPower reports whether the pin is set.
+func (g *GPIO) QueryPower() (on bool, err error) {
+	return ReadGPIO(g.value)
+}
+
+// QuerySource returns "": a relay has no inputs.
+func (g *GPIO) QuerySource() (string, error) { return "", nil }
+
+const sysfsGPIO = "/sys/class/gpio"
+
+// ExportGPIO sets up pin as an input or output, as dir is "in" or
+// "out", and returns the path of its sysfs value file, for
+// ReadGPIO. If activeLow, the pin reads 1 while it's low.
+func ExportGPIO(pin int, dir string, activeLow bool) (value string, err error) {
+	gpio := fmt.Sprintf("%s/gpio%d", sysfsGPIO, pin)
+	if _, err := os.Stat(gpio); os.IsNotExist(err) {
+		if err := os.WriteFile(sysfsGPIO+"/export", []byte(strconv.Itoa(pin)), 0); err != nil {
+			return "", fmt.Errorf("exporting GPIO %d: %v", pin, err)
+		}
+	}
+	// udev may take a moment to make the new files writable.
+	write := func(file, v string) (err error) {
+		for i := 0; i < 10; i++ {
+			if err = os.WriteFile(gpio+"/"+file, []byte(v), 0); err == nil || !os.IsPermission(err) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			return fmt.Errorf("setting up GPIO %d: %v", pin, err)
+		}
+		return nil
+	}
+	al := "0"
+	if activeLow {
+		al = "1"
+	}
+	if err := write("active_low", al); err != nil {
+		return "", err
+	}
+	if cur, err := os.ReadFile(gpio + "/direction"); err != nil || strings.TrimSpace(string(cur)) != dir {
+		if err := write("direction", dir); err != nil {
+			return "", err
+		}
+	}
+	return gpio + "/value", nil
+}
+
+// ReadGPIO reads a GPIO value file from ExportGPIO.
+func ReadGPIO(value string) (bool, error) {
+	b, err := os.ReadFile(value)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == "1", nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HEOS is a Denon or Marantz receiver with HEOS built in, watched over
+// the HEOS CLI protocol (JSON lines on port 1255) for the play state,
+// volume and what's playing, which it reports as they change. The CLI
+// has no power commands, so power still goes over the telnet
+// protocol, as for a Denon.
+type HEOS struct {
+	*Denon
+	host string
+
+	mu  sync.Mutex
+	st  HEOSState
+	pid int // the player we follow; 0 until found
+}
+
+// HEOSState is what a HEOS player last reported.
+type HEOSState struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"` // why not
+	Player    string `json:"player,omitempty"`
+	Model     string `json:"model,omitempty"`
+	PlayState string `json:"play_state,omitempty"` // "play", "pause" or "stop"
+	Volume    int    `json:"volume"`
+	Muted     bool   `json:"muted,omitempty"`
+
+	// Input is the physical input playing, like
+	// "inputs/aux_in_1", if it's one rather than a stream.
+	Input   string `json:"input,omitempty"`
+	Song    string `json:"song,omitempty"`
+	Artist  string `json:"artist,omitempty"`
+	Album   string `json:"album,omitempty"`
+	Station string `json:"station,omitempty"`
+}
+
+const (
+	heosPort      = "1255"
+	heosHeartbeat = 30 * time.Second
+	heosRetry     = 10 * time.Second
+)
+
+// NewHEOS returns the Backend for zone of the HEOS receiver at host,
+// and starts watching it.
+func NewHEOS(host string, zone int) *HEOS {
+	h := &HEOS{Denon: NewDenon(net.JoinHostPort(host, "23"), zone), host: host}
+	go h.run()
+	return h
+}
+
+// State returns what the player last reported.
+func (h *HEOS) State() HEOSState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.st
+}
+
+func (h *HEOS) run() {
+	for {
+		err := h.session()
+		h.mu.Lock()
+		h.st = HEOSState{Error: err.Error()}
+		h.pid = 0
+		h.mu.Unlock()
+		time.Sleep(heosRetry)
+	}
+}
+
+// A heosMessage is a HEOS CLI response or event.
+type heosMessage struct {
+	HEOS struct {
+		Command string `json:"command"`
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	} `json:"heos"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// session connects to the player and follows it until the connection
+// fails.
+func (h *HEOS) session() error {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(h.host, heosPort), denonTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var wmu sync.Mutex
+	send := func(cmd string) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		c.SetWriteDeadline(time.Now().Add(denonTimeout))
+		_, err := fmt.Fprintf(c, "heos://%s\r\n", cmd)
+		return err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		t := time.NewTicker(heosHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if send("system/heart_beat") != nil {
+					return
+				}
+			}
+		}
+	}()
+	if err := send("system/register_for_change_events?enable=on"); err != nil {
+		return err
+	}
+	if err := send("player/get_players"); err != nil {
+		return err
+	}
+	ip := c.RemoteAddr().(*net.TCPAddr).IP.String()
+	br := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(2 * heosHeartbeat))
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var m heosMessage
+		if json.Unmarshal(line, &m) != nil {
+			continue
+		}
+		if strings.HasPrefix(m.HEOS.Message, "command under process") {
+			continue // the real reply follows
+		}
+		if m.HEOS.Result == "fail" {
+			if m.HEOS.Command == "player/get_players" {
+				return fmt.Errorf("HEOS get_players: %s", m.HEOS.Message)
+			}
+			continue
+		}
+		for _, cmd := range h.handle(&m, ip) {
+			if err := send(cmd); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle updates the state from m, and returns commands to send next.
+// The connection's remote ip picks the player when several are on the
+// HEOS network.
+func (h *HEOS) handle(m *heosMessage, ip string) (next []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, _ := url.ParseQuery(m.HEOS.Message)
+	if m.HEOS.Command != "player/get_players" && m.HEOS.Command != "event/players_changed" {
+		if pid, _ := strconv.Atoi(q.Get("pid")); h.pid == 0 || pid != h.pid {
+			return nil // another player's
+		}
+	}
+	switch m.HEOS.Command {
+	case "event/players_changed":
+		return []string{"player/get_players"}
+	case "player/get_players":
+		var players []struct {
+			Name  string `json:"name"`
+			PID   int    `json:"pid"`
+			Model string `json:"model"`
+			IP    string `json:"ip"`
+		}
+		json.Unmarshal(m.Payload, &players)
+		for _, p := range players {
+			if p.IP == ip || len(players) == 1 {
+				h.pid = p.PID
+				h.st = HEOSState{Connected: true, Player: p.Name, Model: p.Model}
+				pid := strconv.Itoa(p.PID)
+				return []string{
+					"player/get_play_state?pid=" + pid,
+					"player/get_volume?pid=" + pid,
+					"player/get_mute?pid=" + pid,
+					"player/get_now_playing_media?pid=" + pid,
+				}
+			}
+		}
+		h.pid = 0
+		h.st = HEOSState{Error: fmt.Sprintf("no HEOS player at %s among %d", ip, len(players))}
+	case "player/get_play_state", "event/player_state_changed":
+		h.st.PlayState = q.Get("state")
+	case "player/get_volume", "event/player_volume_changed":
+		h.st.Volume, _ = strconv.Atoi(q.Get("level"))
+		if mute := q.Get("mute"); mute != "" {
+			h.st.Muted = mute == "on"
+		}
+	case "player/get_mute":
+		h.st.Muted = q.Get("state") == "on"
+	case "event/player_now_playing_changed":
+		return []string{"player/get_now_playing_media?pid=" + strconv.Itoa(h.pid)}
+	case "player/get_now_playing_media":
+		var np struct {
+			Song, Artist, Album, Station, MID string
+		}
+		json.Unmarshal(m.Payload, &np)
+		h.st.Song, h.st.Artist, h.st.Album, h.st.Station = np.Song, np.Artist, np.Album, np.Station
+		h.st.Input = ""
+		if strings.HasPrefix(np.MID, "inputs/") {
+			h.st.Input = np.MID
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// An IRBlaster sends infrared codes.
+type IRBlaster interface {
+	// Addr identifies the blaster, e.g. "lirc:/var/run/lirc/lircd".
+	Addr() string
+	SendIR(code string) error
+}
+
+// IR is an amp with no control but its remote, worked by an IR
+// blaster. IR is one way, so the amp is taken to be as last set; with
+// a toggle code that needs it to start out off.
+type IR struct {
+	Blaster IRBlaster
+	Name    string // tells apart amps on one blaster; may be empty
+
+	onCode, offCode string // the same for a toggle code
+
+	mu sync.Mutex
+	on bool
+}
+
+// NewIR returns the Backend for the amp with discrete power codes on
+// and off, or the toggle code on if off is empty, sent through b.
+func NewIR(b IRBlaster, name, on, off string) *IR {
+	if off == "" {
+		off = on
+	}
+	return &IR{Blaster: b, Name: name, onCode: on, offCode: off}
+}
+
+func (a *IR) Addr() string {
+	if a.Name != "" {
+		return a.Blaster.Addr() + "#" + a.Name
+	}
+	return a.Blaster.Addr()
+}
+
+func (a *IR) toggle() bool { return a.onCode == a.offCode }
+
+// PowerCommands returns the code to send. A toggle code is only
+// returned if the amp isn't already in the state wanted.
+func (a *IR) PowerCommands(on bool) []string {
+	if a.toggle() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.on == on {
+			return nil
+		}
+	}
+	if on {
+		return []string{a.onCode}
+	}
+	return []string{a.offCode}
+}
+
+func (a *IR) SendCommand(code string) error {
+	if err := a.Blaster.SendIR(code); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.toggle() {
+		a.on = !a.on
+	} else {
+		a.on = code == a.onCode
+	}
+	return nil
+}
+
+// QueryPower returns the state the amp was last set to.
+func (a *IR) QueryPower() (on bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.on, nil
+}
+
+// QuerySource returns "": IR can't say.
+func (a *IR) QuerySource() (string, error) { return "", nil }
+
+// LIRC is an IR blaster run by lircd, sending codes named like
+// "denon KEY_POWER" (remote, then button) from its configuration.
+type LIRC struct {
+	Socket string // default /var/run/lirc/lircd
+}
+
+func (l *LIRC) socket() string {
+	if l.Socket == "" {
+		return "/var/run/lirc/lircd"
+	}
+	return l.Socket
+}
+
+func (l *LIRC) Addr() string { return "lirc:" + l.socket() }
+
+func (l *LIRC) SendIR(code string) error {
+	c, err := net.DialTimeout("unix", l.socket(), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(c, "SEND_ONCE %s\n", code); err != nil {
+		return err
+	}
+	// The reply is BEGIN, the command, SUCCESS or ERROR (and
+	// DATA, a count and the message), then END.
+	s := bufio.NewScanner(c)
+	var result, msg string
+	for s.Scan() {
+		switch line := s.Text(); {
+		case line == "SUCCESS" || line == "ERROR":
+			result = line
+		case line == "END":
+			if result == "SUCCESS" {
+				return nil
+			}
+			return fmt.Errorf("lircd: SEND_ONCE %s: %s", code, msg)
+		case result != "":
+			msg = line // the last line before END is the message
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("lircd closed the connection")
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matter is a device switched by a Matter plug or switch, over WiFi or
+// Thread, worked with the Matter SDK's chip-tool, which holds the
+// fabric the plug was commissioned into (chip-tool pairing ...).
+type Matter struct {
+	Tool     string // chip-tool's path; default "chip-tool"
+	Storage  string // chip-tool's --storage-directory; empty for its default
+	Node     uint64 // the plug's node ID, given when commissioning
+	Endpoint int    // of its On/Off cluster; default 1
+}
+
+// matterTimeout is how long chip-tool may take, establishing a session
+// with a sleepy Thread device included.
+const matterTimeout = 30 * time.Second
+
+// NewMatter returns the Backend for the On/Off cluster at endpoint of
+// node, through chip-tool with the storage directory storage.
+func NewMatter(tool, storage string, node uint64, endpoint int) *Matter {
+	if tool == "" {
+		tool = "chip-tool"
+	}
+	if endpoint == 0 {
+		endpoint = 1
+	}
+	return &Matter{Tool: tool, Storage: storage, Node: node, Endpoint: endpoint}
+}
+
+func (m *Matter) Addr() string {
+	return fmt.Sprintf("matter:%d/%d", m.Node, m.Endpoint)
+}
+
+func (m *Matter) PowerCommands(on bool) []string {
+	if on {
+		return []string{"on"}
+	}
+	return []string{"off"}
+}
+
+func (m *Matter) SendCommand(cmd string) error {
+	if cmd != "on" && cmd != "off" {
+		return fmt.Errorf("matter: unknown command %q", cmd)
+	}
+	_, err := m.chipTool("onoff", cmd)
+	return err
+}
+
+var matterOnOff = regexp.MustCompile(`OnOff: (TRUE|FALSE)`)
+
+func (m *Matter) QueryPower() (on bool, err error) {
+	out, err := m.chipTool("onoff", "read", "on-off")
+	if err != nil {
+		return false, err
+	}
+	sm := matterOnOff.FindSubmatch(out)
+	if sm == nil {
+		return false, fmt.Errorf("matter: no OnOff attribute in chip-tool's output")
+	}
+	return string(sm[1]) == "TRUE", nil
+}
+
+// QuerySource returns "": a plug has no inputs.
+func (m *Matter) QuerySource() (string, error) { return "", nil }
+
+// chipTool runs chip-tool with args, then the node and endpoint.
+func (m *Matter) chipTool(args ...string) ([]byte, error) {
+	args = append(args, strconv.FormatUint(m.Node, 10), strconv.Itoa(m.Endpoint))
+	if m.Storage != "" {
+		args = append(args, "--storage-directory", m.Storage)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), matterTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, m.Tool, args...).CombinedOutput()
+	if err != nil {
+		// chip-tool logs a lot; its error is at the end.
+		s := strings.TrimSpace(string(out))
+		if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+		return nil, fmt.Errorf("%s %s: %v: %s", m.Tool, strings.Join(args, " "), err, s)
+	}
+	return out, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Modbus is an amp switched by a coil of a Modbus relay board or PDU,
+// over Modbus TCP or, on a serial port, Modbus RTU.
+type Modbus struct {
+	Host string // TCP: host or host:port; the port defaults to 502
+	Port string // RTU: the serial port, if not Host
+	Unit byte   // the slave address
+	Coil uint16 // from 0
+
+	port *serialPort // RTU
+}
+
+const modbusTimeout = 5 * time.Second
+
+var modbusExceptions = map[byte]string{
+	1: "illegal function",
+	2: "illegal data address (no such coil?)",
+	3: "illegal data value",
+	4: "device failure",
+}
+
+// NewModbusTCP returns the Backend for coil of unit at host.
+func NewModbusTCP(host string, unit byte, coil uint16) *Modbus {
+	return &Modbus{Host: host, Unit: unit, Coil: coil}
+}
+
+// NewModbusRTU returns the Backend for coil of unit on the serial
+// port at baud. Units on the same port share it.
+func NewModbusRTU(port string, baud int, unit byte, coil uint16) *Modbus {
+	return &Modbus{Port: port, Unit: unit, Coil: coil, port: getSerialPort(port, baud)}
+}
+
+func (m *Modbus) Addr() string {
+	where := m.Host
+	if where == "" {
+		where = m.Port
+	}
+	return fmt.Sprintf("modbus:%s/%d/%d", where, m.Unit, m.Coil)
+}
+
+func (m *Modbus) PowerCommands(on bool) []string {
+	if on {
+		return []string{"on"}
+	}
+	return []string{"off"}
+}
+
+func (m *Modbus) SendCommand(cmd string) error {
+	var v uint16
+	switch cmd {
+	case "on":
+		v = 0xff00
+	case "off":
+	default:
+		return fmt.Errorf("modbus: unknown command %q", cmd)
+	}
+	// Write Single Coil, echoed back.
+	_, err := m.call(0x05, binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, m.Coil), v), 4)
+	return err
+}
+
+func (m *Modbus) QueryPower() (on bool, err error) {
+	// Read Coils, just the one.
+	res, err := m.call(0x01, binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, m.Coil), 1), 2)
+	if err != nil {
+		return false, err
+	}
+	return res[1]&1 != 0, nil
+}
+
+// QuerySource returns "": a relay has no inputs.
+func (m *Modbus) QuerySource() (string, error) { return "", nil }
+
+// call sends the request with function code fn and data, and returns
+// the reply's data, which should be n bytes long.
+func (m *Modbus) call(fn byte, data []byte, n int) ([]byte, error) {
+	pdu := append([]byte{fn}, data...)
+	var res []byte
+	var err error
+	if m.port != nil {
+		res, err = m.rtu(pdu, n)
+	} else {
+		res, err = m.tcp(pdu, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(res) == 2 && res[0] == fn|0x80:
+		if msg, ok := modbusExceptions[res[1]]; ok {
+			return nil, fmt.Errorf("%s: %s", m.Addr(), msg)
+		}
+		return nil, fmt.Errorf("%s: exception %d", m.Addr(), res[1])
+	case len(res) != 1+n || res[0] != fn:
+		return nil, fmt.Errorf("%s: bad reply % x", m.Addr(), res)
+	}
+	return res[1:], nil
+}
+
+// tcp sends pdu in a Modbus TCP frame and returns the reply's PDU.
+func (m *Modbus) tcp(pdu []byte, n int) ([]byte, error) {
+	host := m.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "502")
+	}
+	c, err := net.DialTimeout("tcp", host, modbusTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(modbusTimeout))
+	// The MBAP header: transaction ID, protocol 0, length, unit.
+	req := []byte{0, 1, 0, 0}
+	req = binary.BigEndian.AppendUint16(req, uint16(1+len(pdu)))
+	req = append(append(req, m.Unit), pdu...)
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return nil, err
+	}
+	l := int(binary.BigEndian.Uint16(hdr[4:]))
+	if l < 2 || l > 256 {
+		return nil, fmt.Errorf("%s: bad reply length %d", m.Addr(), l)
+	}
+	res := make([]byte, l-1)
+	_, err = io.ReadFull(c, res)
+	return res, err
+}
+
+// rtu sends pdu in a Modbus RTU frame and returns the reply's PDU, of
+// 1+n bytes, or 2 for an exception.
+func (m *Modbus) rtu(pdu []byte, n int) ([]byte, error) {
+	req := append([]byte{m.Unit}, pdu...)
+	req = binary.LittleEndian.AppendUint16(req, modbusCRC(req))
+	var res []byte
+	err := m.port.do(func(f *os.File) error {
+		if _, err := f.Write(req); err != nil {
+			return err
+		}
+		want := 1 + 1 + n + 2
+		deadline := time.Now().Add(serialTimeout)
+		for len(res) < want && time.Now().Before(deadline) {
+			b := make([]byte, want-len(res))
+			k, err := f.Read(b) // times out after a tenth of a second
+			if err != nil {
+				return err
+			}
+			res = append(res, b[:k]...)
+			if len(res) == 5 && res[1]&0x80 != 0 {
+				break // an exception
+			}
+		}
+		time.Sleep(serialGap)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 5 {
+		return nil, fmt.Errorf("%s: no reply", m.Addr())
+	}
+	body := res[:len(res)-2]
+	if res[0] != m.Unit || binary.LittleEndian.Uint16(res[len(res)-2:]) != modbusCRC(body) {
+		return nil, fmt.Errorf("%s: bad reply % x", m.Addr(), res)
+	}
+	return body[1:], nil
+}
+
+// modbusCRC is Modbus RTU's CRC-16.
+func modbusCRC(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
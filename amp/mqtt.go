@@ -0,0 +1,184 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// mqttConn is as much of an MQTT 3.1.1 client as talking to
+// zigbee2mqtt takes: QoS 0 only, one connection per exchange.
+type mqttConn struct {
+	c  net.Conn
+	br *bufio.Reader
+}
+
+// An mqttMessage is a PUBLISH received.
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	retained bool // sent on subscribing, rather than just published
+}
+
+const mqttKeepAlive = 60 // seconds; exchanges are much shorter
+
+// dialMQTT connects to the broker at addr (port 1883 by default),
+// with user and password if user is non-empty.
+func dialMQTT(addr, user, password string, timeout time.Duration) (*mqttConn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "1883")
+	}
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	m := &mqttConn{c: c, br: bufio.NewReader(c)}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+	var p []byte
+	p = mqttString(p, "MQTT")
+	flags := byte(0x02) // clean session
+	if user != "" {
+		flags |= 0x80 | 0x40
+	}
+	p = append(p, 4, flags, 0, mqttKeepAlive)
+	p = mqttString(p, "sonden-"+hex.EncodeToString(id))
+	if user != "" {
+		p = mqttString(p, user)
+		p = mqttString(p, password)
+	}
+	if err := m.write(0x10, p); err != nil {
+		c.Close()
+		return nil, err
+	}
+	typ, body, err := m.read()
+	if err == nil && (typ != 0x20 || len(body) != 2) {
+		err = fmt.Errorf("mqtt: expected CONNACK, got packet type %#x", typ)
+	}
+	if err == nil && body[1] != 0 {
+		err = fmt.Errorf("mqtt: connection refused, code %d", body[1])
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *mqttConn) Close() error {
+	m.write(0xe0, nil) // DISCONNECT
+	return m.c.Close()
+}
+
+func (m *mqttConn) subscribe(topic string) error {
+	p := []byte{0, 1} // packet ID
+	p = mqttString(p, topic)
+	p = append(p, 0) // QoS 0
+	if err := m.write(0x82, p); err != nil {
+		return err
+	}
+	for {
+		typ, body, err := m.read()
+		if err != nil {
+			return err
+		}
+		if typ != 0x90 {
+			continue // a retained message, racing the SUBACK
+		}
+		if len(body) < 3 || body[2] == 0x80 {
+			return fmt.Errorf("mqtt: subscribing to %s refused", topic)
+		}
+		return nil
+	}
+}
+
+func (m *mqttConn) publish(topic string, payload []byte) error {
+	p := mqttString(nil, topic)
+	return m.write(0x30, append(p, payload...))
+}
+
+// next returns the next message received, skipping other packets.
+func (m *mqttConn) next() (*mqttMessage, error) {
+	for {
+		typ, body, err := m.read()
+		if err != nil {
+			return nil, err
+		}
+		if typ&0xf0 != 0x30 {
+			continue
+		}
+		if len(body) < 2 {
+			return nil, errors.New("mqtt: short PUBLISH")
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			return nil, errors.New("mqtt: short PUBLISH")
+		}
+		msg := &mqttMessage{topic: string(body[2 : 2+n]), retained: typ&1 != 0}
+		rest := body[2+n:]
+		if typ&0x06 != 0 && len(rest) >= 2 {
+			rest = rest[2:] // a packet ID, though we only asked for QoS 0
+		}
+		msg.payload = rest
+		return msg, nil
+	}
+}
+
+func (m *mqttConn) write(typ byte, body []byte) error {
+	p := []byte{typ}
+	for n := len(body); ; {
+		b := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := m.c.Write(append(p, body...))
+	return err
+}
+
+// read returns the next packet's first byte and the rest of it.
+func (m *mqttConn) read() (typ byte, body []byte, err error) {
+	if typ, err = m.br.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	for shift := 0; ; shift += 7 {
+		b, err := m.br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if shift > 21 {
+			return 0, nil, errors.New("mqtt: bad packet length")
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if n > 256<<10 {
+		return 0, nil, fmt.Errorf("mqtt: packet of %d bytes", n)
+	}
+	body = make([]byte, n)
+	_, err = io.ReadFull(m.br, body)
+	return typ, body, err
+}
+
+func mqttString(p []byte, s string) []byte {
+	p = binary.BigEndian.AppendUint16(p, uint16(len(s)))
+	return append(p, s...)
+}
@@ -0,0 +1,89 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import "sync"
+
+// A Path is a control path shared by several amps, such as one IR
+// blaster, one RS-232 port, or one receiver's telnet connection used
+// by all its zones. Command sequences sent through a Path run one at a
+// time, whole, so two amps' sequences never interleave.
+//
+// When several are waiting, the highest priority goes first, and among
+// equals the device that's waited longest since its last turn.
+type Path struct {
+	name string
+
+	mu      sync.Mutex
+	busy    bool
+	waiting []*pathRequest
+	turn    map[string]int64 // device -> when it last went, in turns
+	turns   int64
+}
+
+type pathRequest struct {
+	device   string
+	priority int
+	ready    chan bool
+}
+
+var (
+	pathsMu sync.Mutex
+	paths   = make(map[string]*Path)
+)
+
+// SharedPath returns the Path named name, creating it if needed.
+func SharedPath(name string) *Path {
+	pathsMu.Lock()
+	defer pathsMu.Unlock()
+	p, ok := paths[name]
+	if !ok {
+		p = &Path{name: name, turn: make(map[string]int64)}
+		paths[name] = p
+	}
+	return p
+}
+
+func (p *Path) Name() string { return p.name }
+
+// Run waits for device's turn on the path and runs seq, which sends
+// its commands, returning seq's error.
+func (p *Path) Run(device string, priority int, seq func() error) error {
+	p.mu.Lock()
+	if !p.busy {
+		p.busy = true
+		p.mu.Unlock()
+	} else {
+		req := &pathRequest{device, priority, make(chan bool)}
+		p.waiting = append(p.waiting, req)
+		p.mu.Unlock()
+		<-req.ready
+	}
+	defer p.next()
+	p.mu.Lock()
+	p.turns++
+	p.turn[device] = p.turns
+	p.mu.Unlock()
+	return seq()
+}
+
+// next hands the path to the next waiting request, if any.
+func (p *Path) next() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiting) == 0 {
+		p.busy = false
+		return
+	}
+	best := 0
+	for i, r := range p.waiting {
+		b := p.waiting[best]
+		if r.priority > b.priority || (r.priority == b.priority && p.turn[r.device] < p.turn[b.device]) {
+			best = i
+		}
+	}
+	r := p.waiting[best]
+	p.waiting = append(p.waiting[:best], p.waiting[best+1:]...)
+	close(r.ready)
+}
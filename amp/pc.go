@@ -0,0 +1,162 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PC is a computer playing the part of the amp, like an HTPC driving
+// powered monitors: woken with a Wake-on-LAN magic packet, and
+// suspended (or shut down) by a command run over ssh(1), which must be
+// able to log in without a password.
+type PC struct {
+	Host      string // for ssh, and to see whether it's up
+	User      string // to log in as over SSH; empty for ssh's default
+	MAC       net.HardwareAddr
+	Broadcast string // where to send the magic packet; default 255.255.255.255:9
+	Command   string // run to turn it off; default "sudo systemctl suspend"
+
+	mu      sync.Mutex
+	on      bool      // as last set
+	settled time.Time // when it should have woken or gone to sleep
+}
+
+const (
+	pcSettle     = 2 * time.Minute  // how long a PC may take to wake or sleep
+	pcTimeout    = 30 * time.Second // for the ssh command
+	pcSSHTimeout = 2 * time.Second  // for seeing whether it's up
+)
+
+// NewPC returns the Backend for the PC at host with the MAC address
+// mac, suspended by running command as user.
+func NewPC(host, user, mac, broadcast, command string) (*PC, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, err
+	}
+	if broadcast == "" {
+		broadcast = "255.255.255.255:9"
+	} else if _, _, err := net.SplitHostPort(broadcast); err != nil {
+		broadcast = net.JoinHostPort(broadcast, "9")
+	}
+	if command == "" {
+		command = "sudo systemctl suspend"
+	}
+	return &PC{Host: host, User: user, MAC: hw, Broadcast: broadcast, Command: command}, nil
+}
+
+func (p *PC) Addr() string { return "pc:" + p.Host }
+
+func (p *PC) PowerCommands(on bool) []string {
+	if on {
+		return []string{"wake"}
+	}
+	return []string{"sleep"}
+}
+
+func (p *PC) SendCommand(cmd string) error {
+	var err error
+	switch cmd {
+	case "wake":
+		err = p.wake()
+	case "sleep":
+		err = p.sleep()
+	default:
+		return fmt.Errorf("pc: unknown command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.on = cmd == "wake"
+	p.settled = time.Now().Add(pcSettle)
+	return nil
+}
+
+// wake sends the magic packet: six 0xff bytes, then the MAC address
+// sixteen times.
+func (p *PC) wake() error {
+	pkt := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for i := 0; i < 16; i++ {
+		pkt = append(pkt, p.MAC...)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", p.Broadcast)
+	if err != nil {
+		return err
+	}
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()          // Go sets SO_BROADCAST on UDP sockets
+	for i := 0; i < 3; i++ { // it's UDP
+		if _, err := c.WriteToUDP(pkt, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sleep runs Command over SSH. The connection may well drop as the
+// PC goes to sleep, so that's not taken as failure.
+func (p *PC) sleep() error {
+	target := p.Host
+	if p.User != "" {
+		target = p.User + "@" + p.Host
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pcTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", "-o", "ConnectTimeout=10", target, p.Command)
+	out, err := cmd.CombinedOutput()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 255 && strings.Contains(string(out), "closed") {
+		return nil
+	}
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if i := strings.LastIndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		}
+		return fmt.Errorf("ssh %s %q: %v: %s", target, p.Command, err, msg)
+	}
+	return nil
+}
+
+// QueryPower reports whether the PC is up: whether anything answers
+// on its SSH port. Until it's had pcSettle to wake or sleep, it's taken
+// to be as last set.
+func (p *PC) QueryPower() (on bool, err error) {
+	p.mu.Lock()
+	on, settling := p.on, time.Now().Before(p.settled)
+	p.mu.Unlock()
+	if settling {
+		return on, nil
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(p.Host, "22"), pcSSHTimeout)
+	if err == nil {
+		c.Close()
+		return true, nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true, nil // up, just not running sshd
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, syscall.EHOSTUNREACH) {
+		return false, nil
+	}
+	return false, err
+}
+
+// QuerySource returns "": a PC has no inputs to speak of.
+func (p *PC) QuerySource() (string, error) { return "", nil }
@@ -0,0 +1,90 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PDU is an amp powered from an outlet of a switched rack PDU,
+// controlled over SNMP.
+type PDU struct {
+	Host      string // host or host:port; the port defaults to 161
+	Community string // with write access
+	Outlet    int    // from 1
+	PDUOIDs
+}
+
+// PDUOIDs is how a PDU's outlets are switched: setting Set, plus the
+// outlet, to On or Off, and reading Get, plus the outlet, which is
+// IsOn while the outlet's on.
+type PDUOIDs struct {
+	Set     string
+	On, Off int
+	Get     string
+	IsOn    int
+}
+
+// PDUKinds are the OIDs of the PDUs known.
+var PDUKinds = map[string]PDUOIDs{
+	// APC's rack PDUs (AP7900 and the like): rPDUOutletControlOutletCommand.
+	"apc": {
+		Set: "1.3.6.1.4.1.318.1.1.12.3.3.1.1.4", On: 1, Off: 2,
+		Get: "1.3.6.1.4.1.318.1.1.12.3.3.1.1.4", IsOn: 1,
+	},
+	// APC's older MasterSwitches: sPDUOutletCtl.
+	"apc-masterswitch": {
+		Set: "1.3.6.1.4.1.318.1.1.4.4.2.1.3", On: 1, Off: 2,
+		Get: "1.3.6.1.4.1.318.1.1.4.4.2.1.3", IsOn: 1,
+	},
+	// Raritan's PX2 and PX3, the first PDU of a chain:
+	// switchingOperation and outletSwitchingState.
+	"raritan": {
+		Set: "1.3.6.1.4.1.13742.6.4.1.2.1.2.1", On: 1, Off: 0,
+		Get: "1.3.6.1.4.1.13742.6.4.1.2.1.3.1", IsOn: 7,
+	},
+}
+
+// NewPDU returns the Backend for outlet of the PDU of kind, one of
+// PDUKinds, at host.
+func NewPDU(kind, host, community string, outlet int) (*PDU, error) {
+	oids, ok := PDUKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown PDU kind %q; want apc, apc-masterswitch or raritan", kind)
+	}
+	return &PDU{Host: host, Community: community, Outlet: outlet, PDUOIDs: oids}, nil
+}
+
+func (p *PDU) Addr() string { return "pdu:" + p.Host + "#" + strconv.Itoa(p.Outlet) }
+
+func (p *PDU) PowerCommands(on bool) []string {
+	if on {
+		return []string{"on"}
+	}
+	return []string{"off"}
+}
+
+func (p *PDU) SendCommand(cmd string) error {
+	v := p.Off
+	switch cmd {
+	case "on":
+		v = p.On
+	case "off":
+	default:
+		return fmt.Errorf("pdu: unknown command %q", cmd)
+	}
+	_, err := snmpCall(p.Host, p.Community, snmpSet, p.oid(p.Set), v)
+	return err
+}
+
+func (p *PDU) QueryPower() (on bool, err error) {
+	v, err := snmpCall(p.Host, p.Community, snmpGet, p.oid(p.Get), 0)
+	return v == p.IsOn, err
+}
+
+// QuerySource returns "": an outlet has no inputs.
+func (p *PDU) QuerySource() (string, error) { return "", nil }
+
+func (p *PDU) oid(base string) string { return base + "." + strconv.Itoa(p.Outlet) }
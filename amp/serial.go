@@ -0,0 +1,193 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serial is an amp controlled over an RS-232 port with configurable
+// command strings, for older receivers and power amps without a
+// network port.
+type Serial struct {
+	Port string
+	Baud int
+	SerialCommands
+
+	port *serialPort
+
+	mu sync.Mutex
+	on bool // as last set, for amps without Status
+}
+
+// SerialCommands is what a Serial amp understands.
+type SerialCommands struct {
+	// On and Off are the commands that turn the amp on and off,
+	// each sent followed by EOL.
+	On, Off []string
+	EOL     string
+
+	// Status, if set, is the query for the amp's power state: a
+	// reply line starting with OnReply means on, and one starting
+	// with OffReply (or, if that's empty, any other line) off.
+	// Without Status, the amp is taken to be as last set.
+	Status   string
+	OnReply  string
+	OffReply string
+}
+
+// DenonSerial is the command set for Denon receivers, the same on
+// their serial port as over telnet.
+var DenonSerial = SerialCommands{
+	On:       []string{"PWON"},
+	Off:      []string{"PWSTANDBY"},
+	EOL:      "\r",
+	Status:   "PW?",
+	OnReply:  "PWON",
+	OffReply: "PWSTANDBY",
+}
+
+const (
+	serialGap     = 200 * time.Millisecond // after each command, before the next
+	serialTimeout = time.Second            // for a status reply
+)
+
+// NewSerial returns the Backend for the amp on port at baud that
+// understands cmds. Amps on the same port share it.
+func NewSerial(port string, baud int, cmds SerialCommands) *Serial {
+	return &Serial{Port: port, Baud: baud, SerialCommands: cmds, port: getSerialPort(port, baud)}
+}
+
+func (a *Serial) Addr() string { return "serial:" + a.Port }
+
+func (a *Serial) PowerCommands(on bool) []string {
+	if on {
+		return a.On
+	}
+	return a.Off
+}
+
+func (a *Serial) SendCommand(cmd string) error {
+	err := a.port.do(func(f *os.File) error {
+		_, err := f.Write([]byte(cmd + a.EOL))
+		time.Sleep(serialGap)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.On {
+		if c == cmd {
+			a.on = true
+		}
+	}
+	for _, c := range a.Off {
+		if c == cmd {
+			a.on = false
+		}
+	}
+	return nil
+}
+
+func (a *Serial) QueryPower() (on bool, err error) {
+	if a.Status == "" {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.on, nil
+	}
+	var found bool
+	err = a.port.do(func(f *os.File) error {
+		if _, err := f.Write([]byte(a.Status + a.EOL)); err != nil {
+			return err
+		}
+		var buf []byte
+		deadline := time.Now().Add(serialTimeout)
+		for time.Now().Before(deadline) {
+			b := make([]byte, 256)
+			n, err := f.Read(b) // times out after a tenth of a second
+			if err != nil {
+				return err
+			}
+			buf = append(buf, b[:n]...)
+			for {
+				i := bytes.IndexAny(buf, "\r\n")
+				if i < 0 {
+					break
+				}
+				line := strings.TrimSpace(string(buf[:i]))
+				buf = buf[i+1:]
+				switch {
+				case line == "":
+				case strings.HasPrefix(line, a.OnReply):
+					on, found = true, true
+				case a.OffReply == "" || strings.HasPrefix(line, a.OffReply):
+					on, found = false, true
+				}
+				if found {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("no reply to %q on %s", a.Status, a.Port)
+	}
+	return on, err
+}
+
+// QuerySource returns "": inputs aren't queried over serial.
+func (a *Serial) QuerySource() (string, error) { return "", nil }
+
+// A serialPort is an open serial port shared by the amps on it.
+type serialPort struct {
+	dev  string
+	baud int
+
+	mu sync.Mutex // held while in use
+	f  *os.File   // or nil if not open
+}
+
+var (
+	serialMu    sync.Mutex
+	serialPorts = make(map[string]*serialPort)
+)
+
+func getSerialPort(dev string, baud int) *serialPort {
+	serialMu.Lock()
+	defer serialMu.Unlock()
+	p, ok := serialPorts[dev]
+	if !ok {
+		p = &serialPort{dev: dev, baud: baud}
+		serialPorts[dev] = p
+	}
+	return p
+}
+
+// do calls f with the port to itself, opening it if needed. After an
+// error the port is closed, to be opened afresh next time, in case
+// its USB adapter was replugged.
+func (p *serialPort) do(f func(*os.File) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		var err error
+		if p.f, err = openSerial(p.dev, p.baud); err != nil {
+			return err
+		}
+	}
+	err := f(p.f)
+	if err != nil {
+		p.f.Close()
+		p.f = nil
+	}
+	return err
+}
@@ -0,0 +1,247 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// As much SNMP as switching a PDU's outlets takes: v2c GET and SET of
+// one integer.
+
+const (
+	snmpGet      = 0xa0
+	snmpResponse = 0xa2
+	snmpSet      = 0xa3
+
+	snmpTimeout  = 2 * time.Second // per attempt
+	snmpAttempts = 3               // it's UDP
+)
+
+var snmpErrors = map[int]string{
+	1:  "tooBig",
+	2:  "noSuchName",
+	3:  "badValue",
+	4:  "readOnly",
+	5:  "genErr",
+	6:  "noAccess",
+	7:  "wrongType",
+	10: "wrongValue",
+	16: "authorizationError",
+	17: "notWritable",
+}
+
+// snmpCall sends a GET, or a SET of value, of the integer oid to the
+// agent at host (port 161 by default), and returns the value in its
+// response.
+func snmpCall(host, community string, op byte, oid string, value int) (int, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "161")
+	}
+	o, err := berOID(oid)
+	if err != nil {
+		return 0, err
+	}
+	v := []byte{0x05, 0} // NULL, for a GET
+	if op == snmpSet {
+		v = ber(0x02, berInt(value))
+	}
+	id := rand.Int31()
+	req := ber(0x30, berCat(
+		ber(0x02, berInt(1)), // v2c
+		ber(0x04, []byte(community)),
+		ber(op, berCat(
+			ber(0x02, berInt(int(id))),
+			ber(0x02, berInt(0)),
+			ber(0x02, berInt(0)),
+			ber(0x30, ber(0x30, berCat(o, v))),
+		)),
+	))
+	c, err := net.Dial("udp", host)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	buf := make([]byte, 1500)
+	for attempt := 1; ; attempt++ {
+		if _, err := c.Write(req); err != nil {
+			return 0, err
+		}
+		c.SetReadDeadline(time.Now().Add(snmpTimeout))
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() && attempt < snmpAttempts {
+					break
+				}
+				return 0, err
+			}
+			gotID, val, err := snmpParse(buf[:n])
+			if err != nil {
+				return 0, err
+			}
+			if gotID == int(id) {
+				return val, nil
+			}
+			// A late reply to an earlier attempt's lost twin; wait on.
+		}
+	}
+}
+
+// snmpParse returns the request ID and the one integer value of the
+// response msg.
+func snmpParse(msg []byte) (id, val int, err error) {
+	seq, _, err := berNext(msg, 0x30)
+	if err == nil {
+		_, seq, err = berNext(seq, 0x02) // version
+	}
+	if err == nil {
+		_, seq, err = berNext(seq, 0x04) // community
+	}
+	var pdu []byte
+	if err == nil {
+		pdu, _, err = berNext(seq, snmpResponse)
+	}
+	var f [3]int // request ID, error status, error index
+	for i := range f {
+		var b []byte
+		if err == nil {
+			b, pdu, err = berNext(pdu, 0x02)
+			f[i] = berToInt(b)
+		}
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("snmp: bad response: %v", err)
+	}
+	if f[1] != 0 {
+		name, ok := snmpErrors[f[1]]
+		if !ok {
+			name = "error " + strconv.Itoa(f[1])
+		}
+		return f[0], 0, fmt.Errorf("snmp: %s", name)
+	}
+	vbs, _, err := berNext(pdu, 0x30)
+	var vb []byte
+	if err == nil {
+		vb, _, err = berNext(vbs, 0x30)
+	}
+	if err == nil {
+		_, vb, err = berNext(vb, 0x06) // the OID
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("snmp: bad response: %v", err)
+	}
+	if len(vb) > 0 && vb[0] >= 0x80 && vb[0] <= 0x82 {
+		return f[0], 0, errors.New("snmp: no such object")
+	}
+	b, _, err := berNext(vb, 0x02)
+	if err != nil {
+		return 0, 0, fmt.Errorf("snmp: value not an integer")
+	}
+	return f[0], berToInt(b), nil
+}
+
+func berCat(bs ...[]byte) []byte {
+	var all []byte
+	for _, b := range bs {
+		all = append(all, b...)
+	}
+	return all
+}
+
+// ber encodes a BER TLV.
+func ber(tag byte, content []byte) []byte {
+	n := len(content)
+	switch {
+	case n < 0x80:
+		return append([]byte{tag, byte(n)}, content...)
+	case n < 0x100:
+		return append([]byte{tag, 0x81, byte(n)}, content...)
+	}
+	return append([]byte{tag, 0x82, byte(n >> 8), byte(n)}, content...)
+}
+
+// berInt is v's content as a BER INTEGER: two's complement, in as
+// few bytes as keep its sign.
+func berInt(v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if v >= -128 && v < 128 {
+			return b
+		}
+		v >>= 8
+	}
+}
+
+func berToInt(b []byte) int {
+	v := 0
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		v = -1
+	}
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// berOID encodes a dotted OID, like "1.3.6.1.2.1.1.5.0".
+func berOID(s string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("bad OID %q", s)
+	}
+	var ns []int
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad OID %q", s)
+		}
+		ns = append(ns, n)
+	}
+	b := []byte{byte(40*ns[0] + ns[1])}
+	for _, n := range ns[2:] {
+		// Base 128, most significant first, the high bit set on
+		// all but the last.
+		enc := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			enc = append([]byte{byte(n&0x7f) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return ber(0x06, b), nil
+}
+
+// berNext splits off b's first TLV, which must have the tag, and
+// returns its content and what follows.
+func berNext(b []byte, tag byte) (content, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("truncated")
+	}
+	if b[0] != tag {
+		return nil, nil, fmt.Errorf("tag %#x, want %#x", b[0], tag)
+	}
+	n, hdr := int(b[1]), 2
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 2 || len(b) < 2+k {
+			return nil, nil, errors.New("bad length")
+		}
+		n = 0
+		for _, c := range b[2 : 2+k] {
+			n = n<<8 | int(c)
+		}
+		hdr += k
+	}
+	if len(b) < hdr+n {
+		return nil, nil, errors.New("truncated")
+	}
+	return b[hdr : hdr+n], b[hdr+n:], nil
+}
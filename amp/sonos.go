@@ -0,0 +1,118 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Sonos is a Sonos player, typically a Port or Connect feeding an
+// amp, "turned on" by joining the group of another player, the
+// coordinator, and off by leaving it.
+type Sonos struct {
+	Host        string // host or host:port; the port defaults to 1400
+	Coordinator string // its UUID, like "RINCON_000E58A0123401400"
+}
+
+// NewSonos returns the Backend for the player at host joining the
+// group of coordinator.
+func NewSonos(host, coordinator string) *Sonos {
+	return &Sonos{Host: host, Coordinator: coordinator}
+}
+
+func (s *Sonos) Addr() string { return "sonos:" + s.Host }
+
+func (s *Sonos) PowerCommands(on bool) []string {
+	if on {
+		return []string{"join"}
+	}
+	return []string{"leave"}
+}
+
+func (s *Sonos) SendCommand(cmd string) error {
+	var err error
+	switch cmd {
+	case "join":
+		_, err = s.avTransport("SetAVTransportURI", "<CurrentURI>"+html.EscapeString(s.groupURI())+"</CurrentURI><CurrentURIMetaData></CurrentURIMetaData>")
+	case "leave":
+		_, err = s.avTransport("BecomeCoordinatorOfStandaloneGroup", "")
+	default:
+		err = fmt.Errorf("sonos: unknown command %q", cmd)
+	}
+	return err
+}
+
+func (s *Sonos) groupURI() string { return "x-rincon:" + s.Coordinator }
+
+// QueryPower reports whether the player is in the coordinator's group.
+func (s *Sonos) QueryPower() (on bool, err error) {
+	r, err := s.avTransport("GetMediaInfo", "")
+	if err != nil {
+		return false, err
+	}
+	return r["CurrentURI"] == s.groupURI(), nil
+}
+
+// QuerySource returns "".
+func (s *Sonos) QuerySource() (string, error) { return "", nil }
+
+var sonosClient = &http.Client{Timeout: 5 * time.Second}
+
+// avTransport calls action on the player's AVTransport service for
+// instance 0 with the XML arguments args, and returns the reply's
+// arguments.
+func (s *Sonos) avTransport(action, args string) (map[string]string, error) {
+	const service = "urn:schemas-upnp-org:service:AVTransport:1"
+	body := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="` + service + `"><InstanceID>0</InstanceID>` + args + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+	host := s.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "1400")
+	}
+	req, err := http.NewRequest("POST", "http://"+host+"/MediaRenderer/AVTransport/Control", bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPACTION", `"`+service+"#"+action+`"`)
+	res, err := sonosClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sonos %s: %s", action, res.Status)
+	}
+	var env struct {
+		Body struct {
+			Response struct {
+				Args []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		}
+	}
+	if err := xml.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("sonos %s: %v", action, err)
+	}
+	r := make(map[string]string)
+	for _, a := range env.Body.Response.Args {
+		r[a.XMLName.Local] = a.Value
+	}
+	return r, nil
+}
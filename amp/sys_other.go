@@ -0,0 +1,17 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !linux
+
+package amp
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotLinux = errors.New("serial ports and USB relays are only supported on Linux")
+
+func openSerial(dev string, baud int) (*os.File, error) { return nil, errNotLinux }
+
+func hidFeature(f *os.File, buf []byte, set bool) error { return errNotLinux }
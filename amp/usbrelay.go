@@ -0,0 +1,130 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// USBRelay is an amp switched by one relay of a USB relay board,
+// typically closing its 12V trigger loop. Boards come in two kinds:
+// HID ones ("USBRelay2" and the like, at /dev/hidrawN) and CH340
+// serial ones ("LCUS", at /dev/ttyUSBN).
+type USBRelay struct {
+	Device string
+	Relay  int // numbered from 1
+
+	hid bool
+
+	mu sync.Mutex
+	on bool // serial boards can't be asked, so what was last set
+}
+
+// NewUSBRelay returns the Backend for relay of the board at device.
+// kind is "hid" or "serial", or empty to guess from the device name.
+func NewUSBRelay(device string, relay int, kind string) (*USBRelay, error) {
+	if relay < 1 || relay > 8 {
+		return nil, fmt.Errorf("usbrelay %s: relay must be 1 to 8", device)
+	}
+	r := &USBRelay{Device: device, Relay: relay}
+	switch kind {
+	case "":
+		r.hid = strings.Contains(device, "hidraw")
+	case "hid":
+		r.hid = true
+	case "serial":
+	default:
+		return nil, fmt.Errorf("usbrelay %s: kind must be hid or serial", device)
+	}
+	return r, nil
+}
+
+func (r *USBRelay) Addr() string { return fmt.Sprintf("usbrelay:%s#%d", r.Device, r.Relay) }
+
+func (r *USBRelay) PowerCommands(on bool) []string {
+	if on {
+		return []string{"on"}
+	}
+	return []string{"off"}
+}
+
+func (r *USBRelay) SendCommand(cmd string) error {
+	var on bool
+	switch cmd {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return fmt.Errorf("usbrelay: unknown command %q", cmd)
+	}
+	var err error
+	if r.hid {
+		err = r.setHID(on)
+	} else {
+		err = r.setSerial(on)
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.on = on
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *USBRelay) setHID(on bool) error {
+	f, err := os.OpenFile(r.Device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := []byte{0, 0xFD, byte(r.Relay), 0, 0, 0, 0, 0, 0}
+	if on {
+		buf[1] = 0xFF
+	}
+	return hidFeature(f, buf, true)
+}
+
+// setSerial sends the LCUS command: 0xA0, the relay, 1 or 0, and
+// their sum as a checksum.
+func (r *USBRelay) setSerial(on bool) error {
+	f, err := openSerial(r.Device, 9600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var v byte
+	if on {
+		v = 1
+	}
+	_, err = f.Write([]byte{0xA0, byte(r.Relay), v, 0xA0 + byte(r.Relay) + v})
+	return err
+}
+
+// QueryPower reports whether the relay is closed. Serial boards can't
+// say, so for them it's what was last set, and open at first.
+func (r *USBRelay) QueryPower() (on bool, err error) {
+	if !r.hid {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.on, nil
+	}
+	f, err := os.OpenFile(r.Device, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := hidFeature(f, buf, false); err != nil {
+		return false, err
+	}
+	// The eighth byte has a bit per relay.
+	return buf[7]&(1<<uint(r.Relay-1)) != 0, nil
+}
+
+// QuerySource returns "": a relay has no inputs.
+func (r *USBRelay) QuerySource() (string, error) { return "", nil }
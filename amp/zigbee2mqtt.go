@@ -0,0 +1,110 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package amp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Zigbee2MQTT is a device switched by a Zigbee plug, through
+// zigbee2mqtt and its MQTT broker. A command only succeeds once the
+// plug reports the state it was set to.
+type Zigbee2MQTT struct {
+	Broker   string // host or host:port; the port defaults to 1883
+	User     string // empty for none
+	Password string
+	Base     string // zigbee2mqtt's base topic; default "zigbee2mqtt"
+	Device   string // the plug's friendly name
+}
+
+// z2mTimeout is how long the plug has to report its state.
+const z2mTimeout = 10 * time.Second
+
+// NewZigbee2MQTT returns the Backend for the plug named device, under
+// the base topic base on the broker.
+func NewZigbee2MQTT(broker, user, password, base, device string) *Zigbee2MQTT {
+	if base == "" {
+		base = "zigbee2mqtt"
+	}
+	return &Zigbee2MQTT{Broker: broker, User: user, Password: password, Base: base, Device: device}
+}
+
+func (z *Zigbee2MQTT) Addr() string { return "zigbee2mqtt:" + z.Device }
+
+func (z *Zigbee2MQTT) PowerCommands(on bool) []string {
+	if on {
+		return []string{"ON"}
+	}
+	return []string{"OFF"}
+}
+
+// SendCommand sets the plug to cmd, "ON" or "OFF", and waits for it to
+// report that it is.
+func (z *Zigbee2MQTT) SendCommand(cmd string) error {
+	if cmd != "ON" && cmd != "OFF" {
+		return fmt.Errorf("zigbee2mqtt: unknown command %q", cmd)
+	}
+	state, err := z.exchange("/set", cmd)
+	if err != nil {
+		return err
+	}
+	if state != cmd {
+		return fmt.Errorf("zigbee2mqtt: %s reported %s after being set %s", z.Device, state, cmd)
+	}
+	return nil
+}
+
+func (z *Zigbee2MQTT) QueryPower() (on bool, err error) {
+	state, err := z.exchange("/get", "")
+	return state == "ON", err
+}
+
+// QuerySource returns "": a plug has no inputs.
+func (z *Zigbee2MQTT) QuerySource() (string, error) { return "", nil }
+
+// exchange publishes {"state": state} to the plug's topic plus suffix
+// and returns the next state it reports, ignoring any retained from
+// before. Setting a state, it waits for that one, as the plug may
+// report others (its power use, say) in between.
+func (z *Zigbee2MQTT) exchange(suffix, state string) (string, error) {
+	m, err := dialMQTT(z.Broker, z.User, z.Password, z2mTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	topic := z.Base + "/" + z.Device
+	if err := m.subscribe(topic); err != nil {
+		return "", err
+	}
+	req, _ := json.Marshal(map[string]string{"state": state})
+	if err := m.publish(topic+suffix, req); err != nil {
+		return "", err
+	}
+	last := ""
+	for {
+		msg, err := m.next()
+		if err != nil {
+			if last != "" {
+				return last, nil
+			}
+			return "", fmt.Errorf("zigbee2mqtt: no state from %s: %v", z.Device, err)
+		}
+		if msg.retained || msg.topic != topic {
+			continue
+		}
+		var st struct {
+			State string `json:"state"`
+		}
+		if json.Unmarshal(msg.payload, &st) != nil || st.State == "" {
+			continue
+		}
+		last = strings.ToUpper(st.State)
+		if state == "" || last == state {
+			return last, nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+// Package capture provides audio for sonden to listen to: recorded
+// live from a sound card, or read from a file. Either way it's mono
+// signed 16-bit little-endian samples at SampleHz.
+package capture
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// SampleHz is the rate of the samples sonden listens to.
+const SampleHz = 8 << 10
+
+// Open opens a prerecorded file of samples, or stdin if name is "-".
+// WAV and FLAC are decoded; anything else should be in the same
+// format Start produces. If realtime, reads are slowed to the rate
+// the samples would have been recorded at. Open also listens on
+// network inputs, as described in net.go; they arrive in
+// real time, and never end.
+func Open(name string, realtime bool) (io.ReadCloser, error) {
+	if IsNetwork(name) {
+		return openNetwork(name)
+	}
+	var f io.ReadCloser = io.NopCloser(os.Stdin)
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	dec, err := decodeInput(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	var r io.ReadCloser = &multiCloser{dec, []io.Closer{dec, f}}
+	if realtime {
+		r = &pacedReader{ReadCloser: r, bytesPerSec: SampleHz * 2}
+	}
+	return r, nil
+}
+
+// multiCloser is a Reader that closes several things.
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (mc *multiCloser) Close() error {
+	var err error
+	for _, c := range mc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// pacedReader limits reads to bytesPerSec on average.
+type pacedReader struct {
+	io.ReadCloser
+	bytesPerSec int
+	start       time.Time
+	n           int64
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	due := r.start.Add(time.Duration(r.n) * time.Second / time.Duration(r.bytesPerSec))
+	time.Sleep(time.Until(due))
+	if max := r.bytesPerSec / 10; len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// cmdReader reads a command's stdout and kills it on Close.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Close() error {
+	r.cmd.Process.Kill()
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// maxClockDrift is how far a Clock may disagree with the wall clock
+// before it's re-anchored.
+const maxClockDrift = 2 * time.Second
+
+// A Clock maps sample counts to the time the samples were captured,
+// from the rate they arrive at rather than when we got around to
+// reading them.
+type Clock struct {
+	Rate int  // samples per second
+	Free bool // never re-anchor, for reading as fast as possible
+
+	start time.Time // capture time of sample 0
+	n     int64     // samples read
+}
+
+// Add records that n more samples have been read.
+func (c *Clock) Add(n int) {
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+	c.n += int64(n)
+}
+
+// Time returns the capture time of the end of the most recently read
+// sample. If the recorder's clock has drifted from ours, or we fell
+// behind and it dropped samples, the clock is re-anchored to now.
+func (c *Clock) Time() time.Time {
+	now := time.Now()
+	t := c.start.Add(time.Duration(c.n) * time.Second / time.Duration(c.Rate))
+	if d := now.Sub(t); !c.Free && (d > maxClockDrift || d < -maxClockDrift) {
+		c.start = c.start.Add(d)
+		t = now
+	}
+	return t
+}
@@ -0,0 +1,189 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+)
+
+// decodeInput sniffs r for a WAV or FLAC header and returns a reader
+// of the audio converted to the mono S16LE at SampleHz that the
+// detector wants. Anything else is assumed to already be in that
+// format. FLAC is decoded with flac(1).
+func decodeInput(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && len(magic) == 0 {
+		return nil, err
+	}
+	switch string(magic) {
+	case "RIFF":
+		return decodeWAV(br)
+	case "fLaC":
+		cmd := exec.Command("flac", "--decode", "--stdout", "--silent", "-")
+		cmd.Stdin = br
+		out, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("decoding FLAC: %v", err)
+		}
+		wav, err := decodeWAV(bufio.NewReader(out))
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, err
+		}
+		return &cmdReader{wav, cmd}, nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type wavFormat struct {
+	format   uint16 // 1 = integer PCM, 3 = float
+	channels uint16
+	rate     uint32
+	bits     uint16
+}
+
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xfffe
+)
+
+// decodeWAV reads a WAV header from r and returns a converting reader
+// positioned at the start of its data.
+func decodeWAV(r *bufio.Reader) (io.ReadCloser, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[:4]) != "RIFF" || string(riff[8:]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	var wf *wavFormat
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("reading WAV chunk header: %v", err)
+		}
+		id, size := string(hdr[:4]), binary.LittleEndian.Uint32(hdr[4:])
+		switch id {
+		case "fmt ":
+			buf := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, buf); err != nil || size < 16 {
+				return nil, fmt.Errorf("bad WAV fmt chunk")
+			}
+			wf = &wavFormat{
+				format:   binary.LittleEndian.Uint16(buf[0:]),
+				channels: binary.LittleEndian.Uint16(buf[2:]),
+				rate:     binary.LittleEndian.Uint32(buf[4:]),
+				bits:     binary.LittleEndian.Uint16(buf[14:]),
+			}
+			if wf.format == wavExtensible && size >= 26 {
+				wf.format = binary.LittleEndian.Uint16(buf[24:]) // subformat GUID's first two bytes
+			}
+		case "data":
+			if wf == nil {
+				return nil, errors.New("WAV data before fmt chunk")
+			}
+			return newPCMConverter(r, wf)
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return nil, fmt.Errorf("skipping WAV %q chunk: %v", id, err)
+			}
+		}
+	}
+}
+
+// pcmConverter mixes interleaved PCM down to mono int16 and resamples
+// it (by picking the nearest sample, which is plenty for measuring
+// loudness) to SampleHz.
+type pcmConverter struct {
+	r     io.Reader
+	wf    wavFormat
+	frame []byte // one input frame
+	in    int64  // input frames read
+	out   int64  // output samples produced
+	cur   int16  // most recent input frame, mixed to mono
+	buf   []byte // converted output not yet returned
+}
+
+func newPCMConverter(r io.Reader, wf *wavFormat) (*pcmConverter, error) {
+	switch {
+	case wf.format == wavPCM && (wf.bits == 8 || wf.bits == 16 || wf.bits == 24 || wf.bits == 32):
+	case wf.format == wavFloat && wf.bits == 32:
+	default:
+		return nil, fmt.Errorf("unsupported WAV format %d with %d bits per sample", wf.format, wf.bits)
+	}
+	if wf.channels == 0 || wf.rate == 0 {
+		return nil, errors.New("bad WAV header")
+	}
+	return &pcmConverter{
+		r:     r,
+		wf:    *wf,
+		frame: make([]byte, int(wf.channels)*int(wf.bits/8)),
+	}, nil
+}
+
+func (c *pcmConverter) Close() error { return nil }
+
+// sample decodes one channel's sample from b to int16 range.
+func (c *pcmConverter) sample(b []byte) int {
+	switch {
+	case c.wf.format == wavFloat:
+		f := math.Float32frombits(binary.LittleEndian.Uint32(b))
+		return int(math.Max(-1, math.Min(1, float64(f))) * math.MaxInt16)
+	case c.wf.bits == 8:
+		return (int(b[0]) - 128) << 8 // 8-bit WAV is unsigned
+	case c.wf.bits == 16:
+		return int(int16(binary.LittleEndian.Uint16(b)))
+	case c.wf.bits == 24:
+		return int(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 16)
+	default:
+		return int(int32(binary.LittleEndian.Uint32(b)) >> 16)
+	}
+}
+
+func (c *pcmConverter) readFrame() error {
+	if _, err := io.ReadFull(c.r, c.frame); err != nil {
+		return err
+	}
+	c.in++
+	width := int(c.wf.bits / 8)
+	sum := 0
+	for ch := 0; ch < int(c.wf.channels); ch++ {
+		sum += c.sample(c.frame[ch*width:])
+	}
+	c.cur = int16(sum / int(c.wf.channels))
+	return nil
+}
+
+func (c *pcmConverter) Read(p []byte) (int, error) {
+	for len(c.buf) < len(p) && len(c.buf) < 4096 {
+		// Input frame index of the next output sample.
+		want := c.out*int64(c.wf.rate)/SampleHz + 1
+		for c.in < want {
+			if err := c.readFrame(); err != nil {
+				if len(c.buf) > 0 {
+					break
+				}
+				return 0, err
+			}
+		}
+		if c.in < want {
+			break
+		}
+		c.buf = binary.LittleEndian.AppendUint16(c.buf, uint16(c.cur))
+		c.out++
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	return n, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Mixer is the capture gain control of a sound card's ALSA mixer,
+// worked with amixer(1).
+type Mixer struct {
+	Device  string // amixer's -D, like "hw:CARD=Audio"; empty for the default
+	Control string // simple control name; empty for "Capture"
+}
+
+// MixerFor returns the mixer of the card that alsaDev, a device name
+// for Start, records from: "plughw:CARD=Audio,DEV=0" is on the mixer
+// "hw:CARD=Audio". An empty alsaDev is the default card.
+func MixerFor(alsaDev, control string) Mixer {
+	dev := strings.TrimPrefix(alsaDev, "plug")
+	dev, _, _ = strings.Cut(dev, ",")
+	return Mixer{Device: dev, Control: control}
+}
+
+func (m Mixer) control() string {
+	if m.Control == "" {
+		return "Capture"
+	}
+	return m.Control
+}
+
+func (m Mixer) amixer(args ...string) ([]byte, error) {
+	if m.Device != "" {
+		args = append([]string{"-D", m.Device}, args...)
+	}
+	out, err := exec.Command("amixer", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("amixer %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+var mixerPercent = regexp.MustCompile(`\[(\d+)%\]`)
+
+// Gain returns the control's gain, as a percentage of its range. For
+// a stereo control it's the first channel's.
+func (m Mixer) Gain() (float64, error) {
+	out, err := m.amixer("sget", m.control())
+	if err != nil {
+		return 0, err
+	}
+	sm := mixerPercent.FindSubmatch(out)
+	if sm == nil {
+		return 0, fmt.Errorf("mixer control %q has no capture volume", m.control())
+	}
+	return strconv.ParseFloat(string(sm[1]), 64)
+}
+
+// SetGain sets the control's gain to pct percent of its range on all
+// channels, and turns capture on.
+func (m Mixer) SetGain(pct float64) error {
+	_, err := m.amixer("-q", "sset", m.control(), strconv.FormatFloat(pct, 'f', -1, 64)+"%", "cap")
+	return err
+}
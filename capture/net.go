@@ -0,0 +1,290 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audio can be streamed in over the network from a probe near the
+// amp, so analysis can happen somewhere else:
+//
+//	tcp://:9000    a stream per connection, like arecord -t wav | nc host 9000;
+//	               WAV or FLAC headers say its format, else it's raw like Start's
+//	rtp://:5004    RTP packets of L16 (big-endian 16-bit) audio, 44.1 kHz as
+//	               payload types 10 (stereo) and 11 (mono) say, or as given by
+//	               ?rate=48000&channels=2
+//
+// Whenever nothing arrives, the silence is filled in, so time keeps
+// passing for the detector, and lost RTP packets are replaced by
+// silence too.
+
+// netUnderrun is how long a network input can go without audio
+// before the gap is filled with silence.
+const netUnderrun = 500 * time.Millisecond
+
+// rtpMaxLost is the most lost RTP packets filled in with silence.
+// After a longer gap the underrun has already filled it in.
+const rtpMaxLost = 50
+
+// IsNetwork reports whether name, as given to Open, is a network
+// input rather than a file.
+func IsNetwork(name string) bool {
+	return strings.HasPrefix(name, "tcp://") || strings.HasPrefix(name, "rtp://")
+}
+
+func openNetwork(name string) (io.ReadCloser, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &netReader{c: make(chan []byte, 16), done: make(chan struct{}), last: time.Now()}
+	switch u.Scheme {
+	case "tcp":
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		r.closer = ln
+		go r.serveTCP(ln)
+	case "rtp":
+		q := u.Query()
+		pc, err := net.ListenPacket("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		rate, channels := 0, 0
+		if v := q.Get("rate"); v != "" {
+			if rate, err = strconv.Atoi(v); err != nil || rate <= 0 {
+				pc.Close()
+				return nil, fmt.Errorf("%s: bad rate", name)
+			}
+		}
+		if v := q.Get("channels"); v != "" {
+			if channels, err = strconv.Atoi(v); err != nil || channels <= 0 {
+				pc.Close()
+				return nil, fmt.Errorf("%s: bad channels", name)
+			}
+		}
+		r.closer = pc
+		go r.serveRTP(pc, rate, channels)
+	default:
+		return nil, fmt.Errorf("unknown network input %q", u.Scheme)
+	}
+	return r, nil
+}
+
+// A netReader is a network input, as S16LE samples at SampleHz.
+type netReader struct {
+	c      chan []byte // samples received
+	done   chan struct{}
+	closer io.Closer // the listener
+	once   sync.Once
+
+	buf  []byte    // owned by Read
+	last time.Time // owned by Read; when samples last arrived or silence was made up
+}
+
+func (r *netReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		select {
+		case b := <-r.c:
+			r.buf, r.last = b, time.Now()
+		case <-time.After(netUnderrun):
+			now := time.Now()
+			r.buf = make([]byte, 2*int(now.Sub(r.last)*SampleHz/time.Second))
+			r.last = now
+		case <-r.done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *netReader) Close() error {
+	r.once.Do(func() { close(r.done) })
+	return r.closer.Close()
+}
+
+// send passes on samples, unless r's been closed.
+func (r *netReader) send(b []byte) bool {
+	select {
+	case r.c <- b:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// serveTCP reads from one sender at a time; a new one takes over.
+func (r *netReader) serveTCP(ln net.Listener) {
+	var cur net.Conn
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if cur != nil {
+				cur.Close()
+			}
+			return
+		}
+		if cur != nil {
+			cur.Close()
+		}
+		cur = c
+		go r.readConn(c)
+	}
+}
+
+func (r *netReader) readConn(c net.Conn) {
+	defer c.Close()
+	dec, err := decodeInput(c)
+	if err != nil {
+		return
+	}
+	defer dec.Close()
+	for {
+		b := make([]byte, 4096)
+		n, err := io.ReadFull(dec, b)
+		n -= n % 2
+		if n > 0 && !r.send(b[:n]) {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rtpPayload is the default format of an RTP payload type.
+var rtpPayload = map[byte]struct{ rate, channels int }{
+	10: {44100, 2},
+	11: {44100, 1},
+}
+
+// serveRTP reads RTP packets of L16 audio, in rate and channels if
+// non-zero, else as their payload type says.
+func (r *netReader) serveRTP(pc net.PacketConn, rate, channels int) {
+	var (
+		pkt    = make([]byte, 64<<10)
+		chunk  = new(chunkReader)
+		conv   *pcmConverter
+		ssrc   uint32
+		next   uint16 // sequence number expected
+		frames int    // in the last packet
+	)
+	for {
+		n, _, err := pc.ReadFrom(pkt)
+		if err != nil {
+			return
+		}
+		payload, pt, seq, src, ok := parseRTP(pkt[:n])
+		if !ok {
+			continue
+		}
+		if conv == nil || src != ssrc {
+			// A new stream.
+			def := rtpPayload[pt]
+			wf := &wavFormat{format: wavPCM, bits: 16, rate: uint32(def.rate), channels: uint16(def.channels)}
+			if rate != 0 {
+				wf.rate = uint32(rate)
+			}
+			if channels != 0 {
+				wf.channels = uint16(channels)
+			}
+			if wf.rate == 0 {
+				wf.rate = 44100
+			}
+			if wf.channels == 0 {
+				wf.channels = 1
+			}
+			if conv, err = newPCMConverter(chunk, wf); err != nil {
+				return
+			}
+			ssrc, next = src, seq
+		}
+		switch d := int16(seq - next); {
+		case d < 0:
+			continue // late or duplicate
+		case d > 0 && d <= rtpMaxLost && frames > 0:
+			// Lost packets: fill in their silence.
+			chunk.b = make([]byte, int(d)*frames*len(conv.frame))
+			if !r.convert(conv) {
+				return
+			}
+		}
+		next = seq + 1
+		frames = len(payload) / len(conv.frame)
+		// L16 is big-endian; the converter wants little.
+		b := make([]byte, frames*len(conv.frame))
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = payload[i+1], payload[i]
+		}
+		chunk.b = b
+		if !r.convert(conv) {
+			return
+		}
+	}
+}
+
+// convert sends all that conv makes of its current chunk.
+func (r *netReader) convert(conv *pcmConverter) bool {
+	out := make([]byte, 0, 4096)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conv.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	return len(out) == 0 || r.send(out)
+}
+
+// parseRTP returns the payload, payload type, sequence number and
+// SSRC of an RTP packet.
+func parseRTP(p []byte) (payload []byte, pt byte, seq uint16, ssrc uint32, ok bool) {
+	if len(p) < 12 || p[0]>>6 != 2 {
+		return nil, 0, 0, 0, false
+	}
+	off := 12 + 4*int(p[0]&0x0f)
+	if p[0]&0x10 != 0 { // header extension
+		if len(p) < off+4 {
+			return nil, 0, 0, 0, false
+		}
+		off += 4 + 4*int(binary.BigEndian.Uint16(p[off+2:]))
+	}
+	end := len(p)
+	if p[0]&0x20 != 0 && end > 0 { // padding
+		end -= int(p[end-1])
+	}
+	if off > end {
+		return nil, 0, 0, 0, false
+	}
+	return p[off:end], p[1] & 0x7f, binary.BigEndian.Uint16(p[2:]), binary.BigEndian.Uint32(p[8:]), true
+}
+
+// A chunkReader reads one chunk at a time, then reports io.EOF until
+// it's given the next.
+type chunkReader struct {
+	b []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.b)
+	c.b = c.b[n:]
+	return n, nil
+}
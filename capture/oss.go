@@ -0,0 +1,70 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !windows
+
+package capture
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// OSS ioctls, _IOWR('P', n, int), which package syscall lacks.
+const (
+	sndctlDSPSpeed    = 0xc0045002
+	sndctlDSPSetFmt   = 0xc0045005
+	sndctlDSPChannels = 0xc0045006
+
+	afmtS16LE = 0x10
+)
+
+// startOSS records from the OSS device dev, like /dev/dsp, as found
+// on FreeBSD, without any recording program. The device is asked for
+// mono S16LE at SampleHz; if it can only do something near that, it's
+// converted.
+func startOSS(dev string) (io.ReadCloser, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	wf := &wavFormat{format: wavPCM, bits: 16}
+	for _, c := range []struct {
+		name string
+		req  uintptr
+		v    int32
+	}{
+		{"format", sndctlDSPSetFmt, afmtS16LE},
+		{"channels", sndctlDSPChannels, 1},
+		{"rate", sndctlDSPSpeed, SampleHz},
+	} {
+		v := c.v
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), c.req, uintptr(unsafe.Pointer(&v))); errno != 0 {
+			f.Close()
+			return nil, fmt.Errorf("%s: setting %s: %v", dev, c.name, errno)
+		}
+		switch c.req {
+		case sndctlDSPSetFmt:
+			if v != afmtS16LE {
+				f.Close()
+				return nil, fmt.Errorf("%s: can't record S16LE", dev)
+			}
+		case sndctlDSPChannels:
+			wf.channels = uint16(v)
+		case sndctlDSPSpeed:
+			wf.rate = uint32(v)
+		}
+	}
+	if wf.channels == 1 && wf.rate == SampleHz {
+		return f, nil
+	}
+	conv, err := newPCMConverter(f, wf)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+	return &multiCloser{conv, []io.Closer{f}}, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !windows
+
+package capture
+
+import (
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Start starts recording mono 16-bit little-endian samples at
+// SampleHz, with arecord(1) from alsaDev if non-empty, else with
+// rec(1) from the default device. On macOS, where there's no
+// arecord, a non-empty alsaDev is instead the name of the CoreAudio
+// input device for sox(1) to record from, like "Scarlett 2i2 USB".
+// An OSS device like /dev/dsp is read directly instead, for systems
+// like FreeBSD without ALSA. Closing the returned reader stops the
+// recorder.
+func Start(alsaDev string) (io.ReadCloser, error) {
+	if strings.HasPrefix(alsaDev, "/dev/dsp") {
+		return startOSS(alsaDev)
+	}
+	prog, in := "rec", []string(nil)
+	if alsaDev != "" && runtime.GOOS == "darwin" {
+		prog, in = "sox", []string{"-t", "coreaudio", alsaDev}
+	}
+	cmd := exec.Command(prog, append(in,
+		"-t", "raw",
+		"--endian", "little",
+		"-r", strconv.Itoa(SampleHz),
+		"-e", "signed",
+		"-b", "16", // 16 bits per sample
+		"-c", "1", // one channel
+		"-")...)
+	if alsaDev != "" && in == nil {
+		cmd = exec.Command("arecord",
+			"-D", alsaDev,
+			"-f", "S16_LE",
+			"-t", "raw")
+	}
+	out, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{out, cmd}, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// sampleBufSize is how many bytes a SampleReader reads at once.
+const sampleBufSize = 8 << 10
+
+// A SampleReader decodes S16LE samples from a reader in bulk, rather
+// than with a binary.Read (and a syscall, on a pipe) per sample.
+type SampleReader struct {
+	r    io.Reader
+	buf  []byte
+	have int // bytes buffered; at most 1 between calls
+	err  error
+}
+
+func NewSampleReader(r io.Reader) *SampleReader {
+	return &SampleReader{r: r, buf: make([]byte, sampleBufSize)}
+}
+
+// Read reads up to len(dst) samples into dst and returns how many it
+// read. At the end of the input it returns io.EOF, dropping any
+// trailing half sample.
+func (sr *SampleReader) Read(dst []int16) (int, error) {
+	if max := len(sr.buf) / 2; len(dst) > max {
+		dst = dst[:max]
+	}
+	for sr.err == nil && sr.have < 2*len(dst) && sr.have < 2 {
+		var n int
+		n, sr.err = sr.r.Read(sr.buf[sr.have : 2*len(dst)])
+		sr.have += n
+	}
+	n := sr.have / 2
+	for i := 0; i < n; i++ {
+		dst[i] = int16(binary.LittleEndian.Uint16(sr.buf[2*i:]))
+	}
+	if sr.have%2 == 1 {
+		sr.buf[0] = sr.buf[sr.have-1]
+	}
+	sr.have %= 2
+	if n > 0 {
+		return n, nil
+	}
+	if sr.err == io.ErrUnexpectedEOF {
+		return 0, io.EOF
+	}
+	return 0, sr.err
+}
@@ -0,0 +1,43 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var mixerValues = regexp.MustCompile(`(?m)^\s*: values=(\S+)`)
+
+// SPDIFLocked reports whether the card's S/PDIF input is receiving a
+// valid signal, as the boolean control m.Control says: by default
+// "IEC958 Capture Valid", though cards name it differently ("IEC958
+// In Status", say; see amixer controls). A control like "iface=PCM,name=..."
+// is used as given.
+func (m Mixer) SPDIFLocked() (bool, error) {
+	id := m.Control
+	if id == "" {
+		id = "IEC958 Capture Valid"
+	}
+	if !strings.Contains(id, "=") {
+		id = "name=" + id
+	}
+	out, err := m.amixer("cget", id)
+	if err != nil {
+		return false, err
+	}
+	sm := mixerValues.FindSubmatch(out)
+	if sm == nil {
+		return false, fmt.Errorf("mixer control %q has no value", id)
+	}
+	switch v := string(sm[1]); v {
+	case "on", "1":
+		return true, nil
+	case "off", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("mixer control %q isn't a switch: %s", id, v)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// On Windows audio is captured with WASAPI, by talking COM to the
+// Core Audio API directly, so there's nothing else to install.
+
+// Start starts recording mono 16-bit little-endian samples at
+// SampleHz with WASAPI, from the capture device (a line-in or a
+// microphone) whose name contains dev, or the default one if dev is
+// empty. If dev is "loopback", or starts with "loopback:", it records
+// what's being played to the default (or named) output device
+// instead. Closing the returned reader stops recording.
+func Start(dev string) (io.ReadCloser, error) {
+	loopback := false
+	if rest, ok := strings.CutPrefix(dev, "loopback"); ok && (rest == "" || rest[0] == ':') {
+		loopback, dev = true, strings.TrimPrefix(rest, ":")
+	}
+	pr, pw := io.Pipe()
+	w := &wasapiReader{pw: pw, stop: make(chan struct{}), done: make(chan struct{})}
+	started := make(chan *wavFormat, 1)
+	go w.run(dev, loopback, started)
+	wf := <-started
+	if wf == nil {
+		<-w.done
+		return nil, w.err
+	}
+	conv, err := newPCMConverter(pr, wf)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("WASAPI mix format: %v", err)
+	}
+	return &multiCloser{conv, []io.Closer{pr, w}}, nil
+}
+
+// A wasapiReader runs a WASAPI capture stream on its own OS thread,
+// as COM wants, writing the frames it gets in the device's mix format
+// to pw.
+type wasapiReader struct {
+	pw   *io.PipeWriter
+	stop chan struct{}
+	done chan struct{}
+	err  error // why it stopped; set before done is closed
+}
+
+func (w *wasapiReader) Close() error {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+	return nil
+}
+
+var (
+	ole32                = syscall.NewLazyDLL("ole32.dll")
+	procCoInitializeEx   = ole32.NewProc("CoInitializeEx")
+	procCoUninitialize   = ole32.NewProc("CoUninitialize")
+	procCoCreateInstance = ole32.NewProc("CoCreateInstance")
+	procCoTaskMemFree    = ole32.NewProc("CoTaskMemFree")
+	procPropVariantClear = ole32.NewProc("PropVariantClear")
+)
+
+type guid struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}
+
+var (
+	clsidMMDeviceEnumerator = guid{0xBCDE0395, 0xE52F, 0x467C, [8]byte{0x8E, 0x3D, 0xC4, 0x57, 0x92, 0x91, 0x69, 0x2E}}
+	iidIMMDeviceEnumerator  = guid{0xA95664D2, 0x9614, 0x4F35, [8]byte{0xA7, 0x46, 0xDE, 0x8D, 0xB6, 0x36, 0x17, 0xE6}}
+	iidIAudioClient         = guid{0x1CB9AD4C, 0xDBFA, 0x4C32, [8]byte{0xB1, 0x78, 0xC2, 0xF5, 0x68, 0xA7, 0x03, 0xB2}}
+	iidIAudioCaptureClient  = guid{0xC8ADBD64, 0xE71E, 0x48A0, [8]byte{0xA4, 0xDE, 0x18, 0x5C, 0x39, 0x5C, 0xD3, 0x17}}
+)
+
+// pkeyDeviceFriendlyName is PKEY_Device_FriendlyName, a PROPERTYKEY.
+var pkeyDeviceFriendlyName = struct {
+	fmtid guid
+	pid   uint32
+}{guid{0xA45C254E, 0xDF1C, 0x4EFD, [8]byte{0x80, 0x20, 0x67, 0xD1, 0x46, 0xA8, 0x50, 0xE0}}, 14}
+
+const (
+	coinitMultithreaded = 0x0
+	clsctxAll           = 0x17
+	eRender             = 0
+	eCapture            = 1
+	eConsole            = 0
+	deviceStateActive   = 0x1
+	stgmRead            = 0x0
+	vtLPWStr            = 31
+
+	audclntShareModeShared    = 0
+	audclntStreamFlagsLoopbck = 0x00020000
+	audclntBufferFlagsSilent  = 0x2
+
+	wasapiBuffer = 200 * time.Millisecond
+	wasapiPoll   = 20 * time.Millisecond
+)
+
+// A comObject is what a COM interface pointer points to. Its methods
+// are called by their index in its vtable.
+type comObject struct {
+	vtbl *[16]uintptr
+}
+
+func (o *comObject) call(method int, args ...uintptr) error {
+	hr, _, _ := syscall.SyscallN(o.vtbl[method], append([]uintptr{uintptr(unsafe.Pointer(o))}, args...)...)
+	if int32(hr) < 0 {
+		return fmt.Errorf("HRESULT %#x", uint32(hr))
+	}
+	return nil
+}
+
+func (o *comObject) release() {
+	if o != nil {
+		o.call(2)
+	}
+}
+
+// int64Args returns v as the stack words a 64-bit argument takes.
+func int64Args(v int64) []uintptr {
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		return []uintptr{uintptr(v)}
+	}
+	return []uintptr{uintptr(uint32(v)), uintptr(uint32(v >> 32))}
+}
+
+// waveFormatEx is the start of a WAVEFORMATEX, and of the
+// WAVEFORMATEXTENSIBLE it's often the head of.
+type waveFormatEx struct {
+	formatTag      uint16
+	channels       uint16
+	samplesPerSec  uint32
+	avgBytesPerSec uint32
+	blockAlign     uint16
+	bitsPerSample  uint16
+	size           uint16 // of the extension
+	validBits      uint16
+	channelMask    uint32
+	subFormat      guid
+}
+
+// run opens the device, tells Start its format (or nil if it
+// failed, with the error on the pipe), and copies frames to the pipe
+// until Close.
+func (w *wasapiReader) run(dev string, loopback bool, started chan<- *wavFormat) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(w.done)
+	err := w.capture(dev, loopback, started)
+	if err != nil {
+		err = fmt.Errorf("WASAPI: %v", err)
+	} else {
+		err = io.EOF
+	}
+	w.err = err
+	select {
+	case started <- nil:
+	default:
+	}
+	w.pw.CloseWithError(err)
+}
+
+func (w *wasapiReader) capture(dev string, loopback bool, started chan<- *wavFormat) error {
+	procCoInitializeEx.Call(0, coinitMultithreaded)
+	defer procCoUninitialize.Call()
+
+	var enum *comObject
+	hr, _, _ := procCoCreateInstance.Call(uintptr(unsafe.Pointer(&clsidMMDeviceEnumerator)), 0, clsctxAll,
+		uintptr(unsafe.Pointer(&iidIMMDeviceEnumerator)), uintptr(unsafe.Pointer(&enum)))
+	if int32(hr) < 0 {
+		return fmt.Errorf("creating device enumerator: HRESULT %#x", uint32(hr))
+	}
+	defer enum.release()
+
+	flow := uintptr(eCapture)
+	if loopback {
+		flow = eRender
+	}
+	device, err := findDevice(enum, flow, dev)
+	if err != nil {
+		return err
+	}
+	defer device.release()
+
+	var client *comObject
+	if err := device.call(3, uintptr(unsafe.Pointer(&iidIAudioClient)), clsctxAll, 0, uintptr(unsafe.Pointer(&client))); err != nil {
+		return fmt.Errorf("activating audio client: %v", err)
+	}
+	defer client.release()
+	var pwf *waveFormatEx
+	if err := client.call(8, uintptr(unsafe.Pointer(&pwf))); err != nil {
+		return fmt.Errorf("getting mix format: %v", err)
+	}
+	defer procCoTaskMemFree.Call(uintptr(unsafe.Pointer(pwf)))
+	wf := &wavFormat{format: pwf.formatTag, channels: pwf.channels, rate: pwf.samplesPerSec, bits: pwf.bitsPerSample}
+	if wf.format == wavExtensible && pwf.size >= 22 {
+		wf.format = uint16(pwf.subFormat.Data1)
+	}
+
+	var flags uintptr
+	if loopback {
+		flags = audclntStreamFlagsLoopbck
+	}
+	args := []uintptr{audclntShareModeShared, flags}
+	args = append(args, int64Args(int64(wasapiBuffer/100))...) // in 100ns units
+	args = append(args, int64Args(0)...)
+	args = append(args, uintptr(unsafe.Pointer(pwf)), 0)
+	if err := client.call(3, args...); err != nil {
+		return fmt.Errorf("initializing audio client: %v", err)
+	}
+	var cc *comObject
+	if err := client.call(14, uintptr(unsafe.Pointer(&iidIAudioCaptureClient)), uintptr(unsafe.Pointer(&cc))); err != nil {
+		return fmt.Errorf("getting capture client: %v", err)
+	}
+	defer cc.release()
+	if err := client.call(10); err != nil {
+		return fmt.Errorf("starting: %v", err)
+	}
+	defer client.call(11)
+	started <- wf
+
+	// A loopback stream has no packets while nothing plays, but the
+	// detector needs to hear that silence, so it's filled in.
+	frameBytes := int(pwf.blockAlign)
+	start, frames := time.Now(), int64(0)
+	var silence []byte
+	for {
+		select {
+		case <-w.stop:
+			return nil
+		case <-time.After(wasapiPoll):
+		}
+		got := false
+		for {
+			var n uint32
+			if err := cc.call(5, uintptr(unsafe.Pointer(&n))); err != nil {
+				return fmt.Errorf("getting packet size: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+			var (
+				data          *byte
+				nFrames       uint32
+				bufFlags      uint32
+				devPos, qpPos uint64
+			)
+			if err := cc.call(3, uintptr(unsafe.Pointer(&data)), uintptr(unsafe.Pointer(&nFrames)), uintptr(unsafe.Pointer(&bufFlags)),
+				uintptr(unsafe.Pointer(&devPos)), uintptr(unsafe.Pointer(&qpPos))); err != nil {
+				return fmt.Errorf("getting buffer: %v", err)
+			}
+			size := int(nFrames) * frameBytes
+			var b []byte
+			if bufFlags&audclntBufferFlagsSilent != 0 || data == nil {
+				b = make([]byte, size)
+			} else {
+				b = append([]byte(nil), unsafe.Slice(data, size)...)
+			}
+			if err := cc.call(4, uintptr(nFrames)); err != nil {
+				return fmt.Errorf("releasing buffer: %v", err)
+			}
+			if _, err := w.pw.Write(b); err != nil {
+				return nil // closed
+			}
+			frames += int64(nFrames)
+			got = true
+		}
+		if !loopback || got {
+			continue
+		}
+		due := int64(time.Since(start) * time.Duration(wf.rate) / time.Second)
+		if missing := due - frames - int64(wasapiBuffer*time.Duration(wf.rate)/time.Second); missing > 0 {
+			if n := int(missing) * frameBytes; len(silence) < n {
+				silence = make([]byte, n)
+			}
+			if _, err := w.pw.Write(silence[:int(missing)*frameBytes]); err != nil {
+				return nil
+			}
+			frames += missing
+		}
+	}
+}
+
+// findDevice returns the active device of flow whose friendly name
+// contains name, ignoring case, or the default one if name is empty.
+func findDevice(enum *comObject, flow uintptr, name string) (*comObject, error) {
+	var device *comObject
+	if name == "" {
+		if err := enum.call(4, flow, eConsole, uintptr(unsafe.Pointer(&device))); err != nil {
+			return nil, fmt.Errorf("no default device: %v", err)
+		}
+		return device, nil
+	}
+	var coll *comObject
+	if err := enum.call(3, flow, deviceStateActive, uintptr(unsafe.Pointer(&coll))); err != nil {
+		return nil, fmt.Errorf("listing devices: %v", err)
+	}
+	defer coll.release()
+	var n uint32
+	if err := coll.call(3, uintptr(unsafe.Pointer(&n))); err != nil {
+		return nil, fmt.Errorf("listing devices: %v", err)
+	}
+	var names []string
+	for i := uint32(0); i < n; i++ {
+		if err := coll.call(4, uintptr(i), uintptr(unsafe.Pointer(&device))); err != nil {
+			continue
+		}
+		fn := friendlyName(device)
+		if strings.Contains(strings.ToLower(fn), strings.ToLower(name)) {
+			return device, nil
+		}
+		names = append(names, fn)
+		device.release()
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no active devices")
+	}
+	return nil, fmt.Errorf("no device named %q; have %q", name, names)
+}
+
+// friendlyName returns device's name, like "Line In (USB Audio)".
+func friendlyName(device *comObject) string {
+	var store *comObject
+	if err := device.call(4, stgmRead, uintptr(unsafe.Pointer(&store))); err != nil {
+		return ""
+	}
+	defer store.release()
+	var pv struct {
+		vt       uint16
+		reserved [3]uint16
+		val      *uint16
+		pad      uintptr
+	}
+	if err := store.call(5, uintptr(unsafe.Pointer(&pkeyDeviceFriendlyName)), uintptr(unsafe.Pointer(&pv))); err != nil {
+		return ""
+	}
+	defer procPropVariantClear.Call(uintptr(unsafe.Pointer(&pv)))
+	if pv.vt != vtLPWStr || pv.val == nil {
+		return ""
+	}
+	var u []uint16
+	for p := unsafe.Pointer(pv.val); *(*uint16)(p) != 0; p = unsafe.Add(p, 2) {
+		u = append(u, *(*uint16)(p))
+	}
+	return syscall.UTF16ToString(u)
+}
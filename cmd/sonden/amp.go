@@ -0,0 +1,455 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// A managedAmp is one amp, or one zone of one, managed by a monitor.
+type managedAmp struct {
+	amp.Backend
+	zone    int      // 1 is the main zone
+	watts   float64  // configured power draw; see onWatts
+	standby float64  // and in standby; see standbyWatts
+	inputs  []string // inputs we manage; empty means all
+
+	path     *amp.Path     // shared with other amps on the same control path
+	priority int           // on path, relative to the other amps
+	delay    time.Duration // after the amp before it, in a monitor's sequence
+
+	attempts int           // tries at setting its power; 0 means forever
+	backoff  time.Duration // before the first retry, doubling after
+
+	onCmds, offCmds []string // configured power commands; see powerCommands
+
+	plug  *plug      // energy-monitoring plug it's on, if any
+	heos  *amp.HEOS  // the backend, if it's a HEOS receiver
+	denon *amp.Denon // the backend, if it's a Denon receiver
+
+	volume amp.VolumeQuerier // the backend, if it reports its volume
+
+	wake chan struct{} // to the worker; see requestAmpState
+}
+
+func newManagedAmp(b amp.Backend, zone int) *managedAmp {
+	a := &managedAmp{
+		Backend:  chaosBackend(b),
+		zone:     zone,
+		attempts: *ampAttempts,
+		backoff:  *ampBackoff,
+		wake:     make(chan struct{}, 1),
+	}
+	a.volume, _ = b.(amp.VolumeQuerier)
+	go a.work()
+	return a
+}
+
+// name returns the amp's address, and zone if not the main one, like
+// "10.0.0.5/zone2".
+func (a *managedAmp) name() string {
+	if a.zone > 1 {
+		return fmt.Sprintf("%s/zone%d", a.Addr(), a.zone)
+	}
+	return a.Addr()
+}
+
+// subsystem returns the amp's health subsystem name.
+func (a *managedAmp) subsystem() string {
+	return "amp/" + a.name()
+}
+
+var (
+	mu          sync.Mutex
+	ampState    = make(map[*managedAmp]bool)
+	ampChecked  = make(map[*managedAmp]time.Time) // when ampState was last known right
+	ampRefresh  = make(map[*managedAmp]bool)      // background query in flight; see cachedAmpState
+	ampBusy     = make(map[*managedAmp]bool)      // commands in flight
+	ampGen      = make(map[*managedAmp]int)       // commands started, so that stale queries can be told apart
+	ampWant     = make(map[*managedAmp]bool)      // state requested of the worker and not yet reached
+	ampQueued   = make(map[*managedAmp]bool)      // ampWant not yet picked up by the worker
+	ampForce    = make(map[*managedAmp]bool)      // ampWant is to be sent whatever; see forceAmpState
+	ampOverride = make(map[*managedAmp]time.Time) // manual override expiry
+	ampInput    = make(map[*managedAmp]string)    // last polled input, if amp.inputs
+	overBudget  = make(map[*managedAmp]bool)      // kept off by a power budget
+)
+
+func getAmpState(amp *managedAmp) (on bool, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	on, ok = ampState[amp]
+	return
+}
+
+// cachedAmpState is getAmpState for API reads, which must never wait
+// on (or pile connections onto) a receiver: it returns ampState as it
+// was at checked, and if that's older than -status-ttl starts one
+// background query to refresh it for next time.
+func cachedAmpState(amp *managedAmp) (on, ok bool, checked time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	on, ok = ampState[amp]
+	checked = ampChecked[amp]
+	if *statusTTL > 0 && !*dryRun && !ampRefresh[amp] && time.Since(checked) > *statusTTL {
+		ampRefresh[amp] = true
+		go func() {
+			reconcileAmpState(amp)
+			mu.Lock()
+			defer mu.Unlock()
+			delete(ampRefresh, amp)
+		}()
+	}
+	return
+}
+
+// overridden reports whether a human changed amp's power recently
+// enough that we shouldn't fight them.
+func overridden(amp *managedAmp) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return time.Now().Before(ampOverride[amp])
+}
+
+func clearOverride(amp *managedAmp) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(ampOverride, amp)
+}
+
+// onManagedInput reports whether amp is on one of its managed inputs,
+// and thus whether silence on our line-in means anything. It goes by
+// the input last polled, never asking the amp, as it's called while
+// reading samples; if that's unknown, the input is taken to be
+// managed.
+func onManagedInput(amp *managedAmp) bool {
+	if len(amp.inputs) == 0 {
+		return true
+	}
+	mu.Lock()
+	src := ampInput[amp]
+	mu.Unlock()
+	if src == "" {
+		return true
+	}
+	for _, in := range amp.inputs {
+		if strings.EqualFold(strings.TrimSpace(in), src) {
+			return true
+		}
+	}
+	debugf("Amp %s is on unmanaged input %q; leaving it on", amp.Addr(), src)
+	return false
+}
+
+// Each amp has a worker goroutine that sends its commands, so slow
+// or failing amps never hold up reading samples. Requests are
+// deduplicated: the worker only ever heads for the latest one.
+
+var (
+	ampAttempts   = flag.Int("amp-attempts", 5, "how many times to try setting an amp's power before giving up until the next change; 0 to keep trying")
+	ampBackoff    = flag.Duration("amp-backoff", time.Second, "how long to wait before retrying a failed amp command, doubling on each further failure")
+	ampMaxBackoff = flag.Duration("amp-max-backoff", time.Minute, "the most -amp-backoff grows to")
+	chipTool      = flag.String("chip-tool", "chip-tool", "the Matter SDK's chip-tool, for Matter plug amps")
+)
+
+// requestAmpState asks amp's worker to set it to state, superseding
+// any earlier request it hasn't finished.
+func requestAmpState(amp *managedAmp, state bool) {
+	mu.Lock()
+	ampWant[amp] = state
+	ampQueued[amp] = true
+	mu.Unlock()
+	select {
+	case amp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forceAmpState is requestAmpState for switching amp whatever we
+// think its state is, whatever input it's on, and even if it was
+// overridden.
+func forceAmpState(amp *managedAmp, state bool) {
+	mu.Lock()
+	ampForce[amp] = true
+	mu.Unlock()
+	requestAmpState(amp, state)
+}
+
+// wantedAmpState returns the state amp's worker is heading for, if
+// it's busy.
+func wantedAmpState(amp *managedAmp) (state, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	state, ok = ampWant[amp]
+	return
+}
+
+// work sets a's state as requested, retrying failures with backoff
+// until they succeed, run out of attempts, or are superseded.
+func (a *managedAmp) work() {
+	for range a.wake {
+		mu.Lock()
+		state, ok := ampWant[a]
+		force := ampForce[a]
+		delete(ampQueued, a)
+		delete(ampForce, a)
+		mu.Unlock()
+		if !ok {
+			continue
+		}
+		backoff := a.backoff
+		for attempt := 1; ; attempt++ {
+			err := setAmpState(a, state, force)
+			mu.Lock()
+			superseded := ampQueued[a]
+			if !superseded && (err == nil || attempt == a.attempts) {
+				delete(ampWant, a)
+			}
+			mu.Unlock()
+			if err == nil || superseded {
+				break
+			}
+			if attempt == a.attempts {
+				errorf("Giving up setting amp %s to %v after %d attempts", a.Addr(), state, attempt)
+				break
+			}
+			warnf("Amp %s: %v; retrying in %v", a.Addr(), err, backoff)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > *ampMaxBackoff {
+				backoff = *ampMaxBackoff
+			}
+		}
+	}
+}
+
+// powerCommands returns the commands that turn amp on or off: as
+// configured, or else its backend's.
+func (a *managedAmp) powerCommands(on bool) []string {
+	cmds := a.offCmds
+	if on {
+		cmds = a.onCmds
+	}
+	if len(cmds) == 0 {
+		cmds = a.PowerCommands(on)
+	}
+	return cmds
+}
+
+// parseWait parses a "wait 3s" pseudo-command. isWait reports whether
+// cmd is one, even if its duration is bad.
+func parseWait(cmd string) (d time.Duration, isWait bool, err error) {
+	arg, ok := strings.CutPrefix(cmd, "wait ")
+	if !ok {
+		return 0, false, nil
+	}
+	if d, err = time.ParseDuration(strings.TrimSpace(arg)); err != nil {
+		return 0, true, fmt.Errorf("bad command %q: %v", cmd, err)
+	}
+	return d, true, nil
+}
+
+// setAmpState sends amp the commands to set it to state, unless it's
+// already there or shouldn't be touched, or force is set.
+func setAmpState(amp *managedAmp, state, force bool) error {
+	if !force {
+		if cur, ok := getAmpState(amp); ok && cur == state {
+			return nil
+		}
+		if overridden(amp) {
+			return nil
+		}
+		if !state && !onManagedInput(amp) {
+			return nil
+		}
+	}
+	mu.Lock()
+	ampBusy[amp] = true
+	ampGen[amp]++
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(ampBusy, amp)
+	}()
+
+	// Turning on goes ahead of turning off at the same priority:
+	// someone's waiting for the music.
+	prio := 2 * amp.priority
+	if state {
+		prio++
+	}
+	err := amp.path.Run(amp.subsystem(), prio, func() error {
+		for _, cmd := range amp.powerCommands(state) {
+			if d, isWait, _ := parseWait(cmd); isWait {
+				debugf("Amp %s: waiting %v", amp.Addr(), d)
+				time.Sleep(d)
+				continue
+			}
+			if *dryRun {
+				infof("Dry run: would send %q to %s", cmd, amp.Addr())
+				publish(event{Type: "command", Amp: amp.Addr(), Command: cmd, DryRun: true})
+				continue
+			}
+			debugf("Sending command to %s: %q", amp.Addr(), cmd)
+			err := amp.SendCommand(cmd)
+			ev := event{Type: "command", Amp: amp.Addr(), Command: cmd}
+			setHealth(amp.subsystem(), err)
+			if err != nil {
+				errorf("Sending command %q to %s failed: %v", cmd, amp.Addr(), err)
+				ev.Error = err.Error()
+			}
+			publish(ev)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	infof("Amp %s successfully set to state %v", amp.Addr(), state)
+	if !*dryRun {
+		observeAmp(amp, "power", powerString(state), "sonden")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	ampState[amp] = state
+	ampChecked[amp] = time.Now()
+	if state {
+		endKeptOff(amp, time.Now())
+	} else if !*dryRun {
+		startKeptOff(amp, time.Now())
+	}
+	return nil
+}
+
+// reconcileAmpState queries the amp's actual power state and updates
+// ampState to match, in case it was changed behind our back (e.g.
+// with the remote).
+func reconcileAmpState(amp *managedAmp) {
+	mu.Lock()
+	gen := ampGen[amp]
+	mu.Unlock()
+	on, err := amp.QueryPower()
+	setHealth(amp.subsystem(), err)
+	if err != nil {
+		warnf("Querying power state of %s: %v", amp.Addr(), err)
+		return
+	}
+	if amp.plug != nil {
+		meterAmp(amp, on, time.Now())
+	}
+	var src string
+	if on {
+		if src, err = amp.QuerySource(); err != nil {
+			warnf("Querying input of %s: %v", amp.Addr(), err)
+		} else if src != "" {
+			observeAmp(amp, "input", src, "")
+		}
+		if amp.volume != nil {
+			if v, err := amp.volume.QueryVolume(); err != nil {
+				warnf("Querying volume of %s: %v", amp.Addr(), err)
+			} else {
+				observeAmp(amp, "volume", v, "")
+			}
+		}
+	}
+	recordUsage(amp, on, src, time.Now())
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case len(amp.inputs) == 0 || err != nil:
+		// Not needed, or keep the last known.
+	case src != "":
+		ampInput[amp] = src
+	default:
+		delete(ampInput, amp)
+	}
+	if ampBusy[amp] || ampGen[amp] != gen {
+		// We're changing it ourselves right now, or did since asking,
+		// so the answer may be stale.
+		return
+	}
+	by := ""
+	if _, ok := ampState[amp]; ok {
+		by = "someone else" // we'd have seen our own change
+	}
+	observeAmp(amp, "power", powerString(on), by)
+	if cur, ok := ampState[amp]; ok && cur != on {
+		infof("Amp %s is actually in state %v; thought it was %v", amp.Addr(), on, cur)
+		if *overrideGrace > 0 {
+			infof("Amp %s changed manually; leaving it alone for %v", amp.Addr(), *overrideGrace)
+			ampOverride[amp] = time.Now().Add(*overrideGrace)
+			publish(event{Type: "override", Reason: reasonOverrideActive, Amp: amp.Addr()})
+		}
+	}
+	ampState[amp] = on
+	ampChecked[amp] = time.Now()
+	if on {
+		endKeptOff(amp, time.Now())
+	}
+}
+
+func pollAmpState(amps []*managedAmp) {
+	if *dryRun {
+		// We don't change the amps, so they'd all look overridden.
+		return
+	}
+	for _, amp := range amps {
+		if amp.denon != nil {
+			go watchDenon(amp)
+		}
+	}
+	for {
+		for _, amp := range amps {
+			reconcileAmpState(amp)
+		}
+		if *pollEvery <= 0 {
+			return
+		}
+		time.Sleep(*pollEvery)
+	}
+}
+
+// denonSettle is how long to wait after a Denon receiver reports a
+// change before reconciling, since one change comes as several lines.
+const denonSettle = 500 * time.Millisecond
+
+// watchDenon reconciles a Denon amp's state as soon as the receiver
+// reports its zone's power, input or volume changed, as it does when
+// someone uses its remote or front panel, rather than waiting for
+// -poll to notice. Reports of what we last saw anyway, like late
+// replies to reconciling's own queries, are ignored.
+func watchDenon(a *managedAmp) {
+	changed := make(chan string, 1)
+	a.denon.Watch(func(line string) {
+		what, v, ok := a.denon.StatusChange(line)
+		if !ok {
+			return
+		}
+		if old, seen := lastSeen(a, what); seen && old == v {
+			return
+		}
+		select {
+		case changed <- what:
+		default:
+		}
+	})
+	for what := range changed {
+		debugf("Amp %s reported a %s change", a.name(), what)
+		time.Sleep(denonSettle)
+		select {
+		case <-changed:
+		default:
+		}
+		reconcileAmpState(a)
+	}
+}
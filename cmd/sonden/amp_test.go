@@ -0,0 +1,46 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// TestWatchDenon checks that a Denon amp is queried once for each
+// change someone makes with the remote, and not again for the
+// receiver's replies to those queries.
+func TestWatchDenon(t *testing.T) {
+	denon := newFakeDenon(t)
+	denon.press("PWON")
+	b := amp.NewDenon(denon.addr, 1)
+	a := newManagedAmp(b, 1)
+	a.denon = b
+	go watchDenon(a)
+	reconcileAmpState(a)
+
+	round := []string{"PW?", "SI?", "MV?"}
+	check := func(when string, want []string) {
+		t.Helper()
+		time.Sleep(3 * denonSettle)
+		if got := denon.takeQueries(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: queries %q; want %q", when, got, want)
+		}
+	}
+	check("at startup", round)
+	check("left alone", nil)
+	denon.press("MV40")
+	check("after the volume was changed", round)
+	denon.press("MV40")
+	check("after the same volume was reported again", nil)
+	denon.press("PWSTANDBY")
+	check("after it was turned off", []string{"PW?"})
+	check("left alone again", nil)
+	if v, _ := lastSeen(a, "volume"); v != "40" {
+		t.Errorf("volume seen %q; want 40", v)
+	}
+}
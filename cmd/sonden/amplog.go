@@ -0,0 +1,147 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The amp log records every change seen in the amps' power, input and
+// volume, whoever made it, for answering "who turned the amp on at
+// 3am?". Changes made by hand are seen when -poll next asks the amp,
+// so they're timed to within -poll.
+
+var ampLogFile = flag.String("amp-log", "", "if non-empty, file to append the amp log (changes seen in the amps' power, input and volume) to as JSON lines, and to reload it from at startup")
+
+var ampLogSize = flag.Int("amp-log-size", 1000, "how many of the amps' last changes to keep in memory for /amp-log")
+
+// An ampChange is one change seen in an amp.
+type ampChange struct {
+	Time time.Time `json:"time"`
+	Amp  string    `json:"amp"`
+	What string    `json:"what"`           // "power", "input" or "volume"
+	From string    `json:"from,omitempty"` // empty if not seen before
+	To   string    `json:"to"`
+
+	// By, for power, is "sonden" if we switched it, or "someone
+	// else" if it was switched behind our back.
+	By string `json:"by,omitempty"`
+}
+
+var (
+	ampLogMu  sync.Mutex
+	ampLog    []ampChange                               // oldest first
+	ampSeen   = make(map[*managedAmp]map[string]string) // what -> last value seen
+	ampLogOut *os.File
+)
+
+// openAmpLog reloads the last of -amp-log and opens it for appending.
+func openAmpLog() error {
+	if *ampLogFile == "" {
+		return nil
+	}
+	if f, err := os.Open(*ampLogFile); err == nil {
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var c ampChange
+			if json.Unmarshal(s.Bytes(), &c) == nil {
+				ampLog = append(ampLog, c)
+			}
+			if n := *ampLogSize; len(ampLog) > 2*n {
+				ampLog = append([]ampChange(nil), ampLog[len(ampLog)-n:]...)
+			}
+		}
+		f.Close()
+		if len(ampLog) > *ampLogSize {
+			ampLog = append([]ampChange(nil), ampLog[len(ampLog)-*ampLogSize:]...)
+		}
+	}
+	f, err := os.OpenFile(*ampLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	ampLogOut = f
+	return nil
+}
+
+// observeAmp notes that a's what is v, and logs it if that's a
+// change. by is as for ampChange.By.
+func observeAmp(a *managedAmp, what, v, by string) {
+	ampLogMu.Lock()
+	defer ampLogMu.Unlock()
+	seen := ampSeen[a]
+	if seen == nil {
+		seen = make(map[string]string)
+		ampSeen[a] = seen
+	}
+	old, ok := seen[what]
+	seen[what] = v
+	if ok && old == v || !ok && by == "" {
+		// Unchanged, or just what it was when we started.
+		return
+	}
+	c := ampChange{Time: time.Now(), Amp: a.name(), What: what, From: old, To: v, By: by}
+	ampLog = append(ampLog, c)
+	if n := *ampLogSize; len(ampLog) > 2*n {
+		ampLog = append([]ampChange(nil), ampLog[len(ampLog)-n:]...)
+	}
+	if ampLogOut != nil {
+		b, _ := json.Marshal(c)
+		if _, err := ampLogOut.Write(append(b, '\n')); err != nil {
+			errorf("writing amp log: %v", err)
+			setHealth("amp-log", err)
+		}
+	}
+}
+
+// lastSeen returns the last value of a's what observed.
+func lastSeen(a *managedAmp, what string) (v string, ok bool) {
+	ampLogMu.Lock()
+	defer ampLogMu.Unlock()
+	v, ok = ampSeen[a][what]
+	return
+}
+
+func powerString(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// serveAmpLog returns the amp log as JSON, oldest first: the last n
+// changes (default all kept), optionally only those of amp (by name)
+// or since a time in RFC 3339.
+func serveAmpLog(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	n, _ := strconv.Atoi(r.FormValue("n"))
+	name := r.FormValue("amp")
+	ampLogMu.Lock()
+	cs := []ampChange{}
+	for _, c := range ampLog {
+		if (name == "" || c.Amp == name) && !c.Time.Before(since) {
+			cs = append(cs, c)
+		}
+	}
+	ampLogMu.Unlock()
+	if n > 0 && len(cs) > n {
+		cs = cs[len(cs)-n:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs)
+}
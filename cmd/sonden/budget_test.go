@@ -0,0 +1,76 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// TestPowerBudget checks that the power budget holds across monitors:
+// a monitor listed earlier gets its amps turned on in preference to a
+// later one's, which are turned off to make way.
+func TestPowerBudget(t *testing.T) {
+	newAmp := func(addr string) *managedAmp {
+		a := newManagedAmp(soakAmp(addr), 1)
+		a.path = amp.SharedPath(addr)
+		a.watts = 100
+		return a
+	}
+	den := &monitor{name: "den", amps: []*managedAmp{newAmp("den")}}
+	patio := &monitor{name: "patio", amps: []*managedAmp{newAmp("patio"), newAmp("patio-sub")}}
+	defer func(ms []*monitor) { monitors = ms }(monitors)
+	monitors = []*monitor{den, patio}
+	defer setPowerBudget(0)
+	setPowerBudget(250)
+
+	turnOn := func(m *monitor) []*managedAmp {
+		ok := m.ampsWithinBudget()
+		for _, a := range ok {
+			requestAmpState(a, true)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			mu.Lock()
+			busy := false
+			for _, a := range append(den.amps, patio.amps...) {
+				_, want := ampWant[a]
+				busy = busy || want
+			}
+			mu.Unlock()
+			if !busy {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return ok
+	}
+	isOn := func(a *managedAmp) bool {
+		on, _ := getAmpState(a)
+		return on
+	}
+
+	if got := turnOn(patio); !reflect.DeepEqual(got, patio.amps) {
+		t.Errorf("patio alone: %d amps within budget; want both", len(got))
+	}
+	if got := turnOn(den); !reflect.DeepEqual(got, den.amps) {
+		t.Errorf("den: %d amps within budget; want its one", len(got))
+	}
+	if !isOn(den.amps[0]) || !isOn(patio.amps[0]) || isOn(patio.amps[1]) {
+		t.Errorf("after den turned on: den %v, patio %v, patio-sub %v; want on, on, off",
+			isOn(den.amps[0]), isOn(patio.amps[0]), isOn(patio.amps[1]))
+	}
+	if got := turnOn(patio); !reflect.DeepEqual(got, patio.amps[:1]) {
+		t.Errorf("patio again: %d amps within budget; want 1", len(got))
+	}
+	mu.Lock()
+	over := overBudget[patio.amps[1]]
+	mu.Unlock()
+	if !over {
+		t.Errorf("patio-sub not marked over budget")
+	}
+}
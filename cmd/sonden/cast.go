@@ -0,0 +1,219 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// castSource watches a Google Cast device or speaker group over the
+// Cast protocol: protobuf CastMessages, length-prefixed, over TLS. It
+// asks the receiver which app is running, then follows that app's
+// media status. Music's playing while it's PLAYING or BUFFERING.
+type castSource struct {
+	addr string // host:port; groups have their own port
+}
+
+const (
+	castConnection = "urn:x-cast:com.google.cast.tp.connection"
+	castHeartbeat  = "urn:x-cast:com.google.cast.tp.heartbeat"
+	castReceiver   = "urn:x-cast:com.google.cast.receiver"
+	castMedia      = "urn:x-cast:com.google.cast.media"
+
+	castPing = 5 * time.Second
+)
+
+// A castMessage is the part of the CastMessage protobuf we use.
+type castMessage struct {
+	source, dest, namespace, payload string
+}
+
+func (s *castSource) watch(playing func(bool)) error {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.addr, &tls.Config{
+		InsecureSkipVerify: true, // devices have self-signed certificates
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	send := func(dest, ns string, v interface{}) error {
+		j, _ := json.Marshal(v)
+		return writeCastMessage(c, castMessage{"sender-0", dest, ns, string(j)})
+	}
+	type msg map[string]interface{}
+	if err := send("receiver-0", castConnection, msg{"type": "CONNECT"}); err != nil {
+		return err
+	}
+	if err := send("receiver-0", castReceiver, msg{"type": "GET_STATUS", "requestId": 1}); err != nil {
+		return err
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		// The device drops senders that don't ping.
+		t := time.NewTicker(castPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if send("receiver-0", castHeartbeat, msg{"type": "PING"}) != nil {
+					return
+				}
+			}
+		}
+	}()
+	var (
+		transport string // of the app we follow media status from
+		requestID = 1
+	)
+	for {
+		// The device pings us too, so it's never quiet for long.
+		c.SetReadDeadline(time.Now().Add(3 * castPing))
+		m, err := readCastMessage(c)
+		if err != nil {
+			return err
+		}
+		var p struct {
+			Type   string `json:"type"`
+			Status json.RawMessage
+		}
+		json.Unmarshal([]byte(m.payload), &p)
+		switch {
+		case m.namespace == castHeartbeat && p.Type == "PING":
+			if err := send(m.source, castHeartbeat, msg{"type": "PONG"}); err != nil {
+				return err
+			}
+		case m.namespace == castConnection && p.Type == "CLOSE":
+			if m.source == transport {
+				transport = ""
+				playing(false)
+			}
+		case m.namespace == castReceiver && p.Type == "RECEIVER_STATUS":
+			var st struct {
+				Applications []struct {
+					TransportID  string `json:"transportId"`
+					IsIdleScreen bool   `json:"isIdleScreen"`
+				} `json:"applications"`
+			}
+			json.Unmarshal(p.Status, &st)
+			app := ""
+			for _, a := range st.Applications {
+				if !a.IsIdleScreen {
+					app = a.TransportID
+				}
+			}
+			if app == transport {
+				continue
+			}
+			if transport = app; app == "" {
+				playing(false)
+				continue
+			}
+			requestID++
+			if err := send(app, castConnection, msg{"type": "CONNECT"}); err != nil {
+				return err
+			}
+			if err := send(app, castMedia, msg{"type": "GET_STATUS", "requestId": requestID}); err != nil {
+				return err
+			}
+		case m.namespace == castMedia && p.Type == "MEDIA_STATUS" && m.source == transport:
+			var st []struct {
+				PlayerState string `json:"playerState"`
+			}
+			json.Unmarshal(p.Status, &st)
+			if len(st) == 0 {
+				playing(false)
+			} else {
+				playing(st[0].PlayerState == "PLAYING" || st[0].PlayerState == "BUFFERING")
+			}
+		}
+	}
+}
+
+// writeCastMessage writes m as a length-prefixed CastMessage with a
+// string payload.
+func writeCastMessage(w io.Writer, m castMessage) error {
+	var b []byte
+	b = append(b, 1<<3, 0) // protocol_version: CASTV2_1_0
+	for _, f := range []struct {
+		num int
+		s   string
+	}{{2, m.source}, {3, m.dest}, {4, m.namespace}} {
+		b = appendProtoString(b, f.num, f.s)
+	}
+	b = append(b, 5<<3, 0) // payload_type: STRING
+	b = appendProtoString(b, 6, m.payload)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+func appendProtoString(b []byte, num int, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(num<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// readCastMessage reads a length-prefixed CastMessage.
+func readCastMessage(r io.Reader) (castMessage, error) {
+	var m castMessage
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return m, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > 64<<10 {
+		return m, fmt.Errorf("cast message of %d bytes", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return m, err
+	}
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		if k <= 0 {
+			return m, errBadCastMessage
+		}
+		b = b[k:]
+		switch key & 7 {
+		case 0: // varint
+			_, k := binary.Uvarint(b)
+			if k <= 0 {
+				return m, errBadCastMessage
+			}
+			b = b[k:]
+		case 2: // length-delimited
+			l, k := binary.Uvarint(b)
+			if k <= 0 || uint64(len(b)-k) < l {
+				return m, errBadCastMessage
+			}
+			v := string(b[k : k+int(l)])
+			b = b[k+int(l):]
+			switch key >> 3 {
+			case 2:
+				m.source = v
+			case 3:
+				m.dest = v
+			case 4:
+				m.namespace = v
+			case 6:
+				m.payload = v
+			}
+		default:
+			return m, errBadCastMessage
+		}
+	}
+	return m, nil
+}
+
+var errBadCastMessage = errors.New("malformed cast message")
@@ -0,0 +1,100 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build chaos
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// Failure injection, for exercising retries, reconciliation and
+// capture restarts end to end. It's only in binaries built with
+// -tags chaos; never run one for real.
+
+var (
+	chaosDrop       = flag.Float64("chaos-drop", 0, "percentage of amp commands and queries to fail")
+	chaosStall      = flag.Duration("chaos-stall", 0, "how long to stall capture for, every -chaos-stall-every")
+	chaosStallEvery = flag.Duration("chaos-stall-every", 10*time.Minute, "how often to stall capture by -chaos-stall")
+	chaosCorrupt    = flag.Float64("chaos-corrupt", 0, "percentage of captured bytes to replace with noise")
+)
+
+var errChaos = errors.New("chaos: injected failure")
+
+func init() {
+	warnf("Built with -tags chaos: failure injection is available")
+}
+
+// chaosBackend returns b, failing -chaos-drop of its commands and
+// queries.
+func chaosBackend(b amp.Backend) amp.Backend {
+	return chaosAmp{b}
+}
+
+type chaosAmp struct {
+	amp.Backend
+}
+
+func chaosFail() bool {
+	return *chaosDrop > 0 && rand.Float64()*100 < *chaosDrop
+}
+
+func (a chaosAmp) SendCommand(cmd string) error {
+	if chaosFail() {
+		warnf("chaos: dropping command %q to %s", cmd, a.Addr())
+		return errChaos
+	}
+	return a.Backend.SendCommand(cmd)
+}
+
+func (a chaosAmp) QueryPower() (bool, error) {
+	if chaosFail() {
+		return false, errChaos
+	}
+	return a.Backend.QueryPower()
+}
+
+func (a chaosAmp) QuerySource() (string, error) {
+	if chaosFail() {
+		return "", errChaos
+	}
+	return a.Backend.QuerySource()
+}
+
+// chaosCapture returns r, stalled and corrupted as the -chaos flags
+// say.
+func chaosCapture(r io.ReadCloser) io.ReadCloser {
+	if *chaosStall <= 0 && *chaosCorrupt <= 0 {
+		return r
+	}
+	return &chaosReader{ReadCloser: r, nextStall: time.Now().Add(*chaosStallEvery)}
+}
+
+type chaosReader struct {
+	io.ReadCloser
+	nextStall time.Time
+}
+
+func (r *chaosReader) Read(p []byte) (int, error) {
+	if *chaosStall > 0 && time.Now().After(r.nextStall) {
+		warnf("chaos: stalling capture for %v", *chaosStall)
+		time.Sleep(*chaosStall)
+		r.nextStall = time.Now().Add(*chaosStallEvery)
+	}
+	n, err := r.ReadCloser.Read(p)
+	if *chaosCorrupt > 0 {
+		for i := range p[:n] {
+			if rand.Float64()*100 < *chaosCorrupt {
+				p[i] = byte(rand.Intn(256))
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,17 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !chaos
+
+package main
+
+import (
+	"io"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// Without -tags chaos there's no failure injection.
+
+func chaosBackend(b amp.Backend) amp.Backend     { return b }
+func chaosCapture(r io.ReadCloser) io.ReadCloser { return r }
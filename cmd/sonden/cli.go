@@ -0,0 +1,196 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Subcommands other than "run" talk to a running daemon's -http API.
+
+const cliUsage = `usage: sonden [flags] [command]
+
+Commands:
+  run           run the daemon (the default)
+  status        print the running daemon's status
+  on            turn the amps on now
+  off           turn the amps off now
+  pause <dur>   suspend automatic control for a duration, e.g. 1h
+  party <dur>   party mode: turn the amps on and keep them on, whatever
+                the detector says, for a duration, e.g. 6h
+  resume        resume automatic control
+  tune <param>=<value>...
+                change detection parameters without restarting:
+                threshold, idle, playing, window or hop; with
+                persist=1 they're kept in -state across restarts
+  profile <name> [monitor]
+                switch to a named profile (see config.go) until
+                told otherwise; "schedule" goes back to the profile
+                schedule
+  measure [amp[/zoneN]]
+                measure what an amp on an energy-monitoring plug
+                really draws, on and in standby, switching it to
+                each for a minute or so; the amp is optional if
+                only one has a plug
+  librespot-event
+                for librespot's --onevent hook: tell the daemon's
+                librespot source about $PLAYER_EVENT
+  discover      look for Denon and Marantz receivers on the LAN and
+                print their addresses and models, for -amps
+  probe <name> <url>
+                capture and analyze audio as the flags say, and send
+                the levels to the daemon at url (like
+                http://server:8080), whose monitor configured with
+                probe <name> acts on them
+  replay <file> run a recording (WAV, FLAC, or raw mono S16LE at
+                8192 Hz) through the detector as fast as possible and print
+                when the amps would have turned on and off, using
+                the flags (or the first -config monitor) for settings
+
+Commands other than run, discover, probe and replay talk to the daemon
+at -http, using -http-token if set (as probe does too).
+
+Flags:
+`
+
+func usage() {
+	fmt.Fprint(os.Stderr, cliUsage)
+	flag.PrintDefaults()
+}
+
+// runClientCommand runs a non-daemon subcommand and exits.
+func runClientCommand(args []string) {
+	path := ""
+	params := url.Values{}
+	switch args[0] {
+	case "status":
+		path = "/status"
+	case "on", "off":
+		path = "/" + args[0]
+	case "pause", "party":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		if _, err := time.ParseDuration(args[1]); err != nil {
+			fatalf("bad pause duration: %v", err)
+		}
+		path = "/pause"
+		params.Set("d", args[1])
+		if args[0] == "party" {
+			params.Set("party", "1")
+		}
+	case "resume":
+		path = "/pause"
+		params.Set("d", "0")
+	case "tune":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		path = "/tune"
+		for _, a := range args[1:] {
+			k, v, ok := strings.Cut(a, "=")
+			if !ok {
+				fatalf("bad tune argument %q; want param=value", a)
+			}
+			params.Set(k, v)
+		}
+	case "profile":
+		if len(args) < 2 || len(args) > 3 {
+			usage()
+			os.Exit(2)
+		}
+		path = "/profile"
+		params.Set("name", args[1])
+		if len(args) == 3 {
+			params.Set("monitor", args[2])
+		}
+	case "librespot-event":
+		ev := os.Getenv("PLAYER_EVENT")
+		if ev == "" {
+			fatalf("librespot-event: no $PLAYER_EVENT; run it from librespot --onevent")
+		}
+		path = "/librespot"
+		params.Set("event", ev)
+	case "measure":
+		if len(args) > 2 {
+			usage()
+			os.Exit(2)
+		}
+		path = "/measure"
+		if len(args) == 2 {
+			addr, zone, _ := strings.Cut(args[1], "/zone")
+			params.Set("amp", addr)
+			params.Set("zone", zone)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if *httpAddr == "" {
+		fatalf("the %s command requires -http to find the daemon", args[0])
+	}
+	u := "http://" + clientAddr(*httpAddr) + path
+	// Retrying once is safe with a request ID: if the first try got
+	// through after all, the daemon replays its response.
+	id := newRequestID()
+	var res *http.Response
+	for attempt := 1; ; attempt++ {
+		var req *http.Request
+		var err error
+		if path == "/status" {
+			req, err = http.NewRequest("GET", u, nil)
+		} else {
+			req, err = http.NewRequest("POST", u, strings.NewReader(params.Encode()))
+		}
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if path != "/status" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Idempotency-Key", id)
+		}
+		if *httpToken != "" {
+			req.Header.Set("Authorization", "Bearer "+*httpToken)
+		}
+		if res, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		if attempt == 2 {
+			fatalf("%v", err)
+		}
+		time.Sleep(time.Second)
+	}
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, res.Status)
+		os.Exit(1)
+	}
+}
+
+// newRequestID returns a random ID for a control request.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientAddr turns a listen address like ":8080" into one to dial.
+func clientAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
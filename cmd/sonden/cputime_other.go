@@ -0,0 +1,11 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTime isn't implemented on this platform.
+func cpuTime() (time.Duration, bool) { return 0, false }
@@ -0,0 +1,164 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// The dashboard, at /, shows each monitor's level as it's measured,
+// from the /events stream, with its recent levels from /levels, its
+// amps, what's happened lately, and buttons to force the amps on or off
+// or pause. With -http-token, bookmark it as /?token=...; the buttons
+// send it on.
+
+// dashboardText are the catalog keys of the messages the dashboard's
+// script shows: its own, which it knows without their "dash_" or
+// "simple_", and the reasons in its log of events.
+var dashboardText = []string{
+	"simple_on", "simple_off", "simple_playing", "simple_silent",
+	"dash_party_until", "dash_paused_until", "dash_last_switched",
+	"dash_amp_on", "dash_amp_off", "dash_amp_unknown", "dash_overridden", "dash_zone",
+	reasonThresholdExceeded, reasonBelowThreshold, reasonSourcePlaying, reasonIdleTimeout,
+	reasonPrewarm, reasonScheduleBlock, reasonOverrideActive, reasonPaused, reasonManual,
+	reasonParty, reasonPowerBudget, reasonCooldown, reasonGroup,
+}
+
+// dashboardMessages returns dashboardText translated.
+func dashboardMessages() map[string]string {
+	text := make(map[string]string)
+	for _, k := range dashboardText {
+		short := strings.TrimPrefix(strings.TrimPrefix(k, "dash_"), "simple_")
+		text[short] = tr(k)
+	}
+	return text
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{"tr": tr, "text": dashboardMessages}).Parse(`<!DOCTYPE html>
+<html><head>
+<meta name="viewport" content="width=device-width">
+<title>{{tr "title"}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: auto; padding: 0 1em; }
+.monitor { border-bottom: 1px solid #ccc; padding-bottom: 1em; }
+.state { font-size: 2em; font-weight: bold; }
+.meter { position: relative; height: 1.5em; background: #eee; }
+.meter .bar { height: 100%; width: 0; background: #4a4; transition: width 0.2s; }
+.meter .threshold { position: absolute; top: 0; bottom: 0; left: 50%; border-left: 2px dashed #c00; }
+.sparkline { width: 100%; height: 100px; }
+button { font-size: 1.1em; margin: 0.2em; }
+#log { font-size: 0.9em; color: #444; }
+</style>
+</head><body>
+{{range .}}
+<div class="monitor" data-name="{{.}}">
+{{with .}}<h2>{{.}}</h2>{{end}}
+<div class="state">…</div>
+<p class="info"></p>
+<div class="meter"><div class="bar"></div><div class="threshold"></div></div>
+<img class="sparkline" alt="">
+<ul class="amps"></ul>
+<button data-path="/on">{{tr "simple_turn_on"}}</button>
+<button data-path="/off">{{tr "simple_turn_off"}}</button>
+<button data-path="/pause" data-d="1h">{{tr "dash_pause"}}</button>
+<button data-path="/pause" data-d="0">{{tr "dash_resume"}}</button>
+</div>
+{{end}}
+<h3>{{tr "dash_recent"}}</h3>
+<ul id="log"></ul>
+<script>
+const text = {{text}};
+const token = new URLSearchParams(location.search).get("token") || "";
+const monitors = {};
+for (const el of document.querySelectorAll(".monitor")) {
+	monitors[el.dataset.name] = {el: el, threshold: 0};
+	for (const b of el.querySelectorAll("button")) {
+		b.onclick = () => control(el.dataset.name, b.dataset.path, b.dataset.d);
+	}
+}
+
+// f fills in message s's %s with v.
+function f(s, v) {
+	return s.replace("%s", v);
+}
+
+function q(name) {
+	return "?monitor=" + encodeURIComponent(name);
+}
+
+async function control(name, path, d) {
+	const body = new URLSearchParams({monitor: name});
+	if (d !== undefined) body.set("d", d);
+	const headers = {};
+	if (token) headers["Authorization"] = "Bearer " + token;
+	const res = await fetch(path, {method: "POST", headers: headers, body: body});
+	if (!res.ok) alert(await res.text());
+	refresh();
+}
+
+async function refresh() {
+	const st = await (await fetch("/status")).json();
+	for (const ms of st.monitors) {
+		const m = monitors[ms.name || ""];
+		if (!m) continue;
+		const on = ms.amps.some(a => a.on);
+		m.el.querySelector(".state").textContent = on ? text.on : text.off;
+		let info = ms.playing ? text.playing : text.silent;
+		if (ms.paused_until) info += "; " + f(ms.party ? text.party_until : text.paused_until, new Date(ms.paused_until).toLocaleTimeString());
+		if (ms.last_transition && !ms.last_transition.startsWith("0001")) info += "; " + f(text.last_switched, new Date(ms.last_transition).toLocaleString());
+		m.el.querySelector(".info").textContent = info;
+		const amps = m.el.querySelector(".amps");
+		amps.replaceChildren(...ms.amps.map(a => {
+			const li = document.createElement("li");
+			li.textContent = a.addr + (a.zone > 1 ? " " + f(text.zone, a.zone) : "") + ": " + (a.known ? (a.on ? text.amp_on : text.amp_off) : text.amp_unknown) + (a.overridden ? " (" + text.overridden + ")" : "");
+			return li;
+		}));
+		const levels = await (await fetch("/levels" + q(ms.name || ""))).json();
+		if (levels.length) m.threshold = levels[levels.length - 1].threshold;
+		m.el.querySelector(".sparkline").src = "/levels" + q(ms.name || "") + "&format=svg&t=" + Date.now();
+	}
+}
+
+function log(ev) {
+	const li = document.createElement("li");
+	li.textContent = new Date(ev.time).toLocaleTimeString() + " " + (ev.monitor ? ev.monitor + ": " : "") + ev.type + (ev.reason ? " (" + (text[ev.reason] || ev.reason) + ")" : "") + (ev.amp ? " " + ev.amp : "");
+	const ul = document.getElementById("log");
+	ul.prepend(li);
+	while (ul.children.length > 20) ul.lastChild.remove();
+}
+
+const es = new EventSource("/events");
+for (const type of ["playing", "quiet", "amps_on", "amps_off", "suppressed", "override", "over_budget", "long_play", "capture_failed", "source_failed", "clipping", "unhealthy", "recovered", "learned"]) {
+	es.addEventListener(type, e => { log(JSON.parse(e.data)); refresh(); });
+}
+es.addEventListener("variance", e => {
+	const ev = JSON.parse(e.data);
+	const m = monitors[ev.monitor || ""];
+	if (!m || !m.threshold) return;
+	// Log scale, with the threshold half way.
+	const pct = Math.min(100, 50 * Math.log10((ev.variance || 0) + 1) / Math.log10(m.threshold + 1));
+	m.el.querySelector(".bar").style.width = pct + "%";
+});
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body></html>
+`))
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var names []string
+	for _, m := range monitors {
+		names = append(names, m.name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTmpl.Execute(w, names); err != nil {
+		errorf("rendering /: %v", err)
+	}
+}
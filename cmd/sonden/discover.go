@@ -0,0 +1,306 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The "discover" command, and -amps=auto, look for Denon and Marantz
+// receivers on the LAN: by SSDP, as UPnP media renderers and as HEOS
+// devices, and by mDNS, as HEOS devices. Each is then checked for the
+// telnet control port.
+
+// A foundAmp is a receiver found on the LAN.
+type foundAmp struct {
+	addr    string // its control port, host:23
+	model   string
+	name    string
+	via     string // how it was found
+	control error  // from connecting to addr
+}
+
+const denonPort = "23"
+
+// discover implements the "discover" command.
+func discover(args []string) {
+	if len(args) != 0 {
+		usage()
+		os.Exit(2)
+	}
+	fmt.Fprintln(os.Stderr, "Looking for Denon and Marantz receivers...")
+	found := discoverAmps()
+	if len(found) == 0 {
+		fmt.Fprintln(os.Stderr, "None found. Is the receiver on this network, with network control in standby turned on?")
+		os.Exit(1)
+	}
+	var ok []string
+	for _, f := range found {
+		control := "ok"
+		if f.control != nil {
+			control = "unreachable: " + f.control.Error()
+		} else {
+			ok = append(ok, f.addr)
+		}
+		fmt.Printf("%-21s %-20s %-24q via %-5s %s\n", f.addr, f.model, f.name, f.via, control)
+	}
+	switch len(ok) {
+	case 0:
+		fmt.Fprintln(os.Stderr, "None accepts connections on port 23; turn on network control in standby. Only one connection is allowed at a time, too.")
+	case 1:
+		fmt.Fprintf(os.Stderr, "Use -amps=%s, or -amps=auto.\n", ok[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Use -amps with the ones to manage, like -amps=%s.\n", strings.Join(ok, ","))
+	}
+}
+
+// autoAmp returns the address of the only receiver on the LAN, for
+// -amps=auto.
+func autoAmp() (string, error) {
+	var ok []string
+	for _, f := range discoverAmps() {
+		if f.control == nil {
+			ok = append(ok, f.addr)
+		}
+	}
+	switch len(ok) {
+	case 0:
+		return "", errors.New("-amps=auto: no Denon or Marantz receiver found; try \"sonden discover\"")
+	case 1:
+		infof("-amps=auto: using the receiver at %s", ok[0])
+		return ok[0], nil
+	}
+	return "", fmt.Errorf("-amps=auto: found %d receivers (%s); say which with -amps", len(ok), strings.Join(ok, ", "))
+}
+
+// discoverAmps looks for receivers every way at once and returns
+// them ordered by address.
+func discoverAmps() []*foundAmp {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		found = make(map[string]*foundAmp) // by host
+	)
+	add := func(host, model, name, via string) {
+		mu.Lock()
+		defer mu.Unlock()
+		f := found[host]
+		if f == nil {
+			f = &foundAmp{addr: net.JoinHostPort(host, denonPort), via: via}
+			found[host] = f
+		}
+		// SSDP knows the model; mDNS only the name.
+		if f.model == "" && model != "" {
+			f.model, f.via = model, via
+		}
+		if f.name == "" {
+			f.name = name
+		}
+	}
+	for _, st := range []string{
+		"urn:schemas-denon-com:device:ACT-Denon:1", // HEOS
+		"urn:schemas-upnp-org:device:MediaRenderer:1",
+	} {
+		wg.Add(1)
+		go func(st string) {
+			defer wg.Done()
+			locs, err := ssdpSearch(st)
+			if err != nil {
+				warnf("discover: SSDP: %v", err)
+				return
+			}
+			for _, loc := range locs {
+				if d, host := denonDescription(loc); d != nil {
+					add(host, d.ModelName, d.FriendlyName, "ssdp")
+				}
+			}
+		}(st)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hosts, err := mdnsBrowse("_heos-audio._tcp.local.")
+		if err != nil {
+			warnf("discover: mDNS: %v", err)
+			return
+		}
+		for host, name := range hosts {
+			add(host, "", name, "mdns")
+		}
+	}()
+	wg.Wait()
+
+	var fs []*foundAmp
+	for _, f := range found {
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].addr < fs[j].addr })
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f *foundAmp) {
+			defer wg.Done()
+			c, err := net.DialTimeout("tcp", f.addr, 2*time.Second)
+			if err == nil {
+				c.Close()
+			}
+			f.control = err
+		}(f)
+	}
+	wg.Wait()
+	return fs
+}
+
+// denonDescription fetches the UPnP device description at loc and
+// returns its root device if it's a Denon or Marantz one, and its host.
+func denonDescription(loc string) (*upnpDevice, string) {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return nil, ""
+	}
+	res, err := upnpClient.Get(loc)
+	if err != nil {
+		return nil, ""
+	}
+	defer res.Body.Close()
+	var desc struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&desc) != nil {
+		return nil, ""
+	}
+	m := strings.ToLower(desc.Device.Manufacturer)
+	if !strings.Contains(m, "denon") && !strings.Contains(m, "marantz") {
+		return nil, ""
+	}
+	return &desc.Device, u.Hostname()
+}
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsBrowse asks by mDNS for instances of service, like
+// "_heos-audio._tcp.local.", and returns the hosts that answer with
+// their instance names.
+func mdnsBrowse(service string) (map[string]string, error) {
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	// A one-question PTR query. From a port other than 5353 it's a
+	// "legacy" query, answered to us directly.
+	q := make([]byte, 12, 64)
+	binary.BigEndian.PutUint16(q[4:], 1)
+	q = appendDNSName(q, service)
+	q = append(q, 0, 12, 0, 1) // PTR, IN
+	for i := 0; i < 2; i++ {
+		if _, err := c.WriteTo(q, mdnsAddr); err != nil {
+			return nil, err
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	hosts := make(map[string]string)
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := c.ReadFromUDP(buf)
+		if err != nil {
+			break // the deadline
+		}
+		for _, inst := range dnsPTRs(buf[:n], service) {
+			name := strings.TrimSuffix(inst, "."+service)
+			hosts[from.IP.String()] = name
+		}
+	}
+	return hosts, nil
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// dnsPTRs returns the targets of the PTR records for name among the
+// answers and additional records of the DNS message msg.
+func dnsPTRs(msg []byte, name string) []string {
+	if len(msg) < 12 {
+		return nil
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	rr := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		_, n, ok := readDNSName(msg, off)
+		if !ok || n+4 > len(msg) {
+			return nil
+		}
+		off = n + 4
+	}
+	var ptrs []string
+	for i := 0; i < rr; i++ {
+		rname, n, ok := readDNSName(msg, off)
+		if !ok || n+10 > len(msg) {
+			break
+		}
+		typ := binary.BigEndian.Uint16(msg[n:])
+		rdlen := int(binary.BigEndian.Uint16(msg[n+8:]))
+		off = n + 10 + rdlen
+		if off > len(msg) {
+			break
+		}
+		if typ == 12 && strings.EqualFold(rname, name) {
+			if target, _, ok := readDNSName(msg, n+10); ok {
+				ptrs = append(ptrs, target)
+			}
+		}
+	}
+	return ptrs
+}
+
+// readDNSName reads the possibly compressed name at msg[off:],
+// returning it with a trailing dot and the offset just past it.
+func readDNSName(msg []byte, off int) (name string, end int, ok bool) {
+	var labels []string
+	end = -1
+	for hops := 0; hops < 32; hops++ {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, true
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, false
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, false
+			}
+			labels = append(labels, strings.Replace(string(msg[off+1:off+1+l]), ".", `\.`, -1))
+			off += 1 + l
+		}
+	}
+	return "", 0, false
+}
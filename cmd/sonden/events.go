@@ -0,0 +1,163 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An event is something that happened, streamed to /events clients.
+type event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"` // "variance", "playing", "quiet", "amps_on", "amps_off", "suppressed", "override", "over_budget", "long_play", "capture_failed", "source_failed", "clipping", "unhealthy", "recovered", "command", "weekly_summary", "learned"
+	Reason    string    `json:"reason,omitempty"`
+	Monitor   string    `json:"monitor,omitempty"`
+	Amp       string    `json:"amp,omitempty"`
+	Subsystem string    `json:"subsystem,omitempty"` // for unhealthy and recovered
+	Variance  float64   `json:"variance,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	DryRun    bool      `json:"dry_run,omitempty"` // Command wasn't really sent
+	Error     string    `json:"error,omitempty"`
+
+	Usage  map[string]float64 `json:"usage,omitempty"`      // for weekly_summary: seconds of amp on-time per input
+	Energy float64            `json:"energy_kwh,omitempty"` // for weekly_summary: estimated kWh the amps used
+}
+
+// Reason codes say why a decision event happened.
+const (
+	reasonThresholdExceeded = "threshold_exceeded" // variance above threshold
+	reasonBelowThreshold    = "below_threshold"    // variance at or below threshold
+	reasonSourcePlaying     = "source_playing"     // an activity source says music is playing
+	reasonIdleTimeout       = "idle_timeout"       // quiet for the idle time
+	reasonPrewarm           = "prewarm"            // scheduled pre-warm
+	reasonScheduleBlock     = "schedule_block"     // quiet hours
+	reasonOverrideActive    = "override_active"    // a human changed the amp
+	reasonPaused            = "paused"             // automation paused via the API
+	reasonManual            = "manual"             // forced on or off via the API
+	reasonParty             = "party"              // held on by party mode via the API
+	reasonPowerBudget       = "power_budget"       // would exceed the power budget
+	reasonCooldown          = "cooldown"           // too soon after the last transition
+	reasonGroup             = "group"              // a multiroom group started or stopped
+)
+
+var maxEventClients = flag.Int("max-event-clients", 16, "most /events streams to serve at once")
+
+// A dropPolicy says what happens when an event is published to a
+// subscriber whose buffer is full. Publishing never blocks, so one
+// slow consumer can't stall detection or the others.
+type dropPolicy int
+
+const (
+	dropNewest dropPolicy = iota // discard the new event
+	dropOldest                   // discard the oldest buffered event to make room
+)
+
+// A subscriber is one consumer of the event hub.
+type subscriber struct {
+	name   string
+	client bool // an /events stream, counted against -max-event-clients
+	policy dropPolicy
+	filter func(event) bool // or nil for all events
+	C      chan event
+
+	dropped int64 // guarded by subMu
+}
+
+var (
+	subMu sync.Mutex
+	subs  = make(map[*subscriber]bool)
+)
+
+// publish sends ev to all subscribers that want it.
+func publish(ev event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	subMu.Lock()
+	defer subMu.Unlock()
+	for s := range subs {
+		if s.filter != nil && !s.filter(ev) {
+			continue
+		}
+		select {
+		case s.C <- ev:
+			continue
+		default:
+		}
+		s.dropped++
+		if s.policy == dropOldest {
+			select {
+			case <-s.C:
+			default:
+			}
+			select {
+			case s.C <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// subscribe adds a consumer of events with the given buffer size and
+// drop policy. If filter is non-nil, only events it accepts are sent.
+func subscribe(name string, buf int, policy dropPolicy, filter func(event) bool) *subscriber {
+	s := &subscriber{name: name, policy: policy, filter: filter, C: make(chan event, buf)}
+	subMu.Lock()
+	defer subMu.Unlock()
+	subs[s] = true
+	return s
+}
+
+const clientEventBuffer = 64
+
+// subscribeClient subscribes an /events stream, or returns nil if
+// there are already -max-event-clients of them.
+func subscribeClient(name string) *subscriber {
+	s := &subscriber{name: name, client: true, policy: dropOldest, C: make(chan event, clientEventBuffer)}
+	subMu.Lock()
+	defer subMu.Unlock()
+	n := 0
+	for s := range subs {
+		if s.client {
+			n++
+		}
+	}
+	if n >= *maxEventClients {
+		return nil
+	}
+	subs[s] = true
+	return s
+}
+
+func unsubscribe(s *subscriber) {
+	subMu.Lock()
+	defer subMu.Unlock()
+	delete(subs, s)
+}
+
+// cancelSubscriber unsubscribes s and closes its channel, ending its consumer.
+func cancelSubscriber(s *subscriber) {
+	unsubscribe(s)
+	close(s.C)
+}
+
+type subscriberStatus struct {
+	Name     string `json:"name"`
+	Buffered int    `json:"buffered"`
+	Dropped  int64  `json:"dropped"`
+}
+
+func subscriberStatuses() []subscriberStatus {
+	subMu.Lock()
+	defer subMu.Unlock()
+	var ss []subscriberStatus
+	for s := range subs {
+		ss = append(ss, subscriberStatus{s.name, len(s.C), s.dropped})
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
+	return ss
+}
@@ -0,0 +1,111 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A boolExpr is a monitor's "on" or "off" rule, like
+// "audio or (mpd and not airplay)": names of inputs, each playing or
+// not, combined with and, or, not and parentheses.
+type boolExpr struct {
+	src   string
+	names []string // inputs mentioned
+	eval  func(playing map[string]bool) bool
+}
+
+func (e *boolExpr) String() string { return e.src }
+
+// mentions reports whether e uses the input name.
+func (e *boolExpr) mentions(name string) bool {
+	for _, n := range e.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBoolExpr(s string) (*boolExpr, error) {
+	p := &exprParser{toks: strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s))}
+	e := &boolExpr{src: s}
+	f, err := p.or(e)
+	if err == nil && p.i < len(p.toks) {
+		err = fmt.Errorf("unexpected %q", p.toks[p.i])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad rule %q: %v", s, err)
+	}
+	e.eval = f
+	return e, nil
+}
+
+type exprParser struct {
+	toks []string
+	i    int
+}
+
+func (p *exprParser) peek() string {
+	if p.i < len(p.toks) {
+		return strings.ToLower(p.toks[p.i])
+	}
+	return ""
+}
+
+type evalFunc func(map[string]bool) bool
+
+func (p *exprParser) or(e *boolExpr) (evalFunc, error) {
+	l, err := p.and(e)
+	for err == nil && p.peek() == "or" {
+		p.i++
+		var r evalFunc
+		if r, err = p.and(e); err == nil {
+			l0 := l
+			l = func(v map[string]bool) bool { return l0(v) || r(v) }
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) and(e *boolExpr) (evalFunc, error) {
+	l, err := p.not(e)
+	for err == nil && p.peek() == "and" {
+		p.i++
+		var r evalFunc
+		if r, err = p.not(e); err == nil {
+			l0 := l
+			l = func(v map[string]bool) bool { return l0(v) && r(v) }
+		}
+	}
+	return l, err
+}
+
+func (p *exprParser) not(e *boolExpr) (evalFunc, error) {
+	switch tok := p.peek(); tok {
+	case "not":
+		p.i++
+		f, err := p.not(e)
+		return func(v map[string]bool) bool { return !f(v) }, err
+	case "(":
+		p.i++
+		f, err := p.or(e)
+		if err == nil && p.peek() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		p.i++
+		return f, err
+	case "", ")", "and", "or":
+		if tok == "" {
+			tok = "end"
+		}
+		return nil, fmt.Errorf("want an input name, not %s", tok)
+	default:
+		name := p.toks[p.i]
+		p.i++
+		e.names = append(e.names, name)
+		return func(v map[string]bool) bool { return v[name] }, nil
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/sonden/capture"
+)
+
+var (
+	gainFlag        = flag.Float64("gain", 0, "if non-zero, percent to set the capture device's input gain to with its ALSA mixer whenever capture starts, since a reboot can reset it")
+	gainControlFlag = flag.String("gain-control", "Capture", "the ALSA mixer control -gain and -gain-target adjust")
+	gainTargetLevel = flag.Float64("gain-target", 0, "if non-zero, the level silence should sit at: while it's quiet, the input gain is nudged to keep the noise floor near it")
+)
+
+// gainConfig manages a monitor's input gain with its sound card's
+// ALSA mixer.
+type gainConfig struct {
+	Control string  `json:"control"` // default "Capture"
+	Set     float64 `json:"set"`     // percent to set when capture starts; 0 leaves it
+
+	// Target, if non-zero, is the level silence should sit at. The
+	// gain is nudged between Min and Max percent (default 1 and 100)
+	// to keep the noise floor, measured while quiet, near it.
+	Target float64 `json:"target"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+const (
+	gainEvery = time.Minute // how long to measure the noise floor for before adjusting
+	gainStep  = 2           // percent to move the gain by at a time
+	gainSlack = 2           // how many times off target the noise floor may be
+)
+
+// A gainControl is a monitor's input gain, as it manages it. It's
+// owned by the run goroutine.
+type gainControl struct {
+	mixer    capture.Mixer
+	set      float64
+	target   float64
+	min, max float64
+
+	gain  float64   // current percent, once known
+	sum   float64   // of quiet levels since start
+	n     int       // quiet windows since start
+	start time.Time // of the current measurement
+}
+
+func newGainControl(alsaDev string, gc *gainConfig) (*gainControl, error) {
+	g := &gainControl{
+		mixer:  capture.MixerFor(alsaDev, gc.Control),
+		set:    gc.Set,
+		target: gc.Target,
+		min:    gc.Min,
+		max:    gc.Max,
+	}
+	if g.min == 0 {
+		g.min = 1
+	}
+	if g.max == 0 {
+		g.max = 100
+	}
+	if g.set < 0 || g.set > 100 || g.min < 0 || g.max > 100 || g.min > g.max {
+		return nil, fmt.Errorf("gain percentages must be from 0 to 100, with min at most max")
+	}
+	if g.target < 0 {
+		return nil, fmt.Errorf("negative gain target")
+	}
+	return g, nil
+}
+
+// startGain sets m's input gain, if configured, as capture starts.
+func (m *monitor) startGain() {
+	g := m.gain
+	if g == nil {
+		return
+	}
+	g.sum, g.n, g.start = 0, 0, time.Time{}
+	var err error
+	if g.set != 0 {
+		if err = g.mixer.SetGain(g.set); err == nil {
+			m.logf(levelInfo, "set input gain to %v%%", g.set)
+			g.gain = g.set
+		}
+	} else if g.target != 0 {
+		g.gain, err = g.mixer.Gain()
+	}
+	if err != nil {
+		m.logf(levelWarn, "input gain: %v", err)
+	}
+	setHealth(m.subsystem("gain"), err)
+}
+
+// adjustGain notes the level v of a window at now, when nothing's
+// playing, and once a gainEvery of them have been seen nudges m's
+// input gain towards its target noise floor.
+func (m *monitor) adjustGain(v float64, now time.Time) {
+	g := m.gain
+	if g == nil || g.target == 0 || g.gain == 0 {
+		return
+	}
+	if g.start.IsZero() {
+		g.start = now
+	}
+	g.sum += v
+	g.n++
+	if now.Sub(g.start) < gainEvery {
+		return
+	}
+	floor := g.sum / float64(g.n)
+	g.sum, g.n, g.start = 0, 0, now
+	gain := g.gain
+	switch {
+	case floor > g.target*gainSlack:
+		gain = max(gain-gainStep, g.min)
+	case floor < g.target/gainSlack:
+		gain = min(gain+gainStep, g.max)
+	}
+	if gain == g.gain {
+		return
+	}
+	err := g.mixer.SetGain(gain)
+	setHealth(m.subsystem("gain"), err)
+	if err != nil {
+		m.logf(levelWarn, "input gain: %v", err)
+		return
+	}
+	m.logf(levelInfo, "noise floor %.1f vs target %v; input gain %v%% -> %v%%", floor, g.target, g.gain, gain)
+	g.gain = gain
+}
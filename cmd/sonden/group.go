@@ -0,0 +1,151 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A multiroom group, like a Cast speaker group or a Sonos group,
+// plays the same music in several rooms, each with its own monitor.
+// Left alone, each monitor would turn its amps on and off in its own
+// time. A configured group instead holds all its monitors' amps on
+// from when its source says it's playing, and releases them together
+// once it's been stopped for its idle time. A released monitor's amps
+// go off then, unless it hears music of its own.
+
+type group struct {
+	name     string
+	src      activitySource
+	monitors []*monitor
+	idle     time.Duration
+}
+
+func newGroup(gc *groupConfig, ms []*monitor) (*group, error) {
+	if gc.Name == "" {
+		return nil, fmt.Errorf("group needs a name")
+	}
+	if gc.Source == nil {
+		return nil, fmt.Errorf("group %s needs a source", gc.Name)
+	}
+	src, err := newSource(gc.Source)
+	if err != nil {
+		return nil, fmt.Errorf("group %s: %v", gc.Name, err)
+	}
+	g := &group{name: gc.Name, src: src, idle: time.Duration(gc.Idle)}
+	if g.idle <= 0 {
+		g.idle = *idle
+	}
+	for _, name := range gc.Monitors {
+		var m *monitor
+		for _, om := range ms {
+			if om.name == name {
+				m = om
+			}
+		}
+		if m == nil {
+			return nil, fmt.Errorf("group %s: no monitor %q", gc.Name, name)
+		}
+		g.monitors = append(g.monitors, m)
+	}
+	if len(g.monitors) == 0 {
+		return nil, fmt.Errorf("group %s has no monitors", gc.Name)
+	}
+	return g, nil
+}
+
+func (g *group) subsystem() string {
+	return "group/" + g.name
+}
+
+// run holds and releases g's monitors as its source says, forever.
+func (g *group) run() {
+	playing := make(chan bool, 16)
+	go g.watch(playing)
+	var (
+		held    bool
+		release <-chan time.Time
+	)
+	for {
+		select {
+		case p := <-playing:
+			switch {
+			case p:
+				release = nil
+				if !held {
+					held = true
+					infof("Group %s playing; holding its amps on", g.name)
+					for _, m := range g.monitors {
+						m.holdForGroup(g.name, true)
+					}
+				}
+			case held && release == nil:
+				release = time.After(g.idle)
+			}
+		case <-release:
+			release, held = nil, false
+			infof("Group %s stopped for %v; releasing its amps", g.name, g.idle)
+			for _, m := range g.monitors {
+				m.holdForGroup(g.name, false)
+			}
+		}
+	}
+}
+
+// watch sends what g's source says to playing, restarting it with
+// backoff when it fails, after which it counts as not playing.
+func (g *group) watch(playing chan<- bool) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		setHealth(g.subsystem(), nil)
+		err := g.src.watch(func(p bool) {
+			debugf("Group %s source says playing = %v", g.name, p)
+			playing <- p
+		})
+		playing <- false
+		setHealth(g.subsystem(), err)
+		publish(event{Type: "source_failed", Subsystem: g.subsystem(), Error: err.Error()})
+		if time.Since(start) > maxCaptureBackoff {
+			backoff = time.Second
+		}
+		errorf("Group %s source failed: %v; restarting in %v", g.name, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxCaptureBackoff {
+			backoff = maxCaptureBackoff
+		}
+	}
+}
+
+// holdForGroup holds m's amps on for the group name, or releases
+// them. The run goroutine acts on it with the next window.
+func (m *monitor) holdForGroup(name string, hold bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hold {
+		if m.groups == nil {
+			m.groups = make(map[string]bool)
+		}
+		m.groups[name] = true
+		return
+	}
+	delete(m.groups, name)
+	if len(m.groups) == 0 {
+		m.released = name
+	}
+}
+
+// groupNames returns the groups holding m's amps on, joined for a
+// rule. m.mu must be held.
+func (m *monitor) groupNames() string {
+	var names []string
+	for name := range m.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,85 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/sonden/detect"
+)
+
+// chanSource is an activity source that says what it's sent.
+type chanSource chan bool
+
+func (s chanSource) watch(playing func(bool)) error {
+	for p := range s {
+		playing(p)
+	}
+	return fmt.Errorf("closed")
+}
+
+// TestGroup checks that a group's monitors turn their amps on as soon
+// as it plays, keep them on while it's stopped for less than its idle
+// time, and then turn them off together.
+func TestGroup(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		decisions []string
+	)
+	newMonitor := func(name string) *monitor {
+		m := &monitor{name: name}
+		m.decide = func(state bool, reason string) {
+			mu.Lock()
+			defer mu.Unlock()
+			decisions = append(decisions, fmt.Sprintf("%s %s %s", name, powerString(state), reason))
+		}
+		return m
+	}
+	den, kitchen := newMonitor("den"), newMonitor("kitchen")
+	src := make(chanSource)
+	g := &group{name: "downstairs", src: src, monitors: []*monitor{den, kitchen}, idle: 300 * time.Millisecond}
+	go g.run()
+
+	// act has each monitor act on a quiet window, as its run
+	// goroutine does, and returns what they decided.
+	act := func() []string {
+		now := time.Now()
+		for _, m := range g.monitors {
+			m.act(detect.Result{}, 0, reasonSourcePlaying, now, now)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		d := decisions
+		decisions = nil
+		return d
+	}
+	settle := func() { time.Sleep(50 * time.Millisecond) }
+
+	if got := act(); got != nil {
+		t.Errorf("before the group plays: %q", got)
+	}
+	src <- true
+	settle()
+	on := []string{"den on group", "kitchen on group"}
+	if got := act(); !reflect.DeepEqual(got, on) {
+		t.Errorf("group playing: %q; want %q", got, on)
+	}
+	src <- false
+	settle()
+	if got := act(); !reflect.DeepEqual(got, on) {
+		t.Errorf("group just stopped: %q; want %q", got, on)
+	}
+	time.Sleep(g.idle)
+	off := []string{"den off group", "kitchen off group"}
+	if got := act(); !reflect.DeepEqual(got, off) {
+		t.Errorf("group stopped for its idle time: %q; want %q", got, off)
+	}
+	if got := act(); got != nil {
+		t.Errorf("after the release: %q", got)
+	}
+}
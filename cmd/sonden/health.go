@@ -0,0 +1,64 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Subsystems report their health here rather than exiting, so the
+// parts that still work keep working and /status can say which parts
+// don't.
+
+type healthState struct {
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+var (
+	healthMu sync.Mutex
+	health   = make(map[string]*healthState) // subsystem name -> state
+)
+
+// setHealth records whether the named subsystem is working; err is nil
+// if it is.
+func setHealth(name string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	hs, ok := health[name]
+	healthy := err == nil
+	if ok && hs.Healthy == healthy && (healthy || hs.Error == err.Error()) {
+		return
+	}
+	flipped := (ok && hs.Healthy != healthy) || (!ok && !healthy)
+	hs = &healthState{Healthy: healthy, Since: time.Now()}
+	if !healthy {
+		hs.Error = err.Error()
+	}
+	health[name] = hs
+	if flipped {
+		if healthy {
+			infof("%s recovered", name)
+			publish(event{Type: "recovered", Subsystem: name})
+		} else {
+			publish(event{Type: "unhealthy", Subsystem: name, Error: hs.Error})
+		}
+	}
+}
+
+// healthSnapshot returns a copy of all subsystems' health and whether
+// all of them are healthy.
+func healthSnapshot() (all bool, states map[string]healthState) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	all = true
+	states = make(map[string]healthState, len(health))
+	for name, hs := range health {
+		states[name] = *hs
+		all = all && hs.Healthy
+	}
+	return
+}
@@ -0,0 +1,94 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// hooksConfig is shell commands to run when music starts or stops and
+// when the amps are turned on or off, for hooking sonden up to things
+// it doesn't support itself. Each runs with the event in its
+// environment: $SONDEN_EVENT (like "amps_on"), $SONDEN_MONITOR,
+// $SONDEN_REASON, $SONDEN_TIME (RFC 3339) and $SONDEN_LEVEL. For
+// example:
+//
+//	"hooks": {"on_amp_on": "mosquitto_pub -t hifi/amp -m on",
+//	          "on_stop": "logger \"music stopped in $SONDEN_MONITOR\""}
+type hooksConfig struct {
+	OnPlay   string `json:"on_play"`
+	OnStop   string `json:"on_stop"`
+	OnAmpOn  string `json:"on_amp_on"`
+	OnAmpOff string `json:"on_amp_off"`
+}
+
+const (
+	hookTimeout = time.Minute // a hook running longer is killed
+	hookBuffer  = 16          // events queued while a hook runs
+)
+
+// hooks runs hooksConfig's commands, one at a time, in order.
+type hooks map[string]string // event type to command
+
+func newHooks(hc *hooksConfig) hooks {
+	h := make(hooks)
+	for typ, cmd := range map[string]string{
+		"playing":  hc.OnPlay,
+		"quiet":    hc.OnStop,
+		"amps_on":  hc.OnAmpOn,
+		"amps_off": hc.OnAmpOff,
+	} {
+		if cmd != "" {
+			h[typ] = cmd
+		}
+	}
+	return h
+}
+
+func (h hooks) wants(ev event) bool {
+	return h[ev.Type] != ""
+}
+
+// start runs the hooks until its subscription, which it returns, is
+// cancelled.
+func (h hooks) start() *subscriber {
+	sub := subscribe("hooks", hookBuffer, dropOldest, h.wants)
+	go func() {
+		for ev := range sub.C {
+			h.run(ev)
+		}
+	}()
+	return sub
+}
+
+func (h hooks) run(ev event) {
+	cmdline := h[ev.Type]
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", cmdline)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", cmdline)
+	}
+	cmd.Env = append(os.Environ(),
+		"SONDEN_EVENT="+ev.Type,
+		"SONDEN_MONITOR="+ev.Monitor,
+		"SONDEN_REASON="+ev.Reason,
+		"SONDEN_TIME="+ev.Time.Format(time.RFC3339),
+		fmt.Sprintf("SONDEN_LEVEL=%v", ev.Variance),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		errorf("%s hook %q: %v: %s", ev.Type, cmdline, err, strings.TrimSpace(string(out)))
+		return
+	}
+	debugf("ran %s hook %q", ev.Type, cmdline)
+}
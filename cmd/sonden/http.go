@@ -0,0 +1,320 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// serveHTTP serves the HTTP API on addr. If that fails, detection and
+// amp control carry on without it.
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", serveEvents)
+	mux.HandleFunc("/status", serveStatus)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/amp-log", serveAmpLog)
+	mux.HandleFunc("/levels", serveLevels)
+	mux.HandleFunc("/transitions", serveTransitions)
+	mux.HandleFunc("/savings", serveSavings)
+	mux.HandleFunc("/on", authed(idempotent(serveForce(true))))
+	mux.HandleFunc("/off", authed(idempotent(serveForce(false))))
+	mux.HandleFunc("/pause", authed(idempotent(servePause)))
+	mux.HandleFunc("/tune", authed(idempotent(serveTune)))
+	mux.HandleFunc("/profile", authed(idempotent(serveProfile)))
+	mux.HandleFunc("/measure", authed(serveMeasure))
+	mux.HandleFunc("/librespot", authed(serveLibrespot))
+	mux.HandleFunc("/probe", authed(serveProbe))
+	mux.HandleFunc("/", serveDashboard)
+	mux.HandleFunc("/simple", serveSimple)
+	mux.HandleFunc("/simple/on", authed(serveSimpleForce(true)))
+	mux.HandleFunc("/simple/off", authed(serveSimpleForce(false)))
+	infof("Serving HTTP on %s", addr)
+	setHealth("http", nil)
+	err := http.ListenAndServe(addr, mux)
+	errorf("HTTP server: %v", err)
+	setHealth("http", err)
+}
+
+// selectedMonitors returns the monitors named by the request's
+// "monitor" parameter, or all of them if it's empty.
+func selectedMonitors(r *http.Request) []*monitor {
+	name := r.FormValue("monitor")
+	if name == "" {
+		return monitors
+	}
+	for _, m := range monitors {
+		if m.name == name {
+			return []*monitor{m}
+		}
+	}
+	return nil
+}
+
+func serveForce(state bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		ms := selectedMonitors(r)
+		if len(ms) == 0 {
+			http.Error(w, "no such monitor", http.StatusNotFound)
+			return
+		}
+		for _, m := range ms {
+			m.forceAmps(state)
+		}
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+func servePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("d"))
+	if err != nil {
+		http.Error(w, "bad duration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ms := selectedMonitors(r)
+	if len(ms) == 0 {
+		http.Error(w, "no such monitor", http.StatusNotFound)
+		return
+	}
+	party := r.FormValue("party") == "1"
+	if party && d <= 0 {
+		http.Error(w, "party mode needs a duration", http.StatusBadRequest)
+		return
+	}
+	for _, m := range ms {
+		if party {
+			m.holdOn(d)
+		} else {
+			m.pause(d)
+		}
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// serveProfile selects the profile name, or with name empty (or
+// "schedule"), goes back to the schedule.
+func serveProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "schedule" {
+		name = ""
+	}
+	ms := selectedMonitors(r)
+	if len(ms) == 0 {
+		http.Error(w, "no such monitor", http.StatusNotFound)
+		return
+	}
+	// All or none.
+	for _, m := range ms {
+		if err := m.checkProfile(name); err != nil {
+			http.Error(w, m.name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, m := range ms {
+		if err := m.setProfile(name); err != nil {
+			http.Error(w, m.name+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// serveTune changes detection parameters without restarting: any of
+// threshold, idle, playing, window and hop. With persist=1 they're
+// kept in the -state file and outlive a restart.
+func serveTune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var t tuning
+	if v := r.FormValue("threshold"); v != "" {
+		if _, err := fmt.Sscan(v, &t.threshold); err != nil {
+			http.Error(w, "bad threshold: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, d := range []struct {
+		name string
+		p    *time.Duration
+	}{{"idle", &t.idle}, {"playing", &t.playing}, {"window", &t.window}, {"hop", &t.hop}} {
+		v := r.FormValue(d.name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d.p, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "bad "+d.name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if t == (tuning{}) {
+		http.Error(w, "nothing to tune; want threshold, idle, playing, window or hop", http.StatusBadRequest)
+		return
+	}
+	ms := selectedMonitors(r)
+	if len(ms) == 0 {
+		http.Error(w, "no such monitor", http.StatusNotFound)
+		return
+	}
+	persist := r.FormValue("persist") == "1"
+	if persist && *stateFile == "" {
+		http.Error(w, "can't persist without -state", http.StatusBadRequest)
+		return
+	}
+	// All or none.
+	for _, m := range ms {
+		if err := m.checkTuning(t); err != nil {
+			http.Error(w, m.name+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, m := range ms {
+		if err := m.tune(t); err != nil {
+			http.Error(w, m.name+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if persist {
+			m.keepTuning(t, true)
+		}
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+type ampStatus struct {
+	Addr       string    `json:"addr"`
+	Zone       int       `json:"zone"`
+	Known      bool      `json:"known"`
+	On         bool      `json:"on"`
+	CheckedAt  time.Time `json:"checked_at"` // when On was last known right
+	Overridden bool      `json:"overridden,omitempty"`
+	OverBudget bool      `json:"over_budget,omitempty"`
+
+	HEOS *amp.HEOSState `json:"heos,omitempty"` // what a HEOS receiver last said
+}
+
+type monitorStatus struct {
+	Name           string          `json:"name,omitempty"`
+	Playing        bool            `json:"playing"`
+	LastPlaying    time.Time       `json:"last_playing"`
+	LastTransition time.Time       `json:"last_transition"` // amps last turned on or off
+	PausedUntil    *time.Time      `json:"paused_until,omitempty"`
+	Party          bool            `json:"party,omitempty"`          // amps held on until PausedUntil
+	Groups         string          `json:"groups,omitempty"`         // multiroom groups holding the amps on
+	Profile        string          `json:"profile,omitempty"`        // in effect, if any
+	ProfilePinned  bool            `json:"profile_pinned,omitempty"` // selected by hand, not by the schedule
+	Sources        map[string]bool `json:"sources,omitempty"`        // whether each activity source says music's playing
+	Input          *inputStatus    `json:"input,omitempty"`          // the audio input, if captured
+	Amps           []ampStatus     `json:"amps"`
+}
+
+type status struct {
+	Healthy    bool                   `json:"healthy"`
+	Subsystems map[string]healthState `json:"subsystems"`
+	Monitors   []monitorStatus        `json:"monitors"`
+	Consumers  []subscriberStatus     `json:"event_consumers"`
+}
+
+func (m *monitor) status() monitorStatus {
+	m.mu.Lock()
+	ms := monitorStatus{Name: m.name, Playing: m.det.IsPlaying(), LastPlaying: m.det.LastPlaying(), LastTransition: m.lastTransition}
+	if t := m.pausedUntil; time.Now().Before(t) {
+		ms.PausedUntil = &t
+		ms.Party = m.party
+	}
+	ms.Groups = m.groupNames()
+	if len(m.sources) > 0 {
+		ms.Sources = m.inputsPlaying()
+	}
+	ms.ProfilePinned = m.profileDefs[m.pinned] != nil
+	m.mu.Unlock()
+	_, _, ms.Profile = m.params(time.Now())
+	ms.Input = m.inputStatus(time.Now())
+	for _, amp := range m.amps {
+		as := ampStatus{Addr: amp.Addr(), Zone: amp.zone, Overridden: overridden(amp)}
+		as.On, as.Known, as.CheckedAt = cachedAmpState(amp)
+		mu.Lock()
+		as.OverBudget = overBudget[amp]
+		mu.Unlock()
+		if amp.heos != nil {
+			st := amp.heos.State()
+			as.HEOS = &st
+		}
+		ms.Amps = append(ms.Amps, as)
+	}
+	return ms
+}
+
+// serveStatus reports which subsystems are healthy and what each
+// monitor and amp is doing. It returns 503 if anything's unhealthy.
+// Amp states come from the cache, so polling it never touches the
+// receivers; see cachedAmpState.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	var st status
+	st.Healthy, st.Subsystems = healthSnapshot()
+	for _, m := range monitors {
+		st.Monitors = append(st.Monitors, m.status())
+	}
+	st.Consumers = subscriberStatuses()
+	j, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
+
+// serveEvents streams events to the client as server-sent events
+// (text/event-stream), one JSON event per message.
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	sub := subscribeClient("events " + r.RemoteAddr)
+	if sub == nil {
+		http.Error(w, "too many event streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	f.Flush()
+	for {
+		select {
+		case ev := <-sub.C:
+			j, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, j); err != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
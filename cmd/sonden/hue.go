@@ -0,0 +1,324 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With -hue-emulation, sonden pretends to be a Philips Hue bridge, so
+// Alexa (which finds Hue bridges on the LAN itself, no skill needed)
+// and the like see each monitor as a light that's on while music
+// plays, and as a presence sensor, for routines like "when music
+// starts, set the lights to 40%". They're read-only: asking to turn
+// the light on or off fails.
+
+var hueAddr = flag.String("hue-emulation", "", "if non-empty, address to emulate a Philips Hue bridge on, showing each monitor to voice assistants as a light and presence sensor that's on while music plays. Alexa only looks on port 80")
+
+// hueBridgeID is the bridge's made-up MAC address, from the hostname,
+// so it stays the same across restarts.
+var hueBridgeID = func() [6]byte {
+	host, _ := os.Hostname()
+	h := fnv.New64a()
+	h.Write([]byte("sonden " + host))
+	var mac [6]byte
+	copy(mac[:], h.Sum(nil))
+	mac[0] = mac[0]&^1 | 2 // unicast, locally administered
+	return mac
+}()
+
+func hueMAC() string {
+	m := hueBridgeID
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+// hueID is the bridge ID, its MAC address with FFFE in the middle.
+func hueID() string {
+	m := hueBridgeID
+	return fmt.Sprintf("%02X%02X%02XFFFE%02X%02X%02X", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+func hueUUID() string {
+	return "2f402f80-da50-11e1-9b23-" + strings.ReplaceAll(hueMAC(), ":", "")
+}
+
+// serveHue serves the emulated bridge's API on addr and answers SSDP
+// searches for it.
+func serveHue(addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errorf("-hue-emulation: %v", err)
+		setHealth("hue-emulation", err)
+		return
+	}
+	go answerSSDP(port)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/description.xml", serveHueDescription)
+	mux.HandleFunc("/api", serveHueAPI)
+	mux.HandleFunc("/api/", serveHueAPI)
+	infof("Emulating a Hue bridge on %s", addr)
+	setHealth("hue-emulation", nil)
+	err = http.ListenAndServe(addr, mux)
+	errorf("Hue emulation: %v", err)
+	setHealth("hue-emulation", err)
+}
+
+// answerSSDP answers SSDP searches for Hue bridges with where to find
+// ours.
+func answerSSDP(port string) {
+	c, err := net.ListenMulticastUDP("udp4", nil, ssdpAddr)
+	if err != nil {
+		errorf("Hue emulation: SSDP: %v", err)
+		setHealth("hue-emulation", err)
+		return
+	}
+	defer c.Close()
+	buf := make([]byte, 8<<10)
+	for {
+		n, from, err := c.ReadFromUDP(buf)
+		if err != nil {
+			errorf("Hue emulation: SSDP: %v", err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" {
+			continue
+		}
+		st := req.Header.Get("ST")
+		switch st {
+		case "ssdp:all", "upnp:rootdevice", "urn:schemas-upnp-org:device:basic:1":
+		default:
+			continue
+		}
+		ip, err := localIPFor(from)
+		if err != nil {
+			warnf("Hue emulation: SSDP: no address to answer %v from: %v", from, err)
+			continue
+		}
+		usn := "uuid:" + hueUUID()
+		if st != "ssdp:all" {
+			usn += "::" + st
+		} else {
+			st = "upnp:rootdevice"
+		}
+		res := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=100\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: http://" + net.JoinHostPort(ip.String(), port) + "/description.xml\r\n" +
+			"SERVER: Linux/3.14.0 UPnP/1.0 IpBridge/1.17.0\r\n" +
+			"hue-bridgeid: " + hueID() + "\r\n" +
+			"ST: " + st + "\r\n" +
+			"USN: " + usn + "\r\n\r\n"
+		debugf("Hue emulation: answering SSDP search for %s from %v", st, from)
+		if _, err := c.WriteToUDP([]byte(res), from); err != nil {
+			warnf("Hue emulation: SSDP: %v", err)
+		}
+	}
+}
+
+// localIPFor returns this host's address on the route to addr.
+func localIPFor(addr *net.UDPAddr) (net.IP, error) {
+	c, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func serveHueDescription(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8" ?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<URLBase>http://%s/</URLBase>
+<device>
+<deviceType>urn:schemas-upnp-org:device:Basic:1</deviceType>
+<friendlyName>sonden (%s)</friendlyName>
+<manufacturer>Royal Philips Electronics</manufacturer>
+<manufacturerURL>http://www.philips.com</manufacturerURL>
+<modelDescription>Philips hue Personal Wireless Lighting</modelDescription>
+<modelName>Philips hue bridge 2015</modelName>
+<modelNumber>BSB002</modelNumber>
+<modelURL>http://www.meethue.com</modelURL>
+<serialNumber>%s</serialNumber>
+<UDN>uuid:%s</UDN>
+<presentationURL>index.html</presentationURL>
+</device>
+</root>
+`, host, host, strings.ReplaceAll(hueMAC(), ":", ""), hueUUID())
+}
+
+// hueLight and hueSensor are how the bridge's API describes them.
+type hueLight struct {
+	State struct {
+		On        bool   `json:"on"`
+		Bri       int    `json:"bri"`
+		Alert     string `json:"alert"`
+		Reachable bool   `json:"reachable"`
+	} `json:"state"`
+	Type             string `json:"type"`
+	Name             string `json:"name"`
+	ModelID          string `json:"modelid"`
+	Manufacturer     string `json:"manufacturername"`
+	UniqueID         string `json:"uniqueid"`
+	SoftwareVersion  string `json:"swversion"`
+	ProductName      string `json:"productname"`
+	SoftwareConfigID string `json:"swconfigid"`
+}
+
+type hueSensor struct {
+	State struct {
+		Presence bool `json:"presence"`
+	} `json:"state"`
+	Config struct {
+		On        bool `json:"on"`
+		Reachable bool `json:"reachable"`
+	} `json:"config"`
+	Type            string `json:"type"`
+	Name            string `json:"name"`
+	ModelID         string `json:"modelid"`
+	Manufacturer    string `json:"manufacturername"`
+	UniqueID        string `json:"uniqueid"`
+	SoftwareVersion string `json:"swversion"`
+}
+
+// hueName is what a monitor's called on the bridge.
+func hueName(m *monitor) string {
+	if m.name == "" {
+		return tr("hue_music")
+	}
+	return m.name + " " + tr("hue_music")
+}
+
+// hueUniqueID makes up the Zigbee address of the nth device.
+func hueUniqueID(n int, suffix string) string {
+	m := hueBridgeID
+	return fmt.Sprintf("00:17:88:01:%02x:%02x:%02x:%02x-%s", m[4], m[5], n>>8, n&0xff, suffix)
+}
+
+// hueLights and hueSensors are the monitors, by ID: the index in
+// monitors, plus one.
+func hueLights() map[string]*hueLight {
+	ls := make(map[string]*hueLight)
+	for i, m := range monitors {
+		l := &hueLight{
+			Type:             "Dimmable light",
+			Name:             hueName(m),
+			ModelID:          "LWB010",
+			Manufacturer:     "Philips",
+			UniqueID:         hueUniqueID(i+1, "0b"),
+			SoftwareVersion:  "1.46.13_r26312",
+			ProductName:      "Hue white lamp",
+			SoftwareConfigID: "FF6681C4",
+		}
+		l.State.On = m.status().Playing
+		l.State.Bri = 254
+		l.State.Alert = "none"
+		l.State.Reachable = true
+		ls[strconv.Itoa(i+1)] = l
+	}
+	return ls
+}
+
+func hueSensors() map[string]*hueSensor {
+	ss := make(map[string]*hueSensor)
+	for i, m := range monitors {
+		s := &hueSensor{
+			Type:            "ZLLPresence",
+			Name:            hueName(m),
+			ModelID:         "SML001",
+			Manufacturer:    "Philips",
+			UniqueID:        hueUniqueID(i+1, "02-0406"),
+			SoftwareVersion: "6.1.1.27575",
+		}
+		s.State.Presence = m.status().Playing
+		s.Config.On = true
+		s.Config.Reachable = true
+		ss[strconv.Itoa(i+1)] = s
+	}
+	return ss
+}
+
+func hueConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"name":             "sonden",
+		"bridgeid":         hueID(),
+		"mac":              hueMAC(),
+		"modelid":          "BSB002",
+		"apiversion":       "1.41.0",
+		"swversion":        "1941132080",
+		"datastoreversion": "98",
+		"factorynew":       false,
+	}
+}
+
+// hueError is a Hue API error: type 3 for a missing resource, 8 for
+// an unmodifiable parameter.
+func hueError(typ int, address, desc string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"error": map[string]interface{}{"type": typ, "address": address, "description": desc},
+	}}
+}
+
+// serveHueAPI serves the emulated bridge's API. Anyone may pair: any
+// username is accepted.
+func serveHueAPI(w http.ResponseWriter, r *http.Request) {
+	var res interface{}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // "api", user, ...
+	switch {
+	case len(parts) == 1 && r.Method == "POST":
+		// Pairing; the link button's always pressed.
+		res = []interface{}{map[string]interface{}{
+			"success": map[string]string{"username": "sonden"},
+		}}
+	case len(parts) == 2 && r.Method == "GET":
+		res = map[string]interface{}{
+			"lights":  hueLights(),
+			"sensors": hueSensors(),
+			"groups":  map[string]interface{}{},
+			"config":  hueConfig(),
+		}
+	case len(parts) == 3 && r.Method == "GET":
+		switch parts[2] {
+		case "lights":
+			res = hueLights()
+		case "sensors":
+			res = hueSensors()
+		case "config":
+			res = hueConfig()
+		case "groups", "scenes", "schedules", "rules", "resourcelinks":
+			res = map[string]interface{}{}
+		}
+	case len(parts) == 4 && r.Method == "GET":
+		switch parts[2] {
+		case "lights":
+			if l, ok := hueLights()[parts[3]]; ok {
+				res = l
+			}
+		case "sensors":
+			if s, ok := hueSensors()[parts[3]]; ok {
+				res = s
+			}
+		}
+	case r.Method == "PUT":
+		res = hueError(8, "/"+strings.Join(parts[2:], "/"), "parameter, on, is not modifiable")
+	}
+	if res == nil {
+		res = hueError(3, "/"+strings.Join(parts[min(2, len(parts)):], "/"), "resource, "+r.URL.Path+", not available")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,135 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Control requests may carry a request ID, in an Idempotency-Key
+// header or a request_id parameter. A retried request with the same
+// ID gets the original response back instead of being run again, so
+// flaky automations can't cause duplicate power cycles. A retry that
+// comes while the original is still running waits for its response.
+// Failures on our side, 5xx responses, aren't kept, so that a retry
+// runs again.
+
+var maxRequestIDs = flag.Int("max-request-ids", 256, "how many control requests' IDs to remember responses to, for replaying to retries")
+
+const requestIDTTL = 24 * time.Hour
+
+type idempotentResult struct {
+	request string        // method, path and form, to catch reused IDs
+	done    chan struct{} // closed once the following are set
+	at      time.Time
+	code    int // 0 if it failed, and isn't kept
+	body    []byte
+}
+
+var (
+	idemMu      sync.Mutex
+	idemResults = make(map[string]*idempotentResult)
+	idemOrder   []string // oldest first, for eviction
+)
+
+// idempotent wraps a control handler with request ID replay
+// protection. Requests without an ID are always run.
+func idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("Idempotency-Key")
+		if id == "" {
+			id = r.FormValue("request_id")
+		}
+		if id == "" {
+			h(w, r)
+			return
+		}
+		r.ParseForm()
+		r.Form.Del("request_id")
+		request := r.Method + " " + r.URL.Path + "?" + r.Form.Encode()
+
+		for {
+			idemMu.Lock()
+			res, ok := idemResults[id]
+			if !ok || time.Since(res.at) >= requestIDTTL {
+				break
+			}
+			idemMu.Unlock()
+			if res.request != request {
+				http.Error(w, "request ID already used for a different request", http.StatusConflict)
+				return
+			}
+			<-res.done
+			if res.code == 0 {
+				// It failed; try again.
+				continue
+			}
+			debugf("replaying response to request %q", id)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(res.code)
+			w.Write(res.body)
+			return
+		}
+
+		// With idemMu held from the loop, claim the ID, so that a
+		// concurrent retry waits for this result rather than running
+		// it again, but other requests needn't.
+		res := &idempotentResult{request: request, done: make(chan struct{}), at: time.Now()}
+		forgetRequestID(id) // if it expired
+		idemResults[id] = res
+		idemOrder = append(idemOrder, id)
+		idemMu.Unlock()
+
+		rec := &responseRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+
+		idemMu.Lock()
+		defer idemMu.Unlock()
+		if rec.code < 500 {
+			res.at, res.code, res.body = time.Now(), rec.code, rec.body.Bytes()
+		} else if idemResults[id] == res {
+			forgetRequestID(id)
+		}
+		close(res.done)
+		for len(idemOrder) > 0 && (len(idemOrder) > *maxRequestIDs || time.Since(idemResults[idemOrder[0]].at) >= requestIDTTL) {
+			delete(idemResults, idemOrder[0])
+			idemOrder = idemOrder[1:]
+		}
+	}
+}
+
+// forgetRequestID removes id's response, if any. idemMu must be held.
+func forgetRequestID(id string) {
+	if _, ok := idemResults[id]; !ok {
+		return
+	}
+	delete(idemResults, id)
+	for i, o := range idemOrder {
+		if o == id {
+			idemOrder = append(idemOrder[:i], idemOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.code = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.body.Write(p)
+	return rr.ResponseWriter.Write(p)
+}
@@ -0,0 +1,111 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	idemMu.Lock()
+	idemResults, idemOrder = make(map[string]*idempotentResult), nil
+	idemMu.Unlock()
+	var (
+		runsMu sync.Mutex
+		runs   = make(map[string]int)
+		fail   = true
+	)
+	release := make(chan struct{})
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		d := r.FormValue("d")
+		runsMu.Lock()
+		runs[d]++
+		failNow := fail && d == "flaky"
+		runsMu.Unlock()
+		if d == "slow" {
+			<-release
+		}
+		if failNow {
+			http.Error(w, "amp unreachable", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK %s\n", d)
+	})
+	do := func(id, d string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("POST", "/pause?d="+d+"&request_id="+id, nil))
+		return rec
+	}
+	count := func(d string) int {
+		runsMu.Lock()
+		defer runsMu.Unlock()
+		return runs[d]
+	}
+
+	// A retry while the original runs waits for it; another request
+	// doesn't.
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 2)
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = do("a", "slow")
+		}(i)
+	}
+	for count("slow") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if rec := do("b", "1h"); rec.Body.String() != "OK 1h\n" {
+		t.Errorf("other request while one runs: %q", rec.Body.String())
+	}
+	close(release)
+	wg.Wait()
+	if n := count("slow"); n != 1 {
+		t.Errorf("slow request run %d times; want 1", n)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "OK slow\n" {
+			t.Errorf("slow request: %d %q", rec.Code, rec.Body.String())
+		}
+	}
+
+	// A failure isn't kept.
+	if rec := do("c", "flaky"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("flaky request: %d; want 500", rec.Code)
+	}
+	runsMu.Lock()
+	fail = false
+	runsMu.Unlock()
+	if rec := do("c", "flaky"); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry of failed request: %d, replayed %q; want 200, run again", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := do("c", "flaky"); rec.Header().Get("Idempotent-Replayed") != "true" || count("flaky") != 2 {
+		t.Errorf("retry of successful request: replayed %q, run %d times; want replayed, 2", rec.Header().Get("Idempotent-Replayed"), count("flaky"))
+	}
+	if rec := do("c", "2h"); rec.Code != http.StatusConflict {
+		t.Errorf("reused ID: %d; want 409", rec.Code)
+	}
+
+	// An expired ID used again goes to the back of the line.
+	idemMu.Lock()
+	idemResults["a"].at = time.Now().Add(-requestIDTTL)
+	idemMu.Unlock()
+	do("a", "slow")
+	idemMu.Lock()
+	last := idemOrder[len(idemOrder)-1]
+	n, kept := len(idemOrder), len(idemResults)
+	idemMu.Unlock()
+	if last != "a" || n != kept {
+		t.Errorf("after reusing an expired ID: last %q of %d in order, %d kept; want \"a\" and the same", last, n, kept)
+	}
+	if n := count("slow"); n != 2 {
+		t.Errorf("expired request run %d times; want 2", n)
+	}
+}
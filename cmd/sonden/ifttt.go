@@ -0,0 +1,122 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// iftttConfig triggers IFTTT Webhooks applets, or another service
+// keyed the same way, as the amps turn on and off, for devices only
+// reachable through the cloud. For example:
+//
+//	"ifttt": [{"key": "...", "on_event": "hifi_on", "off_event": "hifi_off"}]
+//
+// Each trigger's value1 is the monitor, value2 the reason and value3
+// the level.
+type iftttConfig struct {
+	Key string `json:"key"`
+
+	// URL is where to POST, with {event} and {key} replaced. The
+	// default is IFTTT's, https://maker.ifttt.com/trigger/{event}/with/key/{key}.
+	URL string `json:"url"`
+
+	// The event names triggered when the amps turn on and off, and
+	// when music starts and stops. Empty means that one isn't
+	// triggered; OnEvent and OffEvent default to "sonden_amps_on"
+	// and "sonden_amps_off" unless NoOn or NoOff is set.
+	OnEvent   string `json:"on_event"`
+	OffEvent  string `json:"off_event"`
+	PlayEvent string `json:"play_event"`
+	StopEvent string `json:"stop_event"`
+	NoOn      bool   `json:"no_on"`
+	NoOff     bool   `json:"no_off"`
+}
+
+const iftttURL = "https://maker.ifttt.com/trigger/{event}/with/key/{key}"
+
+type ifttt struct {
+	url    string
+	key    string
+	events map[string]string // sonden event type to IFTTT event name
+}
+
+func newIFTTT(ic *iftttConfig) (*ifttt, error) {
+	if ic.Key == "" {
+		return nil, fmt.Errorf("ifttt has no key")
+	}
+	t := &ifttt{url: ic.URL, key: ic.Key, events: make(map[string]string)}
+	if t.url == "" {
+		t.url = iftttURL
+	}
+	if !strings.Contains(t.url, "{event}") {
+		return nil, fmt.Errorf("ifttt url %q has no {event}", t.url)
+	}
+	on, off := ic.OnEvent, ic.OffEvent
+	if on == "" && !ic.NoOn {
+		on = "sonden_amps_on"
+	}
+	if off == "" && !ic.NoOff {
+		off = "sonden_amps_off"
+	}
+	for typ, name := range map[string]string{
+		"amps_on":  on,
+		"amps_off": off,
+		"playing":  ic.PlayEvent,
+		"quiet":    ic.StopEvent,
+	} {
+		if name != "" {
+			t.events[typ] = name
+		}
+	}
+	return t, nil
+}
+
+func (t *ifttt) wants(ev event) bool {
+	return t.events[ev.Type] != ""
+}
+
+// start triggers events until its subscription, which it returns, is
+// cancelled.
+func (t *ifttt) start() *subscriber {
+	sub := subscribe("ifttt", webhookBuffer, dropOldest, t.wants)
+	go func() {
+		for ev := range sub.C {
+			t.trigger(ev)
+		}
+	}()
+	return sub
+}
+
+func (t *ifttt) trigger(ev event) {
+	name := t.events[ev.Type]
+	u := strings.NewReplacer("{event}", name, "{key}", t.key).Replace(t.url)
+	body, _ := json.Marshal(map[string]string{
+		"value1": ev.Monitor,
+		"value2": ev.Reason,
+		"value3": fmt.Sprint(ev.Variance),
+	})
+	err := withRetry("ifttt "+name, func() error {
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		err = doRequest(req)
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err // without the URL, which has the key in it
+		}
+		return err
+	})
+	if err != nil {
+		errorf("ifttt: giving up on %s: %v", name, err)
+		return
+	}
+	debugf("ifttt: triggered %s", name)
+}
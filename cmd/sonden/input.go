@@ -0,0 +1,234 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/sonden/capture"
+)
+
+// A monitor keeps an eye on the samples themselves, not just their
+// level, so a dead or overdriven input doesn't just look like silence
+// or nonstop music.
+
+var (
+	deadInput        = flag.Duration("dead-input", 30*time.Minute, "how long the audio input may be stuck at zero or some other constant value (a loose cable, a dead ADC) before it's reported dead; 0 to never. Digital inputs can send zeros for as long as nothing plays")
+	deadInputRestart = flag.Bool("dead-input-restart", false, "restart capture when the audio input is found dead")
+)
+
+const (
+	maxSampleAge = 5 * time.Second // samples arrive every sampleChunk; this is many of them
+	clipAfter    = 5 * time.Second // of chunks with clipped samples
+	clipFraction = 0.01            // of a chunk's samples at full scale, for it to count as clipped
+	stuckSpread  = 2               // most a stuck input's samples vary by
+)
+
+// inputHealth is what m's recent samples say about its audio input.
+type inputHealth struct {
+	lastSample time.Time // when samples last arrived
+	stuckSince time.Time // since when they've all been stuckAt, or zero
+	stuckAt    int16     // the value they're stuck at
+	dead       bool      // stuck for -dead-input
+	started    time.Time // when capture last (re)started
+	clipSince  time.Time // since when every chunk has been clipped, or zero
+	clipWarned bool      // about the clipping since clipSince
+	clipEvents int64     // runs of clipped chunks
+	clipped    int64     // samples at full scale
+}
+
+// checkSamples updates m's input health with a chunk of samples read
+// at now. It returns an error if the input's dead and capture should
+// be restarted.
+func (m *monitor) checkSamples(samples []int16, now time.Time) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	lo, hi, clipped := samples[0], samples[0], 0
+	for _, s := range samples {
+		lo, hi = min(lo, s), max(hi, s)
+		if s == 32767 || s == -32768 {
+			clipped++
+		}
+	}
+	m.mu.Lock()
+	in := &m.inputHealth
+	in.lastSample = now
+	in.clipped += int64(clipped)
+	if float64(clipped) <= clipFraction*float64(len(samples)) {
+		in.clipSince, in.clipWarned = time.Time{}, false
+	} else if in.clipSince.IsZero() {
+		in.clipSince = now
+		in.clipEvents++
+	}
+	warnClip := !in.clipSince.IsZero() && !in.clipWarned && now.Sub(in.clipSince) > clipAfter
+	if warnClip {
+		in.clipWarned = true
+	}
+	mid := int16((int(lo) + int(hi)) / 2)
+	stuck := int(hi)-int(lo) <= stuckSpread
+	if stuck && !in.stuckSince.IsZero() && abs(int(mid)-int(in.stuckAt)) <= stuckSpread {
+		// Still stuck.
+	} else if stuck {
+		in.stuckSince, in.stuckAt = now, mid
+	} else {
+		in.stuckSince = time.Time{}
+	}
+	wasDead := in.dead
+	in.dead = *deadInput > 0 && !in.stuckSince.IsZero() && now.Sub(in.stuckSince) > *deadInput
+	dead := in.dead
+	restart := dead && *deadInputRestart && now.Sub(in.started) > *deadInput
+	var err error
+	if dead {
+		err = fmt.Errorf("dead: stuck at %d for %v", in.stuckAt, now.Sub(in.stuckSince).Round(time.Second))
+	}
+	m.mu.Unlock()
+
+	if warnClip {
+		m.logf(levelWarn, "audio input is clipping: %s", gainAdvice)
+		m.publish(event{Type: "clipping", Error: gainAdvice})
+	}
+	if dead != wasDead {
+		setHealth(m.subsystem("input"), err)
+		if dead {
+			m.logf(levelError, "audio input is %v; check its cable", err)
+		}
+	}
+	if restart {
+		return fmt.Errorf("audio input %v", err)
+	}
+	return nil
+}
+
+// gainAdvice is what to do about clipping.
+const gainAdvice = "turn its gain down (with alsamixer, or on the source) until it stops; clipped audio skews the level and the threshold"
+
+// inputStatus is a monitor's input health in /status.
+type inputStatus struct {
+	LastSample time.Time `json:"last_sample"`
+	Clipping   bool      `json:"clipping"`             // for longer than a moment
+	ClipEvents int64     `json:"clip_events"`          // times it started clipping
+	Clipped    int64     `json:"clipped_samples"`      // at full scale
+	Advice     string    `json:"advice,omitempty"`     // what to do about it
+	StuckSince time.Time `json:"stuck_since,omitzero"` // at one value; see -dead-input
+}
+
+// inputStatus returns m's input health as of now.
+func (m *monitor) inputStatus(now time.Time) *inputStatus {
+	if !m.usesAudio {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	in := &m.inputHealth
+	st := &inputStatus{
+		LastSample: in.lastSample,
+		Clipping:   !in.clipSince.IsZero() && now.Sub(in.clipSince) > clipAfter,
+		ClipEvents: in.clipEvents,
+		Clipped:    in.clipped,
+		StuckSince: in.stuckSince,
+	}
+	if st.Clipping {
+		st.Advice = gainAdvice
+	}
+	return st
+}
+
+// captureStarted notes that m's capture (re)started at now, giving
+// it a fresh -dead-input to come back to life before it's restarted
+// again.
+func (m *monitor) captureStarted(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputHealth.started = now
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// A healthProblem is one reason /healthz fails.
+type healthProblem struct {
+	Reason    string `json:"reason"` // "no_samples", "dead_input", "clipping", "amp_unreachable" or "unhealthy"
+	Monitor   string `json:"monitor,omitempty"`
+	Subsystem string `json:"subsystem,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// inputProblems returns what's wrong with m's audio input as of now.
+func (m *monitor) inputProblems(now time.Time) []healthProblem {
+	if !m.usesAudio || (m.input != "" && !capture.IsNetwork(m.input)) {
+		return nil
+	}
+	m.mu.Lock()
+	in := m.inputHealth
+	m.mu.Unlock()
+	var ps []healthProblem
+	if age := now.Sub(in.lastSample); in.lastSample.IsZero() || age > maxSampleAge {
+		detail := "no samples yet"
+		if !in.lastSample.IsZero() {
+			detail = "last sample " + age.Round(time.Second).String() + " ago"
+		}
+		ps = append(ps, healthProblem{Reason: "no_samples", Monitor: m.name, Detail: detail})
+	}
+	if !in.clipSince.IsZero() && now.Sub(in.clipSince) > clipAfter {
+		ps = append(ps, healthProblem{Reason: "clipping", Monitor: m.name,
+			Detail: "clipping for " + now.Sub(in.clipSince).Round(time.Second).String() + "; " + gainAdvice})
+	}
+	return ps
+}
+
+// serveHealthz reports 200 if samples are flowing, the inputs look
+// alive and unclipped, and everything else is healthy, or else 503
+// with each problem and its reason, so monitoring can tell a dead
+// audio device from an unreachable amp.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var ps []healthProblem
+	for _, m := range monitors {
+		ps = append(ps, m.inputProblems(now)...)
+	}
+	_, states := healthSnapshot()
+	var names []string
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hs := states[name]
+		if hs.Healthy {
+			continue
+		}
+		reason := "unhealthy"
+		switch {
+		case strings.HasPrefix(name, "amp/"):
+			reason = "amp_unreachable"
+		case name == "input" || strings.HasPrefix(name, "input/"):
+			reason = "dead_input"
+		}
+		ps = append(ps, healthProblem{Reason: reason, Subsystem: name, Detail: hs.Error})
+	}
+	j, err := json.MarshalIndent(struct {
+		Healthy  bool            `json:"healthy"`
+		Problems []healthProblem `json:"problems,omitempty"`
+	}{len(ps) == 0, ps}, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(ps) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,389 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/sonden/capture"
+)
+
+// TestIntegration runs a monitor over a recording of music between
+// silences, with a Denon receiver and a zigbee2mqtt plug for amps, an
+// HTTP scene and a webhook, all faked in-process, and checks that each
+// was switched on and then off again.
+func TestIntegration(t *testing.T) {
+	denon := newFakeDenon(t)
+	broker := newFakeBroker(t)
+	var (
+		hitsMu   sync.Mutex
+		scenes   []string
+		webhooks []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitsMu.Lock()
+		defer hitsMu.Unlock()
+		if r.URL.Path != "/webhook" {
+			scenes = append(scenes, r.URL.Path)
+			return
+		}
+		var ev event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		webhooks = append(webhooks, ev.Type)
+	}))
+	defer srv.Close()
+
+	input := filepath.Join(t.TempDir(), "music.pcm")
+	writeMusic(t, input, 500*time.Millisecond, 1500*time.Millisecond, 4*time.Second)
+	conf := fmt.Sprintf(`{
+		"monitors": [{
+			"name": "test",
+			"input": %q,
+			"threshold": 1000,
+			"window": "250ms",
+			"playing": "500ms",
+			"idle": "1s",
+			"amps": [
+				{"addr": %q},
+				{"type": "zigbee2mqtt", "addr": %q, "name": "sub"}
+			],
+			"scenes": [{"type": "http", "on_url": "%s/scene/on", "off_url": "%s/scene/off"}]
+		}],
+		"webhooks": [{"url": "%s/webhook"}]
+	}`, input, denon.addr, broker.addr, srv.URL, srv.URL, srv.URL)
+	confFile := filepath.Join(t.TempDir(), "sonden.json")
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := startOutputs(c); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMonitor(c.Monitors[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	monitors = []*monitor{m}
+	m.run()
+
+	// Not knowing the amps' state to begin with, sonden turns them
+	// off in the quiet before the music. The amps are switched, and
+	// the outputs told, in the background.
+	want := map[string][]string{
+		"denon":   {"ZMOFF", "PWSTANDBY", "ZMON", "PWON", "ZMOFF", "PWSTANDBY"},
+		"plug":    {"OFF", "ON", "OFF"},
+		"scene":   {"/scene/off", "/scene/on", "/scene/off"},
+		"webhook": {"amps_off", "amps_on", "amps_off"},
+	}
+	got := func() map[string][]string {
+		hitsMu.Lock()
+		defer hitsMu.Unlock()
+		return map[string][]string{
+			"denon":   denon.commands(),
+			"plug":    broker.sets("zigbee2mqtt/sub"),
+			"scene":   append([]string(nil), scenes...),
+			"webhook": append([]string(nil), webhooks...),
+		}
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !reflect.DeepEqual(got(), want) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if g := got(); !reflect.DeepEqual(g, want) {
+		t.Errorf("got %q; want %q", g, want)
+	}
+}
+
+// writeMusic writes total of faint hiss, with a loud chord from after
+// quiet for playing.
+func writeMusic(t *testing.T, name string, quiet, playing, total time.Duration) {
+	r := rand.New(rand.NewSource(1))
+	var b []byte
+	for i := 0; i < int(total.Seconds()*capture.SampleHz); i++ {
+		ts := float64(i) / capture.SampleHz
+		v := r.NormFloat64() * 20
+		if d := time.Duration(ts * float64(time.Second)); d >= quiet && d < quiet+playing {
+			v += 6000*math.Sin(2*math.Pi*440*ts) + 3000*math.Sin(2*math.Pi*660*ts)
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(int16(v)))
+	}
+	if err := os.WriteFile(name, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeDenon is a Denon receiver's telnet port.
+type fakeDenon struct {
+	addr string
+
+	mu      sync.Mutex
+	on      bool
+	volume  string
+	cmds    []string // power commands
+	queries []string
+	conns   map[net.Conn]bool
+}
+
+func newFakeDenon(t *testing.T) *fakeDenon {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	d := &fakeDenon{addr: ln.Addr().String(), volume: "50", conns: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(c)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDenon) serve(c net.Conn) {
+	d.mu.Lock()
+	d.conns[c] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, c)
+		d.mu.Unlock()
+		c.Close()
+	}()
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\r')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSuffix(line, "\r")
+		d.mu.Lock()
+		var reply string
+		if strings.HasSuffix(cmd, "?") {
+			d.queries = append(d.queries, cmd)
+		}
+		switch cmd {
+		case "PW?":
+			reply = "PWSTANDBY"
+			if d.on {
+				reply = "PWON"
+			}
+		case "SI?":
+			reply = "SICD"
+		case "MV?":
+			reply = "MV" + d.volume
+		case "ZMON", "PWON":
+			d.on = true
+			d.cmds = append(d.cmds, cmd)
+			reply = cmd
+		case "ZMOFF", "PWSTANDBY":
+			d.on = false
+			d.cmds = append(d.cmds, cmd)
+			reply = cmd
+		}
+		d.mu.Unlock()
+		if reply != "" {
+			fmt.Fprintf(c, "%s\r", reply)
+		}
+	}
+}
+
+// press is someone using the receiver's remote: it makes the change
+// line says, like "MV40" or "PWSTANDBY", and reports it.
+func (d *fakeDenon) press(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case line == "PWON":
+		d.on = true
+	case line == "PWSTANDBY":
+		d.on = false
+	case strings.HasPrefix(line, "MV"):
+		d.volume = line[2:]
+	}
+	for c := range d.conns {
+		fmt.Fprintf(c, "%s\r", line)
+	}
+}
+
+// takeQueries returns the queries received since it was last called.
+func (d *fakeDenon) takeQueries() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q := d.queries
+	d.queries = nil
+	return q
+}
+
+func (d *fakeDenon) commands() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.cmds...)
+}
+
+// fakeBroker is an MQTT broker with zigbee2mqtt behind it: a plug's
+// topic plus /set sets its state, and /get asks for it, and either way
+// the plug reports its state on its topic.
+type fakeBroker struct {
+	addr string
+
+	mu     sync.Mutex
+	state  map[string]string   // by plug topic
+	setLog map[string][]string // by plug topic
+	subs   map[net.Conn][]string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &fakeBroker{
+		addr:   ln.Addr().String(),
+		state:  make(map[string]string),
+		setLog: make(map[string][]string),
+		subs:   make(map[net.Conn][]string),
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.subs, c)
+		b.mu.Unlock()
+		c.Close()
+	}()
+	br := bufio.NewReader(c)
+	for {
+		typ, body, err := readMQTT(br)
+		if err != nil {
+			return
+		}
+		switch typ & 0xf0 {
+		case 0x10: // CONNECT
+			writeMQTT(c, 0x20, []byte{0, 0})
+		case 0x80: // SUBSCRIBE
+			if len(body) < 4 {
+				return
+			}
+			topic := mqttTopic(body[2:])
+			b.mu.Lock()
+			b.subs[c] = append(b.subs[c], topic)
+			b.mu.Unlock()
+			writeMQTT(c, 0x90, []byte{body[0], body[1], 0})
+		case 0x30: // PUBLISH
+			topic := mqttTopic(body)
+			payload := body[2+len(topic):]
+			var req struct {
+				State string `json:"state"`
+			}
+			json.Unmarshal(payload, &req)
+			plug, set := strings.CutSuffix(topic, "/set")
+			if !set {
+				plug, _ = strings.CutSuffix(topic, "/get")
+			}
+			b.mu.Lock()
+			if set {
+				b.state[plug] = req.State
+				b.setLog[plug] = append(b.setLog[plug], req.State)
+			}
+			st := b.state[plug]
+			if st == "" {
+				st = "OFF"
+			}
+			report, _ := json.Marshal(map[string]interface{}{"state": st, "power": 1.5})
+			for sc, topics := range b.subs {
+				for _, t := range topics {
+					if t == plug {
+						writeMQTT(sc, 0x30, append(binary.BigEndian.AppendUint16(nil, uint16(len(plug))), append([]byte(plug), report...)...))
+					}
+				}
+			}
+			b.mu.Unlock()
+		case 0xe0: // DISCONNECT
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) sets(plug string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.setLog[plug]...)
+}
+
+func mqttTopic(b []byte) string {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n])
+}
+
+func readMQTT(br *bufio.Reader) (typ byte, body []byte, err error) {
+	if typ, err = br.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	n := 0
+	for shift := 0; ; shift += 7 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, n)
+	_, err = io.ReadFull(br, body)
+	return typ, body, err
+}
+
+func writeMQTT(w io.Writer, typ byte, body []byte) {
+	p := []byte{typ}
+	for n := len(body); ; {
+		c := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			c |= 0x80
+		}
+		p = append(p, c)
+		if n == 0 {
+			break
+		}
+	}
+	w.Write(append(p, body...))
+}
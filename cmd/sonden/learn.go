@@ -0,0 +1,105 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"math"
+	"time"
+)
+
+// With -auto-threshold, a monitor with nothing in -state starts out
+// learning: for -learn it collects the levels it hears and only turns
+// the amps on for music far over the usual threshold. Then it sets the
+// threshold from the noise floor it heard and remembers it.
+
+var (
+	autoThreshold = flag.Bool("auto-threshold", false, "learn the threshold from the input's noise floor; see -learn and -state")
+	learnPeriod   = flag.Duration("learn", 24*time.Hour, "with -auto-threshold, how long to learn for before trusting the learned threshold")
+)
+
+const (
+	// learnMargin is how many times over the threshold music must
+	// be while learning to turn the amps on.
+	learnMargin = 10
+
+	// noiseFloorPercentile is the percentile of levels heard taken
+	// as the noise floor: most of a day is quiet.
+	noiseFloorPercentile = 20
+
+	// autoThresholdFactor is how far over the noise floor the
+	// learned threshold is.
+	autoThresholdFactor = 8
+
+	histBinsPerOctave = 8
+	histMinLevel      = 1.0 / 1024
+	histBins          = 48 * histBinsPerOctave
+)
+
+// A learner collects a histogram of levels heard.
+type learner struct {
+	start, until time.Time
+	n            int
+	bins         [histBins]int
+}
+
+func (l *learner) add(level float64) {
+	i := 0
+	if level > histMinLevel {
+		i = int(math.Log2(level/histMinLevel) * histBinsPerOctave)
+	}
+	if i >= histBins {
+		i = histBins - 1
+	}
+	l.bins[i]++
+	l.n++
+}
+
+// percentile returns the level below which p percent of the levels
+// heard fell, to within a bin.
+func (l *learner) percentile(p float64) float64 {
+	want := int(math.Ceil(float64(l.n) * p / 100))
+	seen := 0
+	for i, c := range l.bins {
+		if seen += c; seen >= want && seen > 0 {
+			return histMinLevel * math.Pow(2, float64(i+1)/histBinsPerOctave)
+		}
+	}
+	return 0
+}
+
+// learning reports whether m is still learning at now, feeding it
+// level. When the learning period is over it sets and remembers the
+// learned threshold.
+func (m *monitor) learning(level float64, now time.Time) bool {
+	l := m.learn
+	if l == nil {
+		return false
+	}
+	if l.start.IsZero() {
+		l.start, l.until = now, now.Add(*learnPeriod)
+		m.logf(levelInfo, "learning the noise floor until %v; only very loud music turns the amps on meanwhile", l.until.Format("Mon 15:04"))
+	}
+	l.add(level)
+	if now.Before(l.until) {
+		return true
+	}
+	floor := l.percentile(noiseFloorPercentile)
+	threshold := floor * autoThresholdFactor
+	m.mu.Lock()
+	m.threshold = threshold
+	m.mu.Unlock()
+	m.learn = nil
+	m.logf(levelInfo, "learned threshold %v from %d windows over %v (noise floor %v)", threshold, l.n, now.Sub(l.start).Round(time.Minute), floor)
+	m.publish(event{Type: "learned", Variance: threshold})
+	if m.decide == nil {
+		// Not a replay.
+		updateState(m.name, func(ms *monitorState) {
+			ms.Threshold = threshold
+			ms.NoiseFloor = floor
+			ms.LearnedAt = now
+		})
+	}
+	return false
+}
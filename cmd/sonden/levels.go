@@ -0,0 +1,145 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Each monitor keeps its last few minutes of window levels, served as
+// /levels, so what the detector saw around a bad transition can be
+// looked at without scraping debug logs.
+
+var (
+	levelHistory    = flag.Duration("level-history", 10*time.Minute, "how much of each monitor's window levels to keep for /levels")
+	levelHistoryMax = flag.Int("level-history-max", 20000, "most of each monitor's window levels to keep for /levels, however short its hop")
+)
+
+// A levelSample is one window's level, and what was made of it.
+type levelSample struct {
+	Time      time.Time `json:"time"`
+	Level     float64   `json:"level"`
+	Threshold float64   `json:"threshold"`
+	Playing   bool      `json:"playing"`
+}
+
+// levelRing is a monitor's recent levels, oldest first.
+type levelRing struct {
+	s     []levelSample
+	start int // of the first kept in s
+}
+
+// add adds ls, forgetting those older than -level-history, and the
+// oldest beyond -level-history-max.
+func (r *levelRing) add(ls levelSample) {
+	r.s = append(r.s, ls)
+	cutoff := ls.Time.Add(-*levelHistory)
+	for r.start < len(r.s) && (r.s[r.start].Time.Before(cutoff) || len(r.s)-r.start > *levelHistoryMax) {
+		r.start++
+	}
+	if r.start > len(r.s)/2 {
+		r.s = append(r.s[:0], r.s[r.start:]...)
+		r.start = 0
+	}
+}
+
+// since returns a copy of the levels kept since t.
+func (r *levelRing) since(t time.Time) []levelSample {
+	kept := r.s[r.start:]
+	i := 0
+	for i < len(kept) && kept[i].Time.Before(t) {
+		i++
+	}
+	return append([]levelSample{}, kept[i:]...)
+}
+
+// serveLevels returns a monitor's recent levels as JSON, oldest first,
+// optionally only since a time in RFC 3339, or with format=svg as a
+// sparkline.
+func serveLevels(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ms := selectedMonitors(r)
+	switch len(ms) {
+	case 0:
+		http.Error(w, "no such monitor", http.StatusNotFound)
+		return
+	case 1:
+	default:
+		http.Error(w, "more than one monitor; say which with monitor=", http.StatusBadRequest)
+		return
+	}
+	m := ms[0]
+	m.mu.Lock()
+	levels := m.levels.since(since)
+	m.mu.Unlock()
+	if r.FormValue("format") == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(levelsSVG(levels, 600, 100)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels)
+}
+
+// levelsSVG draws levels as a w by h sparkline on a log scale, with
+// the threshold dashed and where music was playing shaded.
+func levelsSVG(levels []levelSample, w, h int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, w, h, w, h)
+	if len(levels) < 2 {
+		b.WriteString(`</svg>`)
+		return b.String()
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, l := range levels {
+		for _, v := range []float64{l.Level, l.Threshold} {
+			v = math.Log10(v + 1)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	if hi == lo {
+		hi = lo + 1
+	}
+	t0, span := levels[0].Time, levels[len(levels)-1].Time.Sub(levels[0].Time)
+	if span <= 0 {
+		span = time.Second
+	}
+	x := func(t time.Time) float64 { return float64(w) * float64(t.Sub(t0)) / float64(span) }
+	y := func(v float64) float64 { return float64(h) - float64(h)*(math.Log10(v+1)-lo)/(hi-lo) }
+
+	for i := 0; i < len(levels); i++ {
+		if !levels[i].Playing {
+			continue
+		}
+		j := i
+		for j+1 < len(levels) && levels[j+1].Playing {
+			j++
+		}
+		fmt.Fprintf(&b, `<rect x="%.1f" y="0" width="%.1f" height="%d" fill="#dfd"/>`, x(levels[i].Time), x(levels[j].Time)-x(levels[i].Time), h)
+		i = j
+	}
+	b.WriteString(`<polyline fill="none" stroke="#c00" stroke-dasharray="4 3" points="`)
+	for _, l := range levels {
+		fmt.Fprintf(&b, "%.1f,%.1f ", x(l.Time), y(l.Threshold))
+	}
+	b.WriteString(`"/><polyline fill="none" stroke="#000" points="`)
+	for _, l := range levels {
+		fmt.Fprintf(&b, "%.1f,%.1f ", x(l.Time), y(l.Level))
+	}
+	b.WriteString(`"/></svg>`)
+	return b.String()
+}
@@ -0,0 +1,94 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logLevelFlag = flag.String("loglevel", "info", "minimum level to log: debug, info, warn, or error")
+	logJSON      = flag.Bool("logjson", false, "log one JSON object per line (for journald, Loki, etc) instead of plain text")
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string { return levelNames[l] }
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return levelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	logMu    sync.Mutex
+	minLevel = levelInfo
+)
+
+// initLogging configures the logger from flags. It must be called
+// after flag.Parse.
+func initLogging() {
+	lvl, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatalf("bad -loglevel: %v", err)
+	}
+	minLevel = lvl
+	if *logJSON {
+		log.SetFlags(0)
+	}
+}
+
+type jsonLogLine struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+}
+
+func logf(lvl logLevel, format string, args ...interface{}) {
+	if lvl < minLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !*logJSON {
+		log.Printf("%-5s %s", strings.ToUpper(lvl.String()), msg)
+		return
+	}
+	line, _ := json.Marshal(jsonLogLine{time.Now(), lvl.String(), msg})
+	logMu.Lock()
+	defer logMu.Unlock()
+	os.Stderr.Write(append(line, '\n'))
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+func fatalf(format string, args ...interface{}) {
+	logf(levelError, format, args...)
+	os.Exit(1)
+}
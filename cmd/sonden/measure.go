@@ -0,0 +1,231 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The "measure" command switches an amp off and on with automation
+// paused, reads its plug in each state, and remembers what it draws in
+// -state. Measured watts replace configured ones for power budgets and
+// energy reports.
+
+// ampPower is what an amp was measured to draw.
+type ampPower struct {
+	OnWatts      float64   `json:"on_watts"`
+	StandbyWatts float64   `json:"standby_watts"`
+	MeasuredAt   time.Time `json:"measured_at"`
+}
+
+const (
+	measureSettle  = 30 * time.Second // after switching, for the draw to settle
+	measureSwitch  = 2 * time.Minute  // for the amp's worker to switch it, retries and all
+	measureSamples = 10
+	measureEvery   = time.Second
+)
+
+var ampMeasured = make(map[*managedAmp]*ampPower) // guarded by mu
+
+// onWatts returns what amp draws when on: measured if it has been,
+// else as configured.
+func (a *managedAmp) onWatts() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return a.onWattsLocked()
+}
+
+// onWattsLocked is onWatts with mu held.
+func (a *managedAmp) onWattsLocked() float64 {
+	if p := ampMeasured[a]; p != nil {
+		return p.OnWatts
+	}
+	return a.watts
+}
+
+// standbyWatts returns what amp draws in standby: measured if it has
+// been, else as configured.
+func (a *managedAmp) standbyWatts() float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	if p := ampMeasured[a]; p != nil {
+		return p.StandbyWatts
+	}
+	return a.standby
+}
+
+// measure measures what amp draws in standby and on, telling progress
+// what it's doing, and remembers it. The amp is left as it was found.
+func (m *monitor) measure(a *managedAmp, progress func(format string, args ...interface{})) (*ampPower, error) {
+	if a.plug == nil {
+		return nil, fmt.Errorf("amp %s has no plug configured", a.name())
+	}
+	if *dryRun {
+		return nil, fmt.Errorf("can't measure with -dry_run; the amp has to be switched")
+	}
+	if _, err := a.plug.watts(); err != nil {
+		return nil, fmt.Errorf("reading plug: %v", err)
+	}
+
+	m.mu.Lock()
+	wasPaused, wasParty := m.pausedUntil, m.party
+	until := time.Now().Add(2 * (measureSwitch + measureSettle + measureSamples*measureEvery))
+	m.pausedUntil, m.party = until, false
+	m.mu.Unlock()
+	defer func() {
+		// Unless someone's paused or resumed since.
+		m.mu.Lock()
+		if m.pausedUntil.Equal(until) && !m.party {
+			m.pausedUntil, m.party = wasPaused, wasParty
+		}
+		m.mu.Unlock()
+	}()
+	m.logf(levelInfo, "measuring the power draw of amp %s; automatic control paused meanwhile", a.name())
+	clearOverride(a)
+	wasOn, known := getAmpState(a)
+
+	p := &ampPower{}
+	for _, step := range []struct {
+		on bool
+		w  *float64
+	}{{false, &p.StandbyWatts}, {true, &p.OnWatts}} {
+		what := "standby"
+		if step.on {
+			what = "on"
+		}
+		progress("Switching amp %s to %s; waiting %v for it to settle...", a.name(), what, measureSettle)
+		if err := switchAmp(a, step.on); err != nil {
+			return nil, err
+		}
+		time.Sleep(measureSettle)
+		progress("Reading the plug %d times...", measureSamples)
+		w, err := a.plug.sample(measureSamples, measureEvery)
+		if err != nil {
+			return nil, fmt.Errorf("reading plug: %v", err)
+		}
+		*step.w = w
+		progress("%s: %.1fW", what, w)
+	}
+	if known && !wasOn {
+		progress("Switching amp %s back to standby.", a.name())
+		if err := switchAmp(a, false); err != nil {
+			return nil, err
+		}
+	}
+	p.MeasuredAt = time.Now()
+
+	if p.OnWatts <= p.StandbyWatts {
+		m.logf(levelWarn, "amp %s measured %.1fW on but %.1fW in standby; is the plug in front of it?", a.name(), p.OnWatts, p.StandbyWatts)
+	}
+	mu.Lock()
+	ampMeasured[a] = p
+	mu.Unlock()
+	updateState(m.name, func(ms *monitorState) {
+		amps := map[string]*ampPower{a.name(): p}
+		for k, v := range ms.Amps {
+			if k != a.name() {
+				amps[k] = v
+			}
+		}
+		ms.Amps = amps
+	})
+	m.logf(levelInfo, "amp %s draws %.1fW on and %.1fW in standby", a.name(), p.OnWatts, p.StandbyWatts)
+	return p, nil
+}
+
+// switchAmp has a's worker switch it to state, as it would be by hand,
+// and returns once it's done, or an error if it didn't take.
+func switchAmp(a *managedAmp, state bool) error {
+	forceAmpState(a, state)
+	deadline := time.Now().Add(measureSwitch)
+	for {
+		if _, busy := wantedAmpState(a); !busy {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("amp %s not switched %s after %v", a.name(), powerString(state), measureSwitch)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	on, err := a.QueryPower()
+	if err != nil {
+		return fmt.Errorf("querying amp %s: %v", a.name(), err)
+	}
+	if on != state {
+		return fmt.Errorf("amp %s is still %s; its commands failed or did nothing", a.name(), powerString(on))
+	}
+	return nil
+}
+
+// findAmp returns the amp with the given address and zone (0 for any)
+// across all monitors, and its monitor.
+func findAmp(addr string, zone int) (*monitor, *managedAmp) {
+	for _, m := range monitors {
+		for _, a := range m.amps {
+			if a.Addr() == addr && (zone == 0 || a.zone == zone) {
+				return m, a
+			}
+		}
+	}
+	return nil, nil
+}
+
+// serveMeasure runs the measuring routine on the amp given by the amp
+// (address) and zone parameters, or on the only amp with a plug,
+// streaming its progress as plain text.
+func serveMeasure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		m *monitor
+		a *managedAmp
+	)
+	if addr := r.FormValue("amp"); addr != "" {
+		zone, _ := strconv.Atoi(r.FormValue("zone"))
+		if m, a = findAmp(addr, zone); a == nil {
+			http.Error(w, "no such amp", http.StatusNotFound)
+			return
+		}
+	} else {
+		n := 0
+		for _, mm := range monitors {
+			for _, aa := range mm.amps {
+				if aa.plug != nil {
+					m, a = mm, aa
+					n++
+				}
+			}
+		}
+		if n != 1 {
+			http.Error(w, fmt.Sprintf("%d amps have plugs; say which one with amp=<addr>", n), http.StatusBadRequest)
+			return
+		}
+	}
+	f, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	started := false
+	progress := func(format string, args ...interface{}) {
+		started = true
+		fmt.Fprintf(w, format+"\n", args...)
+		if f != nil {
+			f.Flush()
+		}
+	}
+	p, err := m.measure(a, progress)
+	if err != nil && !started {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		// The status is long gone; say so in the body.
+		progress("Error: %v", err)
+		return
+	}
+	progress("Amp %s: %.1fW on, %.1fW in standby. Saved.", a.name(), p.OnWatts, p.StandbyWatts)
+}
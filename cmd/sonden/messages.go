@@ -0,0 +1,227 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// User-facing strings (notifications and the web pages) are looked up
+// here by key so they can be shown in the household's language. Log
+// messages and the API stay in English.
+
+var localeFlag = flag.String("locale", "en", "language for notifications and web pages: "+strings.Join(locales(), ", "))
+
+var messages = map[string]map[string]string{
+	"en": {
+		"title":               "sonden",
+		"unhealthy":           "%s is failing: %s",
+		"recovered":           "%s is working again",
+		"long_play":           "The amps have been on for a long time.",
+		"amps_on":             "Amps turned on (%s).",
+		"amps_off":            "Amps turned off (%s).",
+		"threshold_exceeded":  "music started",
+		"below_threshold":     "music stopped",
+		"idle_timeout":        "silent for a while",
+		"prewarm":             "scheduled warm-up",
+		"schedule_block":      "quiet hours",
+		"override_active":     "changed by hand",
+		"paused":              "automation paused",
+		"manual":              "requested",
+		"power_budget":        "power budget",
+		"party":               "party mode",
+		"cooldown":            "too soon after the last switch",
+		"group":               "multiroom group",
+		"simple_on":           "ON",
+		"simple_off":          "OFF",
+		"simple_playing":      "Music playing",
+		"simple_silent":       "Silent",
+		"simple_turn_on":      "Turn on",
+		"simple_turn_off":     "Turn off",
+		"public_since":        "since",
+		"weekly_summary":      "Amp on-time this week by input: %s",
+		"weekly_summary_idle": "The amps weren't on this week.",
+		"source_playing":      "player started",
+		"weekly_energy":       "About %.1f kWh.",
+		"dash_pause":          "Pause 1h",
+		"dash_resume":         "Resume",
+		"dash_recent":         "Recently",
+		"dash_party_until":    "party mode until %s",
+		"dash_paused_until":   "paused until %s",
+		"dash_last_switched":  "last switched %s",
+		"dash_amp_on":         "on",
+		"dash_amp_off":        "off",
+		"dash_amp_unknown":    "unknown",
+		"dash_overridden":     "overridden",
+		"dash_zone":           "zone %s",
+		"hue_music":           "Music",
+	},
+	"de": {
+		"title":               "sonden",
+		"unhealthy":           "%s funktioniert nicht: %s",
+		"recovered":           "%s funktioniert wieder",
+		"long_play":           "Die Verstärker sind schon lange an.",
+		"amps_on":             "Verstärker eingeschaltet (%s).",
+		"amps_off":            "Verstärker ausgeschaltet (%s).",
+		"threshold_exceeded":  "Musik gestartet",
+		"below_threshold":     "Musik gestoppt",
+		"idle_timeout":        "eine Weile still",
+		"prewarm":             "geplantes Vorwärmen",
+		"schedule_block":      "Ruhezeit",
+		"override_active":     "von Hand geändert",
+		"paused":              "Automatik pausiert",
+		"manual":              "angefordert",
+		"power_budget":        "Leistungsbudget",
+		"party":               "Partymodus",
+		"cooldown":            "zu kurz nach dem letzten Schalten",
+		"group":               "Multiroom-Gruppe",
+		"simple_on":           "AN",
+		"simple_off":          "AUS",
+		"simple_playing":      "Musik läuft",
+		"simple_silent":       "Stille",
+		"simple_turn_on":      "Einschalten",
+		"simple_turn_off":     "Ausschalten",
+		"public_since":        "seit",
+		"weekly_summary":      "Verstärker-Laufzeit diese Woche nach Eingang: %s",
+		"weekly_summary_idle": "Die Verstärker waren diese Woche nicht an.",
+		"source_playing":      "Player gestartet",
+		"weekly_energy":       "Etwa %.1f kWh.",
+		"dash_pause":          "1 Std. pausieren",
+		"dash_resume":         "Fortsetzen",
+		"dash_recent":         "Zuletzt",
+		"dash_party_until":    "Partymodus bis %s",
+		"dash_paused_until":   "pausiert bis %s",
+		"dash_last_switched":  "zuletzt geschaltet %s",
+		"dash_amp_on":         "an",
+		"dash_amp_off":        "aus",
+		"dash_amp_unknown":    "unbekannt",
+		"dash_overridden":     "übersteuert",
+		"dash_zone":           "Zone %s",
+		"hue_music":           "Musik",
+	},
+	"es": {
+		"title":               "sonden",
+		"unhealthy":           "%s está fallando: %s",
+		"recovered":           "%s vuelve a funcionar",
+		"long_play":           "Los amplificadores llevan mucho tiempo encendidos.",
+		"amps_on":             "Amplificadores encendidos (%s).",
+		"amps_off":            "Amplificadores apagados (%s).",
+		"threshold_exceeded":  "empezó la música",
+		"below_threshold":     "paró la música",
+		"idle_timeout":        "silencio durante un rato",
+		"prewarm":             "calentamiento programado",
+		"schedule_block":      "horas de silencio",
+		"override_active":     "cambiado a mano",
+		"paused":              "automatización en pausa",
+		"manual":              "solicitado",
+		"power_budget":        "límite de potencia",
+		"party":               "modo fiesta",
+		"cooldown":            "demasiado pronto tras el último cambio",
+		"group":               "grupo multisala",
+		"simple_on":           "ENCENDIDO",
+		"simple_off":          "APAGADO",
+		"simple_playing":      "Suena música",
+		"simple_silent":       "Silencio",
+		"simple_turn_on":      "Encender",
+		"simple_turn_off":     "Apagar",
+		"public_since":        "desde",
+		"weekly_summary":      "Tiempo encendido de los amplificadores esta semana por entrada: %s",
+		"weekly_summary_idle": "Los amplificadores no se encendieron esta semana.",
+		"source_playing":      "el reproductor empezó",
+		"weekly_energy":       "Unos %.1f kWh.",
+		"dash_pause":          "Pausar 1 h",
+		"dash_resume":         "Reanudar",
+		"dash_recent":         "Recientemente",
+		"dash_party_until":    "modo fiesta hasta %s",
+		"dash_paused_until":   "en pausa hasta %s",
+		"dash_last_switched":  "último cambio %s",
+		"dash_amp_on":         "encendido",
+		"dash_amp_off":        "apagado",
+		"dash_amp_unknown":    "desconocido",
+		"dash_overridden":     "anulado",
+		"dash_zone":           "zona %s",
+		"hue_music":           "Música",
+	},
+	"fr": {
+		"title":               "sonden",
+		"unhealthy":           "%s ne fonctionne pas : %s",
+		"recovered":           "%s fonctionne à nouveau",
+		"long_play":           "Les amplis sont allumés depuis longtemps.",
+		"amps_on":             "Amplis allumés (%s).",
+		"amps_off":            "Amplis éteints (%s).",
+		"threshold_exceeded":  "la musique a commencé",
+		"below_threshold":     "la musique s'est arrêtée",
+		"idle_timeout":        "silence prolongé",
+		"prewarm":             "préchauffage programmé",
+		"schedule_block":      "heures calmes",
+		"override_active":     "changé à la main",
+		"paused":              "automatisme en pause",
+		"manual":              "demandé",
+		"power_budget":        "budget de puissance",
+		"party":               "mode fête",
+		"cooldown":            "trop tôt après le dernier changement",
+		"group":               "groupe multiroom",
+		"simple_on":           "ALLUMÉ",
+		"simple_off":          "ÉTEINT",
+		"simple_playing":      "Musique en cours",
+		"simple_silent":       "Silence",
+		"simple_turn_on":      "Allumer",
+		"simple_turn_off":     "Éteindre",
+		"public_since":        "depuis",
+		"weekly_summary":      "Durée d'allumage des amplis cette semaine par entrée : %s",
+		"weekly_summary_idle": "Les amplis n'ont pas été allumés cette semaine.",
+		"source_playing":      "le lecteur a démarré",
+		"weekly_energy":       "Environ %.1f kWh.",
+		"dash_pause":          "Pause 1 h",
+		"dash_resume":         "Reprendre",
+		"dash_recent":         "Récemment",
+		"dash_party_until":    "mode fête jusqu'à %s",
+		"dash_paused_until":   "en pause jusqu'à %s",
+		"dash_last_switched":  "dernier changement %s",
+		"dash_amp_on":         "allumé",
+		"dash_amp_off":        "éteint",
+		"dash_amp_unknown":    "inconnu",
+		"dash_overridden":     "forcé",
+		"dash_zone":           "zone %s",
+		"hue_music":           "Musique",
+	},
+}
+
+func locales() []string {
+	var ls []string
+	for l := range messages {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	return ls
+}
+
+// locale is the language in use, from -locale or the config file.
+var locale = "en"
+
+func setLocale(l string) error {
+	if _, ok := messages[l]; !ok {
+		return fmt.Errorf("unsupported locale %q; have %s", l, strings.Join(locales(), ", "))
+	}
+	locale = l
+	return nil
+}
+
+// tr returns the message for key in the current locale, formatted
+// with args. It falls back to English, then to the key itself.
+func tr(key string, args ...interface{}) string {
+	s, ok := messages[locale][key]
+	if !ok {
+		if s, ok = messages["en"][key]; !ok {
+			s = key
+		}
+	}
+	if len(args) == 0 {
+		return s
+	}
+	return fmt.Sprintf(s, args...)
+}
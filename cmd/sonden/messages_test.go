@@ -0,0 +1,26 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMessagesComplete(t *testing.T) {
+	reasons := []string{
+		reasonThresholdExceeded, reasonBelowThreshold, reasonSourcePlaying,
+		reasonIdleTimeout, reasonPrewarm, reasonScheduleBlock, reasonOverrideActive,
+		reasonPaused, reasonManual, reasonParty, reasonPowerBudget, reasonCooldown, reasonGroup,
+	}
+	for _, r := range reasons {
+		if _, ok := messages["en"][r]; !ok {
+			t.Errorf("no message for reason %q", r)
+		}
+	}
+	for l, msgs := range messages {
+		for k := range messages["en"] {
+			if _, ok := msgs[k]; !ok {
+				t.Errorf("locale %s: no message %q", l, k)
+			}
+		}
+	}
+}
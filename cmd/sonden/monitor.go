@@ -0,0 +1,1186 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+	"github.com/bradfitz/sonden/capture"
+	"github.com/bradfitz/sonden/detect"
+)
+
+// A monitor listens to one audio input and turns its amps on and off.
+type monitor struct {
+	name         string // empty for the single flag-configured monitor
+	alsaDev      string
+	input        string // if non-empty, a file (or "-" for stdin) to read instead of recording
+	realtime     bool   // read input at the recording rate, not as fast as possible
+	prewarm      []weeklyTime
+	prewarmLead  time.Duration
+	prewarmGrace time.Duration
+	quietHours   []dailyRange
+	quietForce   bool // force amps off during quiet hours, not just block turning on
+	profiles     []scheduledProfile
+	adaptive     []adaptiveIdleStep // by After
+	longPlay     time.Duration
+	analysis     []detect.StageConfig // or nil for detect.DefaultChain
+	sources      map[string]activitySource
+	on, off      *boolExpr // rules over audio and sources; nil on means audio alone
+	usesAudio    bool      // whether to capture audio
+	probe        string    // if non-empty, the probe that captures it instead
+	amps         []*managedAmp
+	sequence     bool // switch amps one at a time; see sequenceAmps
+	scenes       []scene
+
+	// For replays: decide, if non-nil, is called instead of changing
+	// any amps. Replays also set det.Clock to simulate time.
+	decide func(state bool, reason string)
+
+	lastPrewarm time.Time        // owned by the run goroutine
+	lastProfile string           // owned by the run goroutine
+	session     time.Time        // owned by the run goroutine; when the listening session started, if one's on
+	adapted     adaptiveIdleStep // owned by the run goroutine; the adaptive idle step in effect, if any
+	suppressed  string           // owned by the run goroutine; reason switching the amps is blocked
+	onSince     time.Time        // owned by the run goroutine; when amps were last turned on
+	longPlayed  bool             // owned by the run goroutine; sent long_play since onSince
+	learn       *learner         // owned by the run goroutine; non-nil while learning the threshold
+	gain        *gainControl     // owned by the run goroutine; nil if not managed
+
+	conf   monitorConfig      // as last applied, by the run goroutine; see reconfigure
+	fixed  []byte             // conf's parts that can't change while running; see fixedConfig
+	reconf chan monitorConfig // new config for the run goroutine
+
+	mu          sync.Mutex // guards the following
+	det         detect.Detector
+	pausedUntil time.Time
+	party       bool            // while paused, hold the amps on
+	groups      map[string]bool // multiroom groups holding the amps on; see group.go
+	released    string          // the group that last let go, until the run goroutine acts
+	minOn       time.Duration   // see -min-on
+	minOff      time.Duration   // see -min-off
+	profileDefs map[string]*profileConfig
+	pinned      string // profile selected by hand, overriding the schedule; see setProfile
+	threshold   float64
+	idle        time.Duration
+	window      int  // samples per window, for detect.DefaultChain
+	hop         int  // samples per hop, for detect.DefaultChain
+	chainGen    int  // incremented when the analysis chain needs rebuilding
+	seq         int  // incremented by each sequenceAmps, to stop older ones
+	seqRunning  bool // the latest sequence is still switching amps
+	seqState    bool // to this state
+
+	lastTransition time.Time       // when amps were last turned on or off
+	lastState      bool            // which, at lastTransition
+	why            decision        // set by act just before setAmps
+	sourcePlaying  map[string]bool // what each source last said
+	inputHealth    inputHealth     // what the samples say about the input
+	levels         levelRing       // recent window levels, for /levels
+
+	sourceChanged chan struct{}     // poked when a source changes
+	probeLevels   chan []probeLevel // from the probe, if any
+}
+
+const maxCaptureBackoff = time.Minute
+
+// A scheduledProfile is a profile in effect during some hours.
+type scheduledProfile struct {
+	name      string
+	hours     []dailyRange
+	threshold float64
+	idle      time.Duration
+}
+
+// params returns the threshold and idle timeout in effect at t, and
+// the name of the profile, selected by hand or scheduled, that set
+// them, if any.
+func (m *monitor) params(t time.Time) (threshold float64, idle time.Duration, profile string) {
+	m.mu.Lock()
+	threshold, idle = m.threshold, m.idle
+	pc, pinned := m.profileDefs[m.pinned], m.pinned
+	m.mu.Unlock()
+	if pc != nil {
+		if pc.Threshold != 0 {
+			threshold = pc.Threshold
+		}
+		if pc.Idle != 0 {
+			idle = time.Duration(pc.Idle)
+		}
+		return threshold, idle, pinned
+	}
+	for _, p := range m.profiles {
+		if !inRanges(p.hours, t) {
+			continue
+		}
+		if p.threshold != 0 {
+			threshold = p.threshold
+		}
+		if p.idle != 0 {
+			idle = p.idle
+		}
+		return threshold, idle, p.name
+	}
+	return threshold, idle, ""
+}
+
+func newMonitor(mc *monitorConfig) (*monitor, error) {
+	m := &monitor{
+		name:      mc.Name,
+		alsaDev:   mc.AlsaDev,
+		input:     mc.Input,
+		realtime:  mc.Realtime == nil || *mc.Realtime,
+		threshold: mc.Threshold,
+		idle:      time.Duration(mc.Idle),
+		minOn:     time.Duration(mc.MinOn),
+		minOff:    time.Duration(mc.MinOff),
+		sequence:  mc.Sequence,
+		window:    samplesIn(time.Duration(mc.Window)),
+		hop:       samplesIn(time.Duration(mc.Hop)),
+		conf:      *mc,
+		fixed:     fixedConfig(*mc),
+		reconf:    make(chan monitorConfig, 1),
+	}
+	if m.window < 1 || m.hop < 1 {
+		return nil, fmt.Errorf("window and hop must be at least one sample")
+	}
+	if err := m.setSources(mc); err != nil {
+		return nil, err
+	}
+	if mc.AutoThreshold {
+		if ms := loadState(m.name); ms != nil && ms.Threshold > 0 {
+			m.threshold = ms.Threshold
+		} else {
+			m.learn = new(learner)
+		}
+	}
+	m.det.Playing = time.Duration(mc.Playing)
+	if ms := loadState(m.name); ms != nil && ms.Tuned != nil {
+		t := ms.Tuned.tuning()
+		if t.threshold != 0 {
+			m.learn = nil
+		}
+		if err := m.tune(t); err != nil {
+			m.logf(levelWarn, "ignoring kept tuning: %v", err)
+		}
+	}
+	for i, sc := range mc.Scenes {
+		s, err := newScene(sc)
+		if err != nil {
+			return nil, fmt.Errorf("scene %d: %v", i, err)
+		}
+		m.scenes = append(m.scenes, s)
+	}
+	if mc.Probe != "" {
+		m.probe = mc.Probe
+		m.probeLevels = make(chan []probeLevel, 16)
+	}
+	if mc.Gain != nil && m.input == "" && m.probe == "" {
+		g, err := newGainControl(m.alsaDev, mc.Gain)
+		if err != nil {
+			return nil, err
+		}
+		m.gain = g
+	}
+	m.det.Attack = mc.FastAttack
+	for _, sc := range mc.Analysis {
+		m.analysis = append(m.analysis, detect.StageConfig(sc))
+	}
+	if _, err := m.newChain(); err != nil {
+		return nil, err
+	}
+	if err := m.setSchedule(mc); err != nil {
+		return nil, err
+	}
+	var err error
+	for _, ac := range mc.Amps {
+		var b amp.Backend
+		switch ac.Type {
+		case "", "denon":
+			if ac.Zone < 1 || ac.Zone > 3 {
+				return nil, fmt.Errorf("amp %s: zone must be 1, 2 or 3", ac.Addr)
+			}
+			b = amp.NewDenon(ac.Addr, ac.Zone)
+		case "gpio":
+			ac.Zone = 1
+			if *dryRun {
+				// Leave the pin alone; it's never written.
+				b = &amp.GPIO{Pin: ac.Pin}
+			} else if b, err = amp.NewGPIO(ac.Pin, ac.ActiveLow); err != nil {
+				return nil, err
+			}
+		case "usbrelay":
+			ac.Zone = 1
+			if ac.Relay == 0 {
+				ac.Relay = 1
+			}
+			if b, err = amp.NewUSBRelay(ac.Device, ac.Relay, ac.Kind); err != nil {
+				return nil, err
+			}
+		case "serial":
+			ac.Zone = 1
+			if ac.Baud == 0 {
+				ac.Baud = 9600
+			}
+			cmds := amp.DenonSerial
+			if c := ac.Commands; c != nil {
+				cmds = amp.SerialCommands{On: c.On, Off: c.Off, EOL: c.EOL, Status: c.Status, OnReply: c.OnReply, OffReply: c.OffReply}
+			}
+			b = amp.NewSerial(ac.Device, ac.Baud, cmds)
+		case "ir":
+			ac.Zone = 1
+			blaster, err := newBlaster(ac.Blaster)
+			if err != nil {
+				return nil, err
+			}
+			if ac.OnCode == "" {
+				return nil, fmt.Errorf("ir amp needs on_code")
+			}
+			if ac.Path == "" {
+				ac.Path = blaster.Addr() // its amps take turns
+			}
+			b = amp.NewIR(blaster, ac.Name, ac.OnCode, ac.OffCode)
+		case "sonos":
+			ac.Zone = 1
+			if ac.Addr == "" || ac.Group == "" {
+				return nil, fmt.Errorf("sonos amp needs addr and group")
+			}
+			b = amp.NewSonos(ac.Addr, ac.Group)
+		case "heos":
+			if ac.Zone < 1 || ac.Zone > 3 {
+				return nil, fmt.Errorf("amp %s: zone must be 1, 2 or 3", ac.Addr)
+			}
+			host := ac.Addr
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			b = amp.NewHEOS(host, ac.Zone)
+		case "plug":
+			ac.Zone = 1
+			if b, err = amp.NewSmartPlug(ac.Kind, ac.Addr); err != nil {
+				return nil, err
+			}
+		case "matter":
+			ac.Zone = 1
+			if ac.Node == 0 {
+				return nil, fmt.Errorf("matter amp needs node")
+			}
+			b = amp.NewMatter(*chipTool, ac.Device, ac.Node, ac.Endpoint)
+		case "zigbee2mqtt":
+			ac.Zone = 1
+			if ac.Addr == "" || ac.Name == "" {
+				return nil, fmt.Errorf("zigbee2mqtt amp needs addr and name")
+			}
+			b = amp.NewZigbee2MQTT(ac.Addr, ac.User, ac.Password, ac.BaseTopic, ac.Name)
+		case "modbus":
+			ac.Zone = 1
+			if ac.Unit == 0 {
+				ac.Unit = 1
+			}
+			if ac.Unit > 247 || ac.Coil < 0 || ac.Coil > 0xffff {
+				return nil, fmt.Errorf("modbus amp: bad unit or coil")
+			}
+			switch {
+			case ac.Addr != "":
+				b = amp.NewModbusTCP(ac.Addr, byte(ac.Unit), uint16(ac.Coil))
+			case ac.Device != "":
+				if ac.Baud == 0 {
+					ac.Baud = 9600
+				}
+				b = amp.NewModbusRTU(ac.Device, ac.Baud, byte(ac.Unit), uint16(ac.Coil))
+			default:
+				return nil, fmt.Errorf("modbus amp needs addr or device")
+			}
+		case "pdu":
+			ac.Zone = 1
+			if ac.Addr == "" || ac.Outlet < 1 {
+				return nil, fmt.Errorf("pdu amp needs addr and outlet")
+			}
+			if ac.Kind == "" {
+				ac.Kind = "apc"
+			}
+			if ac.Community == "" {
+				ac.Community = "private"
+			}
+			if b, err = amp.NewPDU(ac.Kind, ac.Addr, ac.Community, ac.Outlet); err != nil {
+				return nil, err
+			}
+		case "pc":
+			ac.Zone = 1
+			if ac.Addr == "" || ac.MAC == "" {
+				return nil, fmt.Errorf("pc amp needs addr and mac")
+			}
+			if b, err = amp.NewPC(ac.Addr, ac.User, ac.MAC, ac.Broadcast, ac.SSHCommand); err != nil {
+				return nil, fmt.Errorf("pc amp %s: %v", ac.Addr, err)
+			}
+		default:
+			return nil, fmt.Errorf("amp %s: unknown type %q", ac.Addr, ac.Type)
+		}
+		path := ac.Path
+		if path == "" {
+			path = b.Addr()
+		}
+		a := newManagedAmp(b, ac.Zone)
+		a.heos, _ = b.(*amp.HEOS)
+		a.denon, _ = b.(*amp.Denon)
+		a.path = amp.SharedPath(path)
+		a.priority = ac.Priority
+		a.watts = ac.Watts
+		a.standby = ac.StandbyWatts
+		a.delay = time.Duration(ac.Delay)
+		for _, cmds := range [][]string{ac.OnCommands, ac.OffCommands} {
+			for _, cmd := range cmds {
+				if _, isWait, err := parseWait(cmd); isWait && err != nil {
+					return nil, fmt.Errorf("amp %s: %v", a.name(), err)
+				}
+			}
+		}
+		a.onCmds, a.offCmds = ac.OnCommands, ac.OffCommands
+		if ac.Attempts != 0 {
+			a.attempts = ac.Attempts
+		}
+		if ac.Backoff != 0 {
+			a.backoff = time.Duration(ac.Backoff)
+		}
+		if len(ac.ManageInputs) > 0 && !reportsInput(ac.Type) {
+			return nil, fmt.Errorf("amp %s: a %s amp can't say which input it's on, for manage_inputs", a.name(), ac.Type)
+		}
+		a.inputs = ac.ManageInputs
+		if ac.Plug != nil {
+			var err error
+			if a.plug, err = newPlug(ac.Plug); err != nil {
+				return nil, fmt.Errorf("amp %s: %v", a.name(), err)
+			}
+		}
+		if ms := loadState(m.name); ms != nil {
+			mu.Lock()
+			if p := ms.Amps[a.name()]; p != nil {
+				ampMeasured[a] = p
+			}
+			keptOff[a] = time.Duration(ms.KeptOffHours[a.name()] * float64(time.Hour))
+			mu.Unlock()
+		}
+		m.amps = append(m.amps, a)
+	}
+	return m, nil
+}
+
+// setSchedule sets m's parameters that depend on the time from mc:
+// pre-warming, quiet hours, long play, scheduled profiles and adaptive
+// idle. It's called by newMonitor, and then only by the run goroutine.
+func (m *monitor) setSchedule(mc *monitorConfig) error {
+	m.prewarmLead = time.Duration(mc.PrewarmLead)
+	m.prewarmGrace = time.Duration(mc.PrewarmGrace)
+	m.longPlay = time.Duration(mc.LongPlay)
+	m.quietForce = false
+	m.profiles = nil
+	m.mu.Lock()
+	m.profileDefs = mc.Profiles
+	m.mu.Unlock()
+	var err error
+	if m.prewarm, err = parseWeeklyTimes(mc.Prewarm); err != nil {
+		return fmt.Errorf("bad prewarm: %v", err)
+	}
+	if m.quietHours, err = parseDailyRanges(mc.QuietHours); err != nil {
+		return fmt.Errorf("bad quiet_hours: %v", err)
+	}
+	switch mc.QuietMode {
+	case "block":
+	case "off":
+		m.quietForce = true
+	default:
+		return fmt.Errorf("bad quiet_mode %q; want \"block\" or \"off\"", mc.QuietMode)
+	}
+	for i, se := range mc.Schedule {
+		pc, ok := mc.Profiles[se.Profile]
+		if !ok {
+			return fmt.Errorf("schedule entry %d: no profile %q", i, se.Profile)
+		}
+		hours, err := parseDailyRanges(se.Hours)
+		if err != nil {
+			return fmt.Errorf("schedule entry %d: %v", i, err)
+		}
+		m.profiles = append(m.profiles, scheduledProfile{
+			name:      se.Profile,
+			hours:     hours,
+			threshold: pc.Threshold,
+			idle:      time.Duration(pc.Idle),
+		})
+	}
+	m.adaptive = nil
+	for i, st := range mc.AdaptiveIdle {
+		if st.After < 0 || st.Idle <= 0 {
+			return fmt.Errorf("adaptive_idle step %d: after must not be negative, and idle must be positive", i)
+		}
+		m.adaptive = append(m.adaptive, *st)
+	}
+	sort.Slice(m.adaptive, func(i, j int) bool { return m.adaptive[i].After < m.adaptive[j].After })
+	return nil
+}
+
+func (m *monitor) logf(lvl logLevel, format string, args ...interface{}) {
+	if m.name != "" {
+		format = "[" + m.name + "] " + format
+	}
+	logf(lvl, format, args...)
+}
+
+func (m *monitor) publish(ev event) {
+	ev.Monitor = m.name
+	publish(ev)
+}
+
+// budgetWatts is the most watts of amps, those of all monitors
+// together, to have on at once; 0 for no limit. It's guarded by mu.
+var budgetWatts float64
+
+func setPowerBudget(watts float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	budgetWatts = watts
+}
+
+// ampsWithinBudget returns the highest-priority subset of m's amps
+// that may be on at once without all monitors' amps exceeding the
+// power budget. Amps have priority in the order of their monitors,
+// then in the order they're listed in their monitor. Other monitors'
+// amps that are on, or on their way, count against the budget too,
+// and any on that no longer fit, for amps of higher priority, are
+// turned off. Overridden amps that are on count against the budget but
+// are never dropped.
+func (m *monitor) ampsWithinBudget() []*managedAmp {
+	mu.Lock()
+	budget := budgetWatts
+	if budget <= 0 {
+		mu.Unlock()
+		return m.amps
+	}
+	now := time.Now()
+	used := 0.0
+	for _, om := range monitors {
+		for _, amp := range om.amps {
+			if ampState[amp] && now.Before(ampOverride[amp]) {
+				used += amp.onWattsLocked()
+			}
+		}
+	}
+	var ok, drop []*managedAmp
+	for _, om := range monitors {
+		for _, amp := range om.amps {
+			on := ampState[amp]
+			if want, busy := ampWant[amp]; busy {
+				on = want
+			}
+			if now.Before(ampOverride[amp]) || om != m && !on {
+				continue
+			}
+			watts := amp.onWattsLocked()
+			fits := used+watts <= budget
+			if fits && overBudget[amp] {
+				om.logf(levelInfo, "Amp %s now fits in the %vW power budget", amp.Addr(), budget)
+			} else if !fits && !overBudget[amp] {
+				om.logf(levelWarn, "Keeping amp %s off: its %vW would exceed the %vW power budget (%vW in use)", amp.Addr(), watts, budget, used)
+				om.publish(event{Type: "over_budget", Reason: reasonPowerBudget, Amp: amp.Addr()})
+			}
+			overBudget[amp] = !fits
+			switch {
+			case fits:
+				used += watts
+				if om == m {
+					ok = append(ok, amp)
+				}
+			case on:
+				drop = append(drop, amp)
+			}
+		}
+	}
+	mu.Unlock()
+	for _, amp := range drop {
+		requestAmpState(amp, false)
+	}
+	return ok
+}
+
+// setAmps turns m's amps on or off for the given reason code. Unless
+// it's manual, it's not done too soon after the last transition the
+// other way (see -min-on and -min-off), and reasonCooldown is returned.
+func (m *monitor) setAmps(state bool, reason string) (suppressed string) {
+	if m.decide != nil {
+		m.decide(state, reason)
+		return ""
+	}
+	m.mu.Lock()
+	inSequence := m.seqRunning && m.seqState == state
+	cooldown := m.minOff
+	if !state {
+		cooldown = m.minOn
+	}
+	cooldown -= time.Since(m.lastTransition)
+	if m.lastTransition.IsZero() || m.lastState == state || reason == reasonManual || reason == reasonParty {
+		cooldown = 0
+	}
+	m.mu.Unlock()
+	if inSequence {
+		// Already on its way.
+		return ""
+	}
+	if cooldown > 0 {
+		word := "off"
+		if state {
+			word = "on"
+		}
+		m.logf(levelDebug, "too soon after the last transition; not turning amps %s for %v", word, cooldown.Round(time.Second))
+		return reasonCooldown
+	}
+	targets := m.amps
+	if state {
+		targets = m.ampsWithinBudget()
+	}
+	allGood := true
+	for _, amp := range targets {
+		if overridden(amp) || (!state && !onManagedInput(amp)) {
+			continue
+		}
+		cur, known := getAmpState(amp)
+		if want, busy := wantedAmpState(amp); busy {
+			cur, known = want, true
+		}
+		if !known || cur != state {
+			allGood = false
+			break
+		}
+	}
+	if allGood {
+		// All amps in the correct state; no need to log spam.
+		return ""
+	}
+	m.mu.Lock()
+	m.lastTransition, m.lastState = time.Now(), state
+	why := m.why
+	m.why = decision{}
+	m.mu.Unlock()
+	t := transition{Time: m.lastTransition, Monitor: m.name, State: powerString(state), Reason: reason, Rule: reason}
+	if reason == reasonManual {
+		t.Rule = "forced via the API"
+	}
+	if why.reason == reason {
+		t.Rule, t.Level, t.Threshold = why.rule, why.level, why.threshold
+	}
+	recordTransition(t)
+	if state {
+		m.logf(levelInfo, "turning amps ON (%s)", reason)
+		m.publish(event{Type: "amps_on", Reason: reason})
+	} else {
+		m.logf(levelInfo, "turning amps OFF (%s)", reason)
+		m.publish(event{Type: "amps_off", Reason: reason})
+	}
+	if m.sequence {
+		m.mu.Lock()
+		m.seq++
+		seq := m.seq
+		m.seqRunning, m.seqState = true, state
+		m.mu.Unlock()
+		go m.sequenceAmps(targets, state, seq)
+		return ""
+	}
+	for _, amp := range targets {
+		requestAmpState(amp, state)
+	}
+	return ""
+}
+
+// sequenceAmps switches amps to state one at a time, in order to turn
+// them on and in reverse to turn them off, waiting for each to finish
+// and then for the delay between it and the next. It stops when a
+// newer sequence starts.
+func (m *monitor) sequenceAmps(amps []*managedAmp, state bool, seq int) {
+	superseded := func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.seq != seq
+	}
+	defer func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.seq == seq {
+			m.seqRunning = false
+		}
+	}()
+	order := append([]*managedAmp(nil), amps...)
+	if !state {
+		for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	for i, a := range order {
+		if i > 0 {
+			// The delay is the later amp's, either way.
+			d := a.delay
+			if !state {
+				d = order[i-1].delay
+			}
+			time.Sleep(d)
+		}
+		if superseded() {
+			return
+		}
+		requestAmpState(a, state)
+		for {
+			if _, busy := wantedAmpState(a); !busy {
+				break
+			}
+			if superseded() {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// checkLongPlay sends a long_play event if m's amps have been on for
+// longer than its long_play setting.
+func (m *monitor) checkLongPlay(now time.Time) {
+	if m.longPlay <= 0 {
+		return
+	}
+	on := false
+	for _, amp := range m.amps {
+		if s, _ := getAmpState(amp); s {
+			on = true
+		}
+	}
+	if !on {
+		m.onSince, m.longPlayed = time.Time{}, false
+		return
+	}
+	if m.onSince.IsZero() {
+		m.onSince = now
+	}
+	if !m.longPlayed && now.Sub(m.onSince) > m.longPlay {
+		m.logf(levelWarn, "amps have been on for %v", now.Sub(m.onSince).Truncate(time.Minute))
+		m.publish(event{Type: "long_play"})
+		m.longPlayed = true
+	}
+}
+
+// trackSession starts a listening session when music starts, if one
+// isn't on, and ends it when the amps go idle.
+func (m *monitor) trackSession(res detect.Result, playing bool) {
+	if playing && m.session.IsZero() {
+		m.session = res.StartedAt
+	}
+	if res.Idle && !m.session.IsZero() {
+		m.session, m.adapted = time.Time{}, adaptiveIdleStep{}
+	}
+}
+
+// adaptiveIdle returns the adaptive idle step for the listening
+// session so far, if any, logging when it changes.
+func (m *monitor) adaptiveIdle() (st adaptiveIdleStep, ok bool) {
+	if m.session.IsZero() {
+		return st, false
+	}
+	m.mu.Lock()
+	length := m.det.LastPlaying().Sub(m.session)
+	m.mu.Unlock()
+	for _, s := range m.adaptive {
+		if time.Duration(s.After) <= length {
+			st, ok = s, true
+		}
+	}
+	if st != m.adapted {
+		if ok {
+			m.logf(levelInfo, "listening for %v; idle now %v (adaptive)", length.Round(time.Second), time.Duration(st.Idle))
+		}
+		m.adapted = st
+	}
+	return st, ok
+}
+
+// forceAmps turns m's amps on or off now, on behalf of a human,
+// cancelling any manual overrides. Turning them on restarts the idle
+// timer.
+func (m *monitor) forceAmps(state bool) {
+	for _, amp := range m.amps {
+		clearOverride(amp)
+	}
+	if state {
+		m.mu.Lock()
+		m.det.Touch(time.Now())
+		m.mu.Unlock()
+	}
+	m.setAmps(state, reasonManual)
+}
+
+// pause suspends automatic control of m's amps for d. A d of zero
+// resumes it.
+func (m *monitor) pause(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pausedUntil, m.party = time.Time{}, false
+	if d > 0 {
+		m.pausedUntil = time.Now().Add(d)
+		m.logf(levelInfo, "pausing automatic control for %v", d)
+	} else {
+		m.logf(levelInfo, "resuming automatic control")
+	}
+}
+
+// setProfile selects the named profile until it's called again, whatever
+// the schedule says; "" goes back to the schedule.
+func (m *monitor) setProfile(name string) error {
+	if err := m.checkProfile(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned = name
+	if name == "" {
+		m.logf(levelInfo, "profile back to the schedule")
+	} else {
+		m.logf(levelInfo, "profile %q selected by hand", name)
+	}
+	return nil
+}
+
+// checkProfile returns an error if m has no profile name. The empty
+// name, for the schedule, is fine.
+func (m *monitor) checkProfile(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name != "" && m.profileDefs[name] == nil {
+		return fmt.Errorf("no profile %q", name)
+	}
+	return nil
+}
+
+// holdOn turns m's amps on and keeps them on, whatever the detector
+// says, for d: party mode. Then automatic control resumes.
+func (m *monitor) holdOn(d time.Duration) {
+	m.mu.Lock()
+	m.pausedUntil, m.party = time.Now().Add(d), true
+	m.det.Touch(time.Now())
+	m.mu.Unlock()
+	m.logf(levelInfo, "party mode: holding amps on for %v", d)
+	for _, amp := range m.amps {
+		clearOverride(amp)
+	}
+	m.setAmps(true, reasonParty)
+}
+
+// run captures audio and watches its activity sources, as its rules
+// need, and manages m's amps forever, or until the end of its input
+// file.
+func (m *monitor) run() {
+	m.startScenes()
+	for name := range m.sources {
+		go m.keep("source", sourceSubsystem(name), m.watchSource(name))
+	}
+	if m.usesAudio && m.probe != "" {
+		m.keep("probe", "probe", m.listenProbe)
+	} else if m.usesAudio {
+		m.keep("capture", "capture", m.listen)
+	} else {
+		m.watchSources()
+	}
+}
+
+// keep runs listen, what of m's inputs, until it reaches the end of
+// its input. If it fails it's restarted with backoff, leaving the amps
+// as they are meanwhile. Its health is reported as subsystem name.
+func (m *monitor) keep(what, name string, listen func() error) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := listen()
+		if err == io.EOF {
+			m.logf(levelInfo, "end of input %s", m.input)
+			return
+		}
+		setHealth(m.subsystem(name), err)
+		m.publish(event{Type: what + "_failed", Subsystem: m.subsystem(name), Error: err.Error()})
+		if time.Since(start) > maxCaptureBackoff {
+			backoff = time.Second
+		}
+		m.logf(levelError, "%s failed: %v; restarting in %v", name, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxCaptureBackoff {
+			backoff = maxCaptureBackoff
+		}
+	}
+}
+
+// subsystem returns the health subsystem name for m's part named
+// name.
+func (m *monitor) subsystem(name string) string {
+	if m.name != "" {
+		return name + "/" + m.name
+	}
+	return name
+}
+
+// newChain returns a new analysis chain for m's input.
+func (m *monitor) newChain() (detect.Chain, error) {
+	if m.analysis == nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return detect.DefaultChain(m.window, m.hop), nil
+	}
+	return detect.NewChain(m.analysis, capture.SampleHz)
+}
+
+// A tuning is a change to a monitor's detection parameters. Zero
+// fields are left alone.
+type tuning struct {
+	threshold     float64
+	idle, playing time.Duration
+	window, hop   time.Duration
+}
+
+// tune changes m's detection parameters while it runs. The detector
+// keeps its state, and the analysis window keeps what of its history
+// still applies, so tuning doesn't look like the music stopped.
+func (m *monitor) tune(t tuning) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	window, hop, err := m.tunedWindow(t)
+	if err != nil {
+		return err
+	}
+	if window != m.window || hop != m.hop {
+		m.window, m.hop = window, hop
+		m.chainGen++
+	}
+	if t.threshold != 0 {
+		m.threshold = t.threshold
+	}
+	if t.idle != 0 {
+		m.idle = t.idle
+	}
+	if t.playing != 0 {
+		m.det.Playing = t.playing
+	}
+	m.logf(levelInfo, "tuned: threshold %v, idle %v, playing %v, window %v, hop %v", m.threshold, m.idle, m.det.Playing,
+		samplesDuration(m.window), samplesDuration(m.hop))
+	return nil
+}
+
+// checkTuning returns the error tune would for t, without tuning.
+func (m *monitor) checkTuning(t tuning) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, _, err := m.tunedWindow(t)
+	return err
+}
+
+// tunedWindow returns m's window and hop as tuned by t, in samples, or
+// an error if t is no good. m.mu must be held.
+func (m *monitor) tunedWindow(t tuning) (window, hop int, err error) {
+	window, hop = m.window, m.hop
+	if t.window != 0 || t.hop != 0 {
+		if m.analysis != nil {
+			return 0, 0, fmt.Errorf("window and hop don't apply to a configured analysis chain")
+		}
+		if t.window != 0 {
+			if hop == window {
+				hop = samplesIn(t.window)
+			}
+			window = samplesIn(t.window)
+		}
+		if t.hop != 0 {
+			hop = samplesIn(t.hop)
+		}
+		if window < 1 || hop < 1 {
+			return 0, 0, fmt.Errorf("window and hop must be at least one sample")
+		}
+	}
+	if t.threshold < 0 || t.idle < 0 || t.playing < 0 {
+		return 0, 0, fmt.Errorf("negative parameter")
+	}
+	return window, hop, nil
+}
+
+// keepTuning remembers t's parameters in the -state file, so they
+// outlive a restart, or with keep false forgets them, so the config's
+// apply again.
+func (m *monitor) keepTuning(t tuning, keep bool) {
+	if ms := loadState(m.name); !keep && (ms == nil || ms.Tuned == nil) {
+		return
+	}
+	updateState(m.name, func(ms *monitorState) {
+		var ts tunedState
+		if ms.Tuned != nil {
+			ts = *ms.Tuned
+		}
+		if t.threshold != 0 {
+			ts.Threshold = 0
+			if keep {
+				ts.Threshold = t.threshold
+			}
+		}
+		for _, p := range []struct {
+			v  time.Duration
+			ts *duration
+		}{{t.idle, &ts.Idle}, {t.playing, &ts.Playing}, {t.window, &ts.Window}, {t.hop, &ts.Hop}} {
+			if p.v != 0 {
+				*p.ts = 0
+				if keep {
+					*p.ts = duration(p.v)
+				}
+			}
+		}
+		if ms.Tuned = &ts; ts == (tunedState{}) {
+			ms.Tuned = nil
+		}
+	})
+}
+
+func (m *monitor) chainGeneration() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chainGen
+}
+
+// samplesIn returns how many samples are captured in d.
+func samplesIn(d time.Duration) int {
+	return int(d * capture.SampleHz / time.Second)
+}
+
+// samplesDuration returns how long it takes to capture n samples, to
+// the millisecond.
+func samplesDuration(n int) time.Duration {
+	return (time.Duration(n) * time.Second / capture.SampleHz).Round(time.Millisecond)
+}
+
+// sampleChunk is how many samples listen reads at a time.
+const sampleChunk = 4 << 10
+
+// listen captures audio and manages m's amps until capture fails.
+func (m *monitor) listen() error {
+	var (
+		out io.ReadCloser
+		err error
+	)
+	if m.input != "" {
+		out, err = capture.Open(m.input, m.realtime)
+	} else {
+		out, err = capture.Start(m.alsaDev)
+	}
+	if err != nil {
+		return fmt.Errorf("starting capture: %v", err)
+	}
+	out = chaosCapture(out)
+	defer out.Close()
+	setHealth(m.subsystem("capture"), nil)
+	m.captureStarted(time.Now())
+	m.startGain()
+
+	var (
+		clock   = capture.Clock{Rate: capture.SampleHz}
+		windows int
+		end     time.Time
+	)
+	gen := m.chainGeneration()
+	chain, err := m.newChain()
+	if err != nil {
+		return err
+	}
+	if m.input != "" && !m.realtime {
+		// Time passes as fast as we read.
+		clock.Free = true
+		m.mu.Lock()
+		m.det.Clock = detect.ClockFunc(func() time.Time { return end })
+		m.mu.Unlock()
+	}
+	sr := capture.NewSampleReader(out)
+	samples := make([]int16, sampleChunk)
+	for {
+		n, err := sr.Read(samples)
+		if m.input != "" && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("reading samples: %v", err)
+		}
+		if err := m.checkSamples(samples[:n], time.Now()); err != nil {
+			return err
+		}
+		if g := m.chainGeneration(); g != gen {
+			nc, err := m.newChain()
+			if err != nil {
+				return err
+			}
+			kept := nc.Migrate(chain)
+			m.logf(levelInfo, "analysis changed; kept the state of %d of %d stages", kept, len(nc))
+			chain, gen = nc, g
+		}
+		for _, sample := range samples[:n] {
+			clock.Add(1)
+			level, ok := chain.Process(float64(sample))
+			if !ok {
+				continue
+			}
+			if windows++; windows%getAnalysisStride() != 0 {
+				continue
+			}
+			end = clock.Time()
+			m.handleWindow(level, end)
+		}
+	}
+}
+
+// handleWindow decides what to do after each window of audio with
+// variance v, whose last sample was captured at end.
+func (m *monitor) handleWindow(v float64, end time.Time) {
+	now, threshold, idle := m.stepParams()
+	if m.learning(v, now) {
+		threshold *= learnMargin
+	}
+	reason := reasonThresholdExceeded
+	m.mu.Lock()
+	m.det.Threshold, m.det.Idle = threshold, idle
+	var res detect.Result
+	if m.on == nil {
+		res = m.det.Window(v, end)
+	} else {
+		playing := m.inputsPlaying()
+		playing["audio"] = v > threshold
+		if res = m.judge(playing, end); res.Playing && !playing["audio"] {
+			reason = reasonSourcePlaying
+		}
+	}
+	m.levels.add(levelSample{Time: end, Level: v, Threshold: threshold, Playing: res.Playing})
+	m.mu.Unlock()
+	if !res.Playing && v <= threshold {
+		m.adjustGain(v, now)
+	}
+	m.logf(levelDebug, "level = %v; playing = %v", v, res.Playing)
+	m.publish(event{Time: end, Type: "variance", Variance: v})
+	m.act(res, v, reason, end, now)
+}
+
+// handleActivity is handleWindow for monitors without audio, which
+// judge what their sources say as of end.
+func (m *monitor) handleActivity(end time.Time) {
+	now, _, idle := m.stepParams()
+	m.mu.Lock()
+	m.det.Idle = idle
+	res := m.judge(m.inputsPlaying(), end)
+	m.mu.Unlock()
+	m.act(res, 0, reasonSourcePlaying, end, now)
+}
+
+// stepParams returns the current time and the detection parameters in
+// effect, logging any change of profile.
+func (m *monitor) stepParams() (now time.Time, threshold float64, idle time.Duration) {
+	select {
+	case mc := <-m.reconf:
+		m.reconfigure(mc)
+	default:
+	}
+	m.mu.Lock()
+	now = m.det.Now()
+	m.mu.Unlock()
+	threshold, idle, profile := m.params(now)
+	if profile != m.lastProfile {
+		if profile == "" {
+			m.logf(levelInfo, "back to default profile (threshold %v, idle %v)", threshold, idle)
+		} else {
+			m.logf(levelInfo, "switching to profile %q (threshold %v, idle %v)", profile, threshold, idle)
+		}
+		m.lastProfile = profile
+	}
+	if st, ok := m.adaptiveIdle(); ok {
+		idle = time.Duration(st.Idle)
+	}
+	return now, threshold, idle
+}
+
+// act turns m's amps on or off, or not, given what the detector made
+// of the latest window, which had level v. Music playing is put down
+// to reason.
+func (m *monitor) act(res detect.Result, v float64, reason string, end, now time.Time) {
+	audioPlaying := res.Playing
+	m.mu.Lock()
+	paused := now.Before(m.pausedUntil)
+	party, pausedUntil := paused && m.party, m.pausedUntil
+	group, released := m.groupNames(), m.released
+	m.released = ""
+	threshold, lastPlaying, playingFor, idle := m.det.Threshold, m.det.LastPlaying(), m.det.Playing, m.det.Idle
+	attack := m.det.Attack
+	resumed := !paused && !m.pausedUntil.IsZero()
+	if resumed {
+		m.pausedUntil, m.party = time.Time{}, false
+	}
+	m.mu.Unlock()
+	if resumed {
+		m.logf(levelInfo, "pause over; resuming automatic control")
+	}
+	if res.Changed {
+		// Record when the audio actually started or stopped, not
+		// when we noticed.
+		if audioPlaying {
+			m.publish(event{Time: res.StartedAt, Type: "playing", Reason: reason, Variance: v})
+		} else {
+			m.publish(event{Time: res.StoppedAt, Type: "quiet", Reason: reasonBelowThreshold, Variance: v})
+		}
+	}
+	quiet := inRanges(m.quietHours, now)
+	suppressed := ""
+	because := func(reason, format string, args ...interface{}) string {
+		m.mu.Lock()
+		m.why = decision{reason: reason, rule: fmt.Sprintf(format, args...), level: v, threshold: threshold}
+		m.mu.Unlock()
+		return reason
+	}
+	if party {
+		m.setAmps(true, because(reasonParty, "party mode until %v", pausedUntil.Format("Mon 15:04")))
+	} else if paused {
+		m.logf(levelDebug, "paused; leaving amps alone")
+		suppressed = reasonPaused
+	} else if quiet && m.quietForce {
+		suppressed = m.setAmps(false, because(reasonScheduleBlock, "quiet hours (quiet mode force)"))
+	} else if quiet && (res.TurnOn || group != "") {
+		m.logf(levelDebug, "quiet hours; not turning amps on")
+		suppressed = reasonScheduleBlock
+	} else if group != "" {
+		suppressed = m.setAmps(true, because(reasonGroup, "group %s playing", group))
+	} else if res.TurnOn {
+		rule := fmt.Sprintf("music for %v (playing %v)", end.Sub(res.StartedAt), playingFor)
+		if res.Fast {
+			m.logf(levelDebug, "level %v is over %v times the threshold; fast attack", v, attack)
+			rule = fmt.Sprintf("a window %.3g times the threshold (fast attack %v)", v/threshold, attack)
+		}
+		suppressed = m.setAmps(true, because(reason, "%s", rule))
+	} else if occ, ok := prewarmWindow(m.prewarm, now, m.prewarmLead, m.prewarmGrace); ok && !quiet {
+		if occ != m.lastPrewarm {
+			m.logf(levelInfo, "pre-warming amps for %v", occ.Format("Mon 15:04"))
+			m.lastPrewarm = occ
+		}
+		suppressed = m.setAmps(true, because(reasonPrewarm, "pre-warm for %v", occ.Format("Mon 15:04")))
+	} else if audioPlaying {
+		m.logf(levelDebug, "music for %v; not yet long enough", end.Sub(res.StartedAt))
+	} else if released != "" {
+		suppressed = m.setAmps(false, because(reasonGroup, "group %s stopped", released))
+	} else if res.Idle && m.adapted.Idle != 0 {
+		suppressed = m.setAmps(false, because(reasonIdleTimeout, "silent for %v (adaptive idle %v, after %v of listening)",
+			end.Sub(lastPlaying).Round(time.Second), idle, lastPlaying.Sub(m.session).Round(time.Second)))
+	} else if res.Idle {
+		suppressed = m.setAmps(false, because(reasonIdleTimeout, "silent for %v (idle %v)", end.Sub(lastPlaying).Round(time.Second), idle))
+	} else {
+		m.logf(levelDebug, "turning amps off in %v", res.OffIn)
+	}
+	m.trackSession(res, audioPlaying)
+	m.checkLongPlay(now)
+	if suppressed != m.suppressed {
+		if suppressed != "" {
+			m.publish(event{Type: "suppressed", Reason: suppressed})
+		}
+		m.suppressed = suppressed
+	}
+}
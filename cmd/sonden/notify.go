@@ -0,0 +1,161 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// notifierConfig configures a built-in push notification service.
+type notifierConfig struct {
+	Type string `json:"type"` // "pushover", "telegram" or "ntfy"
+
+	// Events lists the event types to notify about, as in
+	// webhookConfig. Empty means unhealthy, recovered, long_play and
+	// weekly_summary.
+	Events []string `json:"events"`
+
+	Token  string `json:"token"`   // pushover app token, or telegram bot token
+	User   string `json:"user"`    // pushover user key
+	ChatID string `json:"chat_id"` // telegram chat
+	URL    string `json:"url"`     // ntfy topic URL, e.g. https://ntfy.sh/mytopic
+}
+
+type notifier struct {
+	name   string
+	events map[string]bool
+	send   func(title, msg string) error
+}
+
+func newNotifier(nc *notifierConfig) (*notifier, error) {
+	n := &notifier{name: nc.Type, events: make(map[string]bool)}
+	events := nc.Events
+	if len(events) == 0 {
+		events = []string{"unhealthy", "recovered", "long_play", "weekly_summary"}
+	}
+	for _, e := range events {
+		n.events[e] = true
+	}
+	switch nc.Type {
+	case "pushover":
+		if nc.Token == "" || nc.User == "" {
+			return nil, fmt.Errorf("pushover notifier needs token and user")
+		}
+		n.send = func(title, msg string) error {
+			return postForm("https://api.pushover.net/1/messages.json", url.Values{
+				"token":   {nc.Token},
+				"user":    {nc.User},
+				"title":   {title},
+				"message": {msg},
+			})
+		}
+	case "telegram":
+		if nc.Token == "" || nc.ChatID == "" {
+			return nil, fmt.Errorf("telegram notifier needs token and chat_id")
+		}
+		n.send = func(title, msg string) error {
+			err := postForm("https://api.telegram.org/bot"+nc.Token+"/sendMessage", url.Values{
+				"chat_id": {nc.ChatID},
+				"text":    {title + ": " + msg},
+			})
+			if ue, ok := err.(*url.Error); ok {
+				err = ue.Err // without the URL, which has the token in it
+			}
+			return err
+		}
+	case "ntfy":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("ntfy notifier needs url")
+		}
+		n.send = func(title, msg string) error {
+			req, err := http.NewRequest("POST", nc.URL, strings.NewReader(msg))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Title", title)
+			return doRequest(req)
+		}
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", nc.Type)
+	}
+	return n, nil
+}
+
+func (n *notifier) wants(ev event) bool {
+	return n.events[ev.Type] || (ev.Error != "" && n.events["error"])
+}
+
+// start sends notifications until its subscription, which it
+// returns, is cancelled.
+func (n *notifier) start() *subscriber {
+	sub := subscribe("notifier "+n.name, webhookBuffer, dropOldest, n.wants)
+	go func() {
+		for ev := range sub.C {
+			title, msg := eventMessage(ev)
+			if err := withRetry(n.name+" notification", func() error { return n.send(title, msg) }); err != nil {
+				errorf("%s notification for %s event failed: %v", n.name, ev.Type, err)
+			}
+		}
+	}()
+	return sub
+}
+
+// eventMessage returns a human-readable title and message for ev in
+// the current locale.
+func eventMessage(ev event) (title, msg string) {
+	title = tr("title")
+	if ev.Monitor != "" {
+		title += " " + ev.Monitor
+	}
+	switch ev.Type {
+	case "unhealthy":
+		msg = tr("unhealthy", ev.Subsystem, ev.Error)
+	case "recovered":
+		msg = tr("recovered", ev.Subsystem)
+	case "long_play":
+		msg = tr("long_play")
+	case "weekly_summary":
+		if len(ev.Usage) == 0 {
+			msg = tr("weekly_summary_idle")
+		} else {
+			msg = tr("weekly_summary", formatUsage(ev.Usage))
+		}
+		if ev.Energy > 0 {
+			msg += " " + tr("weekly_energy", ev.Energy)
+		}
+	case "amps_on", "amps_off":
+		msg = tr(ev.Type, tr(ev.Reason))
+	default:
+		msg = ev.Type
+		if ev.Error != "" {
+			msg += ": " + ev.Error
+		}
+	}
+	return
+}
+
+func postForm(u string, v url.Values) error {
+	req, err := http.NewRequest("POST", u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doRequest(req)
+}
+
+func doRequest(req *http.Request) error {
+	c := &http.Client{Timeout: webhookTimeout}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+)
+
+// An energy-monitoring plug between an amp and the wall lets sonden
+// measure what the amp really draws, on and in standby, instead of
+// trusting a guessed "watts". See the "measure" command.
+
+// plugConfig configures an amp's plug, like
+// {"type": "shelly", "addr": "10.0.0.40"}.
+type plugConfig struct {
+	// Type is "shelly", for Shelly Plus and Gen2 plugs; "tasmota",
+	// for plugs running Tasmota with an energy sensor; or "kasa",
+	// for TP-Link Kasa plugs with energy monitoring (HS110, KP115).
+	Type string `json:"type"`
+	Addr string `json:"addr"`
+}
+
+// A plug reports the power drawn through it.
+type plug struct {
+	watts func() (float64, error) // right now
+}
+
+func newPlug(pc *plugConfig) (*plug, error) {
+	if pc.Addr == "" {
+		return nil, fmt.Errorf("plug needs addr")
+	}
+	switch pc.Type {
+	case "shelly":
+		return httpPlug("http://"+pc.Addr+"/rpc/Switch.GetStatus?id=0", shellyPower), nil
+	case "tasmota":
+		return httpPlug("http://"+pc.Addr+"/cm?cmnd=Status%208", tasmotaPower), nil
+	case "kasa":
+		return &plug{watts: func() (float64, error) { return kasaPower(pc.Addr) }}, nil
+	}
+	return nil, fmt.Errorf("unknown plug type %q", pc.Type)
+}
+
+var plugClient = &http.Client{Timeout: 5 * time.Second}
+
+// httpPlug returns a plug read by getting url and passing the JSON
+// reply to power.
+func httpPlug(url string, power func(body []byte) (float64, error)) *plug {
+	return &plug{watts: func() (float64, error) {
+		res, err := plugClient.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("%s: %s", url, res.Status)
+		}
+		var body json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return 0, fmt.Errorf("%s: %v", url, err)
+		}
+		return power(body)
+	}}
+}
+
+// sample reads the plug n times, every interval, and returns the
+// median, so a single odd reading doesn't count.
+func (p *plug) sample(n int, every time.Duration) (float64, error) {
+	var ws []float64
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			time.Sleep(every)
+		}
+		w, err := p.watts()
+		if err != nil {
+			return 0, err
+		}
+		ws = append(ws, w)
+	}
+	sort.Float64s(ws)
+	return ws[len(ws)/2], nil
+}
+
+func shellyPower(body []byte) (float64, error) {
+	var st struct {
+		APower *float64 `json:"apower"`
+	}
+	if err := json.Unmarshal(body, &st); err != nil || st.APower == nil {
+		return 0, fmt.Errorf("no apower in Shelly status")
+	}
+	return *st.APower, nil
+}
+
+// kasaPower asks the Kasa plug at host for its power.
+func kasaPower(host string) (float64, error) {
+	body, err := amp.KasaCall(host, []byte(`{"emeter":{"get_realtime":{}}}`))
+	if err != nil {
+		return 0, err
+	}
+	var st struct {
+		Emeter struct {
+			GetRealtime struct {
+				Power   *float64 `json:"power"`    // older firmware, in W
+				PowerMW *float64 `json:"power_mw"` // newer, in mW
+			} `json:"get_realtime"`
+		} `json:"emeter"`
+	}
+	if err := json.Unmarshal(body, &st); err != nil {
+		return 0, fmt.Errorf("kasa: %v", err)
+	}
+	rt := st.Emeter.GetRealtime
+	switch {
+	case rt.PowerMW != nil:
+		return *rt.PowerMW / 1000, nil
+	case rt.Power != nil:
+		return *rt.Power, nil
+	}
+	return 0, fmt.Errorf("no emeter power in Kasa reply; does the plug monitor energy?")
+}
+
+func tasmotaPower(body []byte) (float64, error) {
+	var st struct {
+		StatusSNS struct {
+			ENERGY struct {
+				Power *float64
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &st); err != nil || st.StatusSNS.ENERGY.Power == nil {
+		return 0, fmt.Errorf("no StatusSNS.ENERGY.Power in Tasmota status")
+	}
+	return *st.StatusSNS.ENERGY.Power, nil
+}
+
+// An ampMeter is what an amp's plug has been seen to draw since
+// startup, read at each -poll.
+type ampMeter struct {
+	last   time.Time // of the previous reading
+	lastW  float64
+	lastOn bool
+
+	usedWh float64       // in all
+	onWh   float64       // while on
+	onTime time.Duration // and for how long
+}
+
+var ampMeters = make(map[*managedAmp]*ampMeter) // guarded by mu
+
+// meterAmp reads amp's plug, and charges the time since the previous
+// reading at that one's watts.
+func meterAmp(amp *managedAmp, on bool, t time.Time) {
+	w, err := amp.plug.watts()
+	if err != nil {
+		warnf("Reading the plug of %s: %v", amp.name(), err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	m := ampMeters[amp]
+	if m == nil {
+		m = new(ampMeter)
+		ampMeters[amp] = m
+	} else if d := t.Sub(m.last); d > 0 {
+		m.usedWh += m.lastW * d.Hours()
+		if m.lastOn {
+			m.onWh += m.lastW * d.Hours()
+			m.onTime += d
+		}
+	}
+	m.last, m.lastW, m.lastOn = t, w, on
+}
+
+// meteredOnWatts returns what amp's plug has seen it draw on average
+// while on, if it's been seen on.
+func meteredOnWatts(amp *managedAmp) (float64, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if m := ampMeters[amp]; m != nil && m.onTime > 0 {
+		return m.onWh / m.onTime.Hours(), true
+	}
+	return 0, false
+}
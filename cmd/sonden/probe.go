@@ -0,0 +1,258 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/sonden/capture"
+	"github.com/bradfitz/sonden/detect"
+)
+
+// A probe is a small sonden (on a Pi Zero in a far room, say) that
+// only captures and analyzes audio, sending the daemon each window's
+// level rather than the audio itself. The daemon's monitor configured
+// with the probe's name judges the levels as if it had captured them.
+
+const (
+	probeEvery      = time.Second      // how often a probe sends what it has
+	probeTimeout    = 30 * time.Second // a monitor without levels from its probe for this long has lost it
+	probeMaxPending = 5 * time.Minute  // of levels a probe holds while it can't reach the daemon
+)
+
+var probeMaxLevels = flag.Int("probe-max-levels", 20000, "most window levels a probe holds while it can't reach the daemon, and the daemon takes in one report")
+
+// A probeLevel is one window's level, as a probe measured it.
+type probeLevel struct {
+	Time  time.Time `json:"time"` // by the probe's clock
+	Level float64   `json:"level"`
+}
+
+type probeReport struct {
+	Name   string       `json:"name"`
+	Levels []probeLevel `json:"levels"`
+}
+
+// probe implements the "probe" command: it captures audio as the
+// flags say, forever, and sends its levels to the daemon at daemonURL
+// as the probe called name.
+func probe(args []string) {
+	if len(args) != 2 {
+		usage()
+		os.Exit(2)
+	}
+	name, daemonURL := args[0], strings.TrimSuffix(args[1], "/")+"/probe"
+	mc, err := flagMonitorConfig()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if _, err := probeChain(mc); err != nil {
+		fatalf("%v", err)
+	}
+	levels := make(chan probeLevel, 64)
+	go sendProbeLevels(name, daemonURL, levels)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := probeCapture(mc, levels)
+		if err == io.EOF {
+			return
+		}
+		if time.Since(start) > maxCaptureBackoff {
+			backoff = time.Second
+		}
+		errorf("capture failed: %v; restarting in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxCaptureBackoff {
+			backoff = maxCaptureBackoff
+		}
+	}
+}
+
+// probeCapture captures audio as mc says and sends each window's
+// level to levels, until capture fails.
+func probeCapture(mc *monitorConfig, levels chan<- probeLevel) error {
+	var (
+		out io.ReadCloser
+		err error
+	)
+	if mc.Input != "" {
+		out, err = capture.Open(mc.Input, true)
+	} else {
+		out, err = capture.Start(mc.AlsaDev)
+	}
+	if err != nil {
+		return fmt.Errorf("starting capture: %v", err)
+	}
+	defer out.Close()
+	chain, err := probeChain(mc)
+	if err != nil {
+		return err
+	}
+	clock := capture.Clock{Rate: capture.SampleHz}
+	sr := capture.NewSampleReader(out)
+	samples := make([]int16, sampleChunk)
+	for {
+		n, err := sr.Read(samples)
+		if err == io.EOF && mc.Input != "" {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("reading samples: %v", err)
+		}
+		for _, sample := range samples[:n] {
+			clock.Add(1)
+			if level, ok := chain.Process(float64(sample)); ok {
+				select {
+				case levels <- probeLevel{Time: clock.Time(), Level: level}:
+				default:
+					// The sender's stuck; it has plenty pending.
+				}
+			}
+		}
+	}
+}
+
+// probeChain returns a new analysis chain for a probe configured by
+// mc.
+func probeChain(mc *monitorConfig) (detect.Chain, error) {
+	if len(mc.Analysis) == 0 {
+		return detect.DefaultChain(samplesIn(time.Duration(mc.Window)), samplesIn(time.Duration(mc.Hop))), nil
+	}
+	var scs []detect.StageConfig
+	for _, sc := range mc.Analysis {
+		scs = append(scs, detect.StageConfig(sc))
+	}
+	return detect.NewChain(scs, capture.SampleHz)
+}
+
+// sendProbeLevels posts the levels it's sent to the daemon every
+// probeEvery, keeping up to probeMaxPending (and -probe-max-levels) of
+// them while it can't.
+func sendProbeLevels(name, daemonURL string, levels <-chan probeLevel) {
+	var pending []probeLevel
+	failing := false
+	for range time.Tick(probeEvery) {
+	drain:
+		for {
+			select {
+			case l := <-levels:
+				pending = append(pending, l)
+			default:
+				break drain
+			}
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if last := pending[len(pending)-1].Time; last.Sub(pending[0].Time) > probeMaxPending {
+			i := 0
+			for last.Sub(pending[i].Time) > probeMaxPending {
+				i++
+			}
+			pending = pending[i:]
+		}
+		if n := *probeMaxLevels; len(pending) > n {
+			pending = append(pending[:0], pending[len(pending)-n:]...)
+		}
+		err := postProbeLevels(daemonURL, probeReport{Name: name, Levels: pending})
+		if err != nil {
+			if !failing {
+				errorf("sending levels to %s: %v", daemonURL, err)
+			}
+			failing = true
+			continue
+		}
+		if failing {
+			infof("sending levels to %s again", daemonURL)
+		}
+		failing = false
+		pending = pending[:0]
+	}
+}
+
+func postProbeLevels(daemonURL string, rep probeReport) error {
+	j, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", daemonURL, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *httpToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*httpToken)
+	}
+	return doRequest(req)
+}
+
+// serveProbe receives a probe's levels and passes them on to the
+// monitor listening to it.
+func serveProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var rep probeReport
+	// A level is well under 100 bytes of JSON.
+	body := http.MaxBytesReader(w, r.Body, int64(*probeMaxLevels)*100+1024)
+	if err := json.NewDecoder(body).Decode(&rep); err != nil {
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rep.Levels) > *probeMaxLevels {
+		http.Error(w, fmt.Sprintf("more than -probe-max-levels (%d) levels", *probeMaxLevels), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(rep.Levels) == 0 {
+		fmt.Fprintf(w, "OK\n")
+		return
+	}
+	for _, m := range monitors {
+		if m.probe == "" || m.probe != rep.Name {
+			continue
+		}
+		select {
+		case m.probeLevels <- rep.Levels:
+			fmt.Fprintf(w, "OK\n")
+		default:
+			http.Error(w, "too many reports queued", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	http.Error(w, "no monitor for probe "+rep.Name, http.StatusNotFound)
+}
+
+// listenProbe is listen for a monitor whose audio is analyzed by a
+// probe: it judges the levels the probe sends until it stops sending
+// them.
+func (m *monitor) listenProbe() error {
+	for {
+		select {
+		case levels := <-m.probeLevels:
+			// The probe's clock may not agree with ours; only the
+			// time between its levels counts.
+			now := time.Now()
+			last := levels[len(levels)-1].Time
+			m.mu.Lock()
+			m.inputHealth.lastSample = now
+			m.mu.Unlock()
+			setHealth(m.subsystem("probe"), nil)
+			for _, l := range levels {
+				m.handleWindow(l.Level, now.Add(l.Time.Sub(last)))
+			}
+		case <-time.After(probeTimeout):
+			return fmt.Errorf("no levels from probe %q for %v", m.probe, probeTimeout)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	httpToken  = flag.String("http-token", "", "if non-empty, control endpoints (on, off, pause) require this token, as \"Authorization: Bearer <token>\" or a token parameter")
+	publicAddr = flag.String("public-http", "", "if non-empty, address to serve a read-only, unauthenticated, cacheable status page on, safe to expose to the whole LAN")
+)
+
+// authed wraps a control handler to require -http-token, if set.
+func authed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *httpToken != "" && !validToken(requestToken(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sonden"`)
+			http.Error(w, "bad or missing token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func requestToken(r *http.Request) string {
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return t
+	}
+	return r.FormValue("token")
+}
+
+func validToken(t string) bool {
+	return subtle.ConstantTimeCompare([]byte(t), []byte(*httpToken)) == 1
+}
+
+// publicStatus is all the public page reveals about a monitor.
+type publicStatus struct {
+	Name           string    `json:"name,omitempty"`
+	On             bool      `json:"on"`
+	LastTransition time.Time `json:"last_transition"`
+}
+
+func publicStatuses() []publicStatus {
+	var ps []publicStatus
+	for _, m := range monitors {
+		st := m.status()
+		p := publicStatus{Name: st.Name, LastTransition: st.LastTransition}
+		for _, as := range st.Amps {
+			p.On = p.On || as.On
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+var publicTmpl = template.Must(template.New("public").Funcs(template.FuncMap{"tr": tr}).Parse(`<!DOCTYPE html>
+<html><head>
+<meta name="viewport" content="width=device-width">
+<title>{{tr "title"}}</title>
+<style>body { font-family: sans-serif; text-align: center; } .state { font-size: 4em; font-weight: bold; }</style>
+</head><body>
+{{range .}}
+{{with .Name}}<h1>{{.}}</h1>{{end}}
+<div class="state">{{if .On}}{{tr "simple_on"}}{{else}}{{tr "simple_off"}}{{end}}</div>
+{{if not .LastTransition.IsZero}}<p>{{tr "public_since"}} {{.LastTransition.Format "Mon 15:04"}}</p>{{end}}
+{{end}}
+</body></html>
+`))
+
+// servePublic serves the read-only status page on -public-http. It
+// has no control endpoints at all.
+func servePublic(addr string) {
+	mux := http.NewServeMux()
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=10")
+		if r.URL.Path == "/status.json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(publicStatuses())
+			return
+		}
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		publicTmpl.Execute(w, publicStatuses())
+	}
+	mux.HandleFunc("/", page)
+	infof("Serving public status page on %s", addr)
+	setHealth("public-http", nil)
+	err := http.ListenAndServe(addr, mux)
+	errorf("public HTTP server: %v", err)
+	setHealth("public-http", err)
+}
@@ -0,0 +1,257 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The -config file is reloaded on SIGHUP, or when it changes, without
+// losing the detector's state or what's known about the amps.
+// Monitors' detection parameters and schedules change in place;
+// webhooks, notifiers, hooks and IFTTT triggers are replaced if theirs
+// changed. Anything else (amps, sources, inputs, analysis) takes a
+// restart.
+
+const configPoll = 5 * time.Second // how often to check the file for changes
+
+var (
+	outputsMu sync.Mutex
+	outputs   []*subscriber // of the running outputs
+	curConf   *config       // as last loaded
+)
+
+// startOutputs starts conf's webhooks, notifiers, hooks and IFTTT
+// triggers, replacing any already running.
+func startOutputs(conf *config) error {
+	var (
+		whs []*webhook
+		ns  []*notifier
+		ts  []*ifttt
+	)
+	for _, wc := range conf.Webhooks {
+		wh, err := newWebhook(wc)
+		if err != nil {
+			return err
+		}
+		whs = append(whs, wh)
+	}
+	for _, nc := range conf.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return err
+		}
+		ns = append(ns, n)
+	}
+	for _, ic := range conf.IFTTT {
+		t, err := newIFTTT(ic)
+		if err != nil {
+			return err
+		}
+		ts = append(ts, t)
+	}
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	for _, sub := range outputs {
+		cancelSubscriber(sub)
+	}
+	outputs = nil
+	for _, wh := range whs {
+		outputs = append(outputs, wh.start())
+	}
+	for _, n := range ns {
+		outputs = append(outputs, n.start())
+	}
+	for _, t := range ts {
+		outputs = append(outputs, t.start())
+	}
+	if conf.Hooks != nil {
+		outputs = append(outputs, newHooks(conf.Hooks).start())
+	}
+	curConf = conf
+	return nil
+}
+
+// watchConfig reloads the config file on SIGHUP and whenever its
+// modification time changes.
+func watchConfig(filename string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var mtime time.Time
+	if fi, err := os.Stat(filename); err == nil {
+		mtime = fi.ModTime()
+	}
+	t := time.NewTicker(configPoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-hup:
+			infof("SIGHUP; reloading %s", filename)
+		case <-t.C:
+			fi, err := os.Stat(filename)
+			if err != nil || fi.ModTime().Equal(mtime) {
+				continue
+			}
+			mtime = fi.ModTime()
+			infof("%s changed; reloading it", filename)
+		}
+		reloadConfig(filename)
+	}
+}
+
+// reloadConfig applies what's changed in the config file since it was
+// last loaded. If it's no good, nothing changes.
+func reloadConfig(filename string) {
+	conf, err := loadConfig(filename)
+	if err != nil {
+		errorf("Not reloading: %v", err)
+		return
+	}
+	for _, mc := range conf.Monitors {
+		if err := checkReconfig(mc); err != nil {
+			errorf("Not reloading: monitor %q: %v", mc.Name, err)
+			return
+		}
+	}
+	outputsMu.Lock()
+	old := curConf
+	outputsMu.Unlock()
+
+	if conf.PowerBudget != old.PowerBudget {
+		setPowerBudget(conf.PowerBudget)
+		infof("Power budget now %vW", conf.PowerBudget)
+	}
+	if conf.Locale != "" && conf.Locale != old.Locale {
+		if err := setLocale(conf.Locale); err != nil {
+			errorf("Not changing locale: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(conf.Webhooks, old.Webhooks) || !reflect.DeepEqual(conf.Notifiers, old.Notifiers) ||
+		!reflect.DeepEqual(conf.Hooks, old.Hooks) || !reflect.DeepEqual(conf.IFTTT, old.IFTTT) {
+		if err := startOutputs(conf); err != nil {
+			errorf("Keeping the old webhooks, notifiers and hooks: %v", err)
+		} else {
+			infof("Restarted %d webhooks, %d notifiers and hooks", len(conf.Webhooks), len(conf.Notifiers))
+		}
+	}
+	outputsMu.Lock()
+	curConf = conf
+	outputsMu.Unlock()
+
+	if !reflect.DeepEqual(conf.Groups, old.Groups) {
+		warnf("The config's groups changed; restart to apply them")
+	}
+	if len(conf.Monitors) != len(monitors) {
+		warnf("The config has %d monitors, not %d; restart to add or remove them", len(conf.Monitors), len(monitors))
+	}
+	for _, mc := range conf.Monitors {
+		m := monitorNamed(mc.Name)
+		if m == nil {
+			continue
+		}
+		if string(fixedConfig(*mc)) != string(m.fixed) {
+			m.logf(levelWarn, "restart to apply changes to its amps, sources, input or analysis")
+		}
+		// Replace any reconfiguration it hasn't got to yet.
+		select {
+		case <-m.reconf:
+		default:
+		}
+		m.reconf <- *mc
+	}
+}
+
+func monitorNamed(name string) *monitor {
+	for _, m := range monitors {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// fixedConfig returns, for comparison, mc without the parameters
+// reconfigure can change while the monitor runs.
+func fixedConfig(mc monitorConfig) []byte {
+	mc.Threshold, mc.Idle, mc.Playing, mc.FastAttack = 0, 0, 0, 0
+	mc.Window, mc.Hop = 0, 0
+	mc.Prewarm, mc.PrewarmLead, mc.PrewarmGrace = "", 0, 0
+	mc.QuietHours, mc.QuietMode, mc.LongPlay = "", "", 0
+	mc.MinOn, mc.MinOff = 0, 0
+	mc.Profiles, mc.Schedule, mc.AdaptiveIdle = nil, nil, nil
+	j, _ := json.Marshal(mc)
+	return j
+}
+
+// checkReconfig returns an error if mc's changeable parameters are no
+// good.
+func checkReconfig(mc *monitorConfig) error {
+	if err := new(monitor).setSchedule(mc); err != nil {
+		return err
+	}
+	if samplesIn(time.Duration(mc.Window)) < 1 || samplesIn(time.Duration(mc.Hop)) < 1 {
+		return fmt.Errorf("window and hop must be at least one sample")
+	}
+	if mc.Threshold < 0 || mc.Idle < 0 || mc.Playing < 0 {
+		return fmt.Errorf("negative parameter")
+	}
+	return nil
+}
+
+// reconfigure changes m's parameters that differ between its config
+// and mc, already checked by checkReconfig, leaving alone any it's
+// been tuned to since that weren't changed. It's called by the run
+// goroutine.
+func (m *monitor) reconfigure(mc monitorConfig) {
+	old := m.conf
+	m.conf = mc
+	var t tuning
+	if mc.Threshold != old.Threshold {
+		t.threshold = mc.Threshold
+	}
+	if mc.Idle != old.Idle {
+		t.idle = time.Duration(mc.Idle)
+	}
+	if mc.Playing != old.Playing {
+		t.playing = time.Duration(mc.Playing)
+	}
+	if (mc.Window != old.Window || mc.Hop != old.Hop) && m.analysis == nil {
+		t.window, t.hop = time.Duration(mc.Window), time.Duration(mc.Hop)
+	}
+	if t != (tuning{}) {
+		if err := m.tune(t); err != nil {
+			m.logf(levelError, "reconfiguring: %v", err)
+		} else {
+			// What's configured now wins over what was kept.
+			m.keepTuning(t, false)
+		}
+	}
+	m.mu.Lock()
+	if mc.FastAttack != old.FastAttack {
+		m.det.Attack = mc.FastAttack
+		m.logf(levelInfo, "fast attack now %v", mc.FastAttack)
+	}
+	if mc.MinOn != old.MinOn || mc.MinOff != old.MinOff {
+		m.minOn, m.minOff = time.Duration(mc.MinOn), time.Duration(mc.MinOff)
+		m.logf(levelInfo, "minimum on time now %v, off time %v", m.minOn, m.minOff)
+	}
+	m.mu.Unlock()
+	if mc.Prewarm != old.Prewarm || mc.PrewarmLead != old.PrewarmLead || mc.PrewarmGrace != old.PrewarmGrace ||
+		mc.QuietHours != old.QuietHours || mc.QuietMode != old.QuietMode || mc.LongPlay != old.LongPlay ||
+		!reflect.DeepEqual(mc.Profiles, old.Profiles) || !reflect.DeepEqual(mc.Schedule, old.Schedule) ||
+		!reflect.DeepEqual(mc.AdaptiveIdle, old.AdaptiveIdle) {
+		if err := m.setSchedule(&mc); err != nil {
+			m.logf(levelError, "reconfiguring: %v", err)
+			return
+		}
+		m.logf(levelInfo, "reloaded pre-warm, quiet hours, long play, profile schedule and adaptive idle")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bradfitz/sonden/capture"
+	"github.com/bradfitz/sonden/detect"
+)
+
+// writeTranscript appends every event to f as a JSON line.
+func writeTranscript(f *os.File) {
+	sub := subscribe("transcript "+f.Name(), 1024, dropNewest, nil)
+	enc := json.NewEncoder(f)
+	for ev := range sub.C {
+		if err := enc.Encode(ev); err != nil {
+			errorf("writing transcript: %v", err)
+			setHealth("transcript", err)
+		}
+	}
+}
+
+// replay implements the "replay" command: it runs the detector over a
+// recorded file in simulated time and prints its decisions.
+func replay(args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
+	}
+	mc, err := flagMonitorConfig()
+	if *configFile != "" {
+		var conf *config
+		if conf, err = loadConfig(*configFile); err == nil {
+			mc = conf.Monitors[0]
+		}
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	m, err := newMonitor(mc)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	m.on, m.off = nil, nil // there are no sources to judge; just the audio
+	f, err := capture.Open(args[0], false)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer f.Close()
+
+	var (
+		start   = time.Now().Truncate(time.Second)
+		simNow  = start
+		on      bool
+		onSince time.Time
+		onTime  time.Duration
+		changes int
+	)
+	stamp := func(t time.Time) string {
+		d := t.Sub(start)
+		return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+	m.det.Clock = detect.ClockFunc(func() time.Time { return simNow })
+	m.decide = func(state bool, reason string) {
+		if state == on {
+			return
+		}
+		on = state
+		changes++
+		if on {
+			onSince = simNow
+			fmt.Printf("%s ON  (%s)\n", stamp(simNow), reason)
+		} else {
+			onTime += simNow.Sub(onSince)
+			fmt.Printf("%s OFF (%s)\n", stamp(simNow), reason)
+		}
+	}
+
+	var (
+		chain, _ = m.newChain()
+		sr       = capture.NewSampleReader(f)
+		samples  = make([]int16, sampleChunk)
+		n        int64
+	)
+	for {
+		nr, err := sr.Read(samples)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fatalf("reading %s: %v", args[0], err)
+		}
+		for _, sample := range samples[:nr] {
+			n++
+			level, ok := chain.Process(float64(sample))
+			if !ok {
+				continue
+			}
+			simNow = start.Add(time.Duration(n) * time.Second / capture.SampleHz)
+			m.handleWindow(level, simNow)
+		}
+	}
+	if on {
+		onTime += simNow.Sub(onSince)
+	}
+	fmt.Printf("%s end: %d transitions; amps on for %v of %v (threshold %v, idle %v)\n",
+		stamp(simNow), changes, onTime, simNow.Sub(start), m.threshold, m.idle)
+}
@@ -0,0 +1,150 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"time"
+)
+
+// Savings: how long sonden has kept each amp off, from when it turned
+// it off until anyone turns it on again, and what that saved over
+// leaving it on, at its on watts less its standby watts. An amp on an
+// energy-monitoring plug is charged what the plug has seen it draw
+// while on. The totals are kept in -state across restarts.
+
+var energyPrice = flag.Float64("energy-price", 0, "price of a kWh, for the estimated cost of the energy saved")
+
+var (
+	keptOff      = make(map[*managedAmp]time.Duration) // guarded by mu; closed periods only
+	keptOffSince = make(map[*managedAmp]time.Time)     // guarded by mu; since sonden turned it off
+)
+
+// startKeptOff notes that sonden just turned amp off. mu must be held.
+func startKeptOff(amp *managedAmp, t time.Time) {
+	if _, ok := keptOffSince[amp]; !ok {
+		keptOffSince[amp] = t
+	}
+}
+
+// endKeptOff notes that amp is on, if sonden was keeping it off. mu
+// must be held.
+func endKeptOff(amp *managedAmp, t time.Time) {
+	if since, ok := keptOffSince[amp]; ok {
+		keptOff[amp] += t.Sub(since)
+		delete(keptOffSince, amp)
+		go saveKeptOff()
+	}
+}
+
+// keptOffFor returns how long sonden has kept amp off in all, as of
+// t. mu must be held.
+func keptOffFor(amp *managedAmp, t time.Time) time.Duration {
+	d := keptOff[amp]
+	if since, ok := keptOffSince[amp]; ok && t.After(since) {
+		d += t.Sub(since)
+	}
+	return d
+}
+
+// saveKeptOff remembers the totals in -state.
+func saveKeptOff() {
+	now := time.Now()
+	for _, m := range monitors {
+		hours := make(map[string]float64)
+		mu.Lock()
+		for _, a := range m.amps {
+			if d := keptOffFor(a, now); d > 0 {
+				hours[a.name()] = d.Hours()
+			}
+		}
+		mu.Unlock()
+		updateState(m.name, func(ms *monitorState) { ms.KeptOffHours = hours })
+	}
+}
+
+// ampSavings is one amp's row of /savings.
+type ampSavings struct {
+	Amp          string  `json:"amp"`
+	KeptOffHours float64 `json:"kept_off_hours"`
+	OnWatts      float64 `json:"on_watts"`
+	StandbyWatts float64 `json:"standby_watts"`
+	SavedKWh     float64 `json:"saved_kwh"`
+	SavedCost    float64 `json:"saved_cost,omitempty"` // at -energy-price
+	UsedKWh      float64 `json:"used_kwh,omitempty"`   // metered by its plug since startup
+}
+
+type savingsReport struct {
+	Amps      []ampSavings `json:"amps"`
+	SavedKWh  float64      `json:"saved_kwh"`
+	SavedCost float64      `json:"saved_cost,omitempty"`
+}
+
+// savings totals up the savings so far, as of now.
+func savings(now time.Time) *savingsReport {
+	r := &savingsReport{Amps: []ampSavings{}}
+	for _, m := range monitors {
+		for _, a := range m.amps {
+			mu.Lock()
+			d := keptOffFor(a, now)
+			var used float64
+			if mt := ampMeters[a]; mt != nil {
+				used = mt.usedWh / 1000
+			}
+			mu.Unlock()
+			s := ampSavings{Amp: a.name(), KeptOffHours: d.Hours(), OnWatts: a.onWatts(), StandbyWatts: a.standbyWatts(), UsedKWh: used}
+			if w, ok := meteredOnWatts(a); ok {
+				s.OnWatts = w
+			}
+			if w := s.OnWatts - s.StandbyWatts; w > 0 {
+				s.SavedKWh = d.Hours() * w / 1000
+			}
+			s.SavedCost = s.SavedKWh * *energyPrice
+			r.Amps = append(r.Amps, s)
+			r.SavedKWh += s.SavedKWh
+			r.SavedCost += s.SavedCost
+		}
+	}
+	return r
+}
+
+func serveSavings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(savings(time.Now()))
+}
+
+const savingsCheckpoint = 10 * time.Minute
+
+// logSavings checkpoints the totals every savingsCheckpoint, and logs
+// what was saved each day at the first checkpoint after midnight.
+func logSavings() {
+	last := savings(time.Now())
+	day := time.Now().YearDay()
+	for range time.Tick(savingsCheckpoint) {
+		if *stateFile != "" {
+			saveKeptOff()
+		}
+		now := time.Now()
+		if now.YearDay() == day {
+			continue
+		}
+		day = now.YearDay()
+		cur := savings(now)
+		var hours float64
+		for i, s := range cur.Amps {
+			if i < len(last.Amps) {
+				hours += s.KeptOffHours - last.Amps[i].KeptOffHours
+			}
+		}
+		kwh := cur.SavedKWh - last.SavedKWh
+		if *energyPrice > 0 {
+			infof("Savings yesterday: amps kept off %.1fh in all, about %.2f kWh (%.2f); %.1f kWh (%.2f) so far", hours, kwh, kwh**energyPrice, cur.SavedKWh, cur.SavedCost)
+		} else {
+			infof("Savings yesterday: amps kept off %.1fh in all, about %.2f kWh; %.1f kWh so far", hours, kwh, cur.SavedKWh)
+		}
+		last = cur
+	}
+}
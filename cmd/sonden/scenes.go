@@ -0,0 +1,207 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A monitor's scenes are set along with its amps: when the amps turn
+// on, the "listening" scene (lights dimmed, say) is set, and when they
+// turn off again, it's reverted.
+
+// sceneConfig configures one scene, like
+//
+//	{"type": "hue", "addr": "10.0.0.60", "user": "...", "group": "3", "scene": "Ab12Cd34"}
+//	{"type": "http", "on_url": "http://ha:8123/api/webhook/listening", "off_url": "..."}
+type sceneConfig struct {
+	// Type is "hue", for a Philips Hue bridge's scene, or "http",
+	// for URLs to request.
+	Type string `json:"type"`
+
+	// Hue: the bridge, its API username, and the group (room) and
+	// scene IDs. Reverting recalls OffScene if set, else puts the
+	// group's lights back as they were before.
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Group    string `json:"group"`
+	Scene    string `json:"scene"`
+	OffScene string `json:"off_scene"`
+
+	// HTTP: the URLs to request to set and revert the scene, with
+	// Method (default POST) and an optional Body.
+	OnURL  string `json:"on_url"`
+	OffURL string `json:"off_url"`
+	Method string `json:"method"`
+	Body   string `json:"body"`
+}
+
+// A scene is something set while the amps are on.
+type scene interface {
+	set() error
+	revert() error
+}
+
+func newScene(sc *sceneConfig) (scene, error) {
+	switch sc.Type {
+	case "hue":
+		if sc.Addr == "" || sc.User == "" || sc.Group == "" || sc.Scene == "" {
+			return nil, fmt.Errorf("hue scene needs addr, user, group and scene")
+		}
+		return &hueScene{api: "http://" + sc.Addr + "/api/" + sc.User, group: sc.Group, scene: sc.Scene, offScene: sc.OffScene}, nil
+	case "http":
+		if sc.OnURL == "" {
+			return nil, fmt.Errorf("http scene needs on_url")
+		}
+		method := sc.Method
+		if method == "" {
+			method = "POST"
+		}
+		return &httpScene{onURL: sc.OnURL, offURL: sc.OffURL, method: method, body: sc.Body}, nil
+	}
+	return nil, fmt.Errorf("unknown scene type %q", sc.Type)
+}
+
+// startScenes sets and reverts m's scenes as its amps turn on and off.
+func (m *monitor) startScenes() {
+	if len(m.scenes) == 0 {
+		return
+	}
+	sub := subscribe("scenes "+m.name, hookBuffer, dropOldest, func(ev event) bool {
+		return ev.Monitor == m.name && (ev.Type == "amps_on" || ev.Type == "amps_off")
+	})
+	go func() {
+		for ev := range sub.C {
+			for i, s := range m.scenes {
+				what, f := "setting", s.set
+				if ev.Type == "amps_off" {
+					what, f = "reverting", s.revert
+				}
+				if err := withRetry(fmt.Sprintf("%s scene %d", what, i), f); err != nil {
+					m.logf(levelError, "%s scene %d: %v", what, i, err)
+				}
+			}
+		}
+	}()
+}
+
+type httpScene struct {
+	onURL, offURL string
+	method, body  string
+}
+
+func (s *httpScene) set() error { return s.request(s.onURL) }
+
+func (s *httpScene) revert() error {
+	if s.offURL == "" {
+		return nil
+	}
+	return s.request(s.offURL)
+}
+
+func (s *httpScene) request(url string) error {
+	req, err := http.NewRequest(s.method, url, strings.NewReader(s.body))
+	if err != nil {
+		return err
+	}
+	return doRequest(req)
+}
+
+// hueScene is a scene on a Hue bridge, through its v1 API.
+type hueScene struct {
+	api      string // http://bridge/api/user
+	group    string
+	scene    string
+	offScene string
+
+	before map[string]hueLightState // by light ID, when the scene was set
+}
+
+// hueLightState is what of a light's state is put back.
+type hueLightState struct {
+	On        bool      `json:"on"`
+	Bri       int       `json:"bri"`
+	CT        int       `json:"ct"`
+	XY        []float64 `json:"xy"`
+	ColorMode string    `json:"colormode"`
+}
+
+func (s *hueScene) set() error {
+	if s.offScene == "" && s.before == nil {
+		// Remember how the lights were. A second set, after a
+		// failed revert, keeps the first.
+		var g struct {
+			Lights []string `json:"lights"`
+		}
+		if err := s.get("/groups/"+s.group, &g); err != nil {
+			return err
+		}
+		before := make(map[string]hueLightState)
+		for _, id := range g.Lights {
+			var l struct {
+				State hueLightState `json:"state"`
+			}
+			if err := s.get("/lights/"+id, &l); err != nil {
+				return err
+			}
+			before[id] = l.State
+		}
+		s.before = before
+	}
+	return s.put("/groups/"+s.group+"/action", map[string]string{"scene": s.scene})
+}
+
+func (s *hueScene) revert() error {
+	if s.offScene != "" {
+		return s.put("/groups/"+s.group+"/action", map[string]string{"scene": s.offScene})
+	}
+	for id, st := range s.before {
+		v := map[string]interface{}{"on": st.On}
+		if st.On {
+			v["bri"] = st.Bri
+			switch st.ColorMode {
+			case "ct":
+				v["ct"] = st.CT
+			case "xy", "hs":
+				v["xy"] = st.XY
+			}
+		}
+		if err := s.put("/lights/"+id+"/state", v); err != nil {
+			return err
+		}
+		delete(s.before, id)
+	}
+	s.before = nil
+	return nil
+}
+
+func (s *hueScene) get(path string, v interface{}) error {
+	c := &http.Client{Timeout: webhookTimeout}
+	res, err := c.Get(s.api + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (s *hueScene) put(path string, v interface{}) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.api+path, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(req)
+}
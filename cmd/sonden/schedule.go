@@ -0,0 +1,174 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weeklyTime is a time of day, optionally restricted to one day of
+// the week.
+type weeklyTime struct {
+	anyDay bool
+	day    time.Weekday
+	hour   int
+	min    int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeeklyTime parses "15:04" (every day) or "Sun 15:04".
+func parseWeeklyTime(s string) (weeklyTime, error) {
+	var wt weeklyTime
+	f := strings.Fields(s)
+	switch len(f) {
+	case 1:
+		wt.anyDay = true
+	case 2:
+		name := strings.ToLower(f[0])
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		d, ok := weekdays[name]
+		if !ok {
+			return wt, fmt.Errorf("bad weekday in %q", s)
+		}
+		wt.day = d
+		f = f[1:]
+	default:
+		return wt, fmt.Errorf("bad time %q; want \"15:04\" or \"Sun 15:04\"", s)
+	}
+	t, err := time.Parse("15:04", f[0])
+	if err != nil {
+		return wt, fmt.Errorf("bad time %q: %v", s, err)
+	}
+	wt.hour, wt.min = t.Hour(), t.Minute()
+	return wt, nil
+}
+
+// parseWeeklyTimes parses a comma-separated list of weeklyTimes.
+func parseWeeklyTimes(s string) ([]weeklyTime, error) {
+	var wts []weeklyTime
+	for _, f := range strings.Split(s, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		wt, err := parseWeeklyTime(f)
+		if err != nil {
+			return nil, err
+		}
+		wts = append(wts, wt)
+	}
+	return wts, nil
+}
+
+// near returns the occurrence of wt closest to t, if there is one
+// within a day either side.
+func (wt weeklyTime) near(t time.Time) (occ time.Time, ok bool) {
+	best := time.Duration(-1)
+	for d := -1; d <= 1; d++ {
+		day := t.AddDate(0, 0, d)
+		if !wt.anyDay && day.Weekday() != wt.day {
+			continue
+		}
+		o := time.Date(day.Year(), day.Month(), day.Day(), wt.hour, wt.min, 0, 0, t.Location())
+		dist := o.Sub(t)
+		if dist < 0 {
+			dist = -dist
+		}
+		if best < 0 || dist < best {
+			occ, best, ok = o, dist, true
+		}
+	}
+	return
+}
+
+// next returns the first occurrence of wt after t.
+func (wt weeklyTime) next(t time.Time) time.Time {
+	for d := 0; ; d++ {
+		day := t.AddDate(0, 0, d)
+		if !wt.anyDay && day.Weekday() != wt.day {
+			continue
+		}
+		if o := time.Date(day.Year(), day.Month(), day.Day(), wt.hour, wt.min, 0, 0, t.Location()); o.After(t) {
+			return o
+		}
+	}
+}
+
+// prewarmWindow reports whether t is within lead before, or grace
+// after, any of the scheduled times, and if so which one.
+func prewarmWindow(sched []weeklyTime, t time.Time, lead, grace time.Duration) (occ time.Time, ok bool) {
+	for _, wt := range sched {
+		o, found := wt.near(t)
+		if found && !t.Before(o.Add(-lead)) && t.Before(o.Add(grace)) {
+			return o, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// A dailyRange is a range of time of day, like 23:00-07:00. It may
+// wrap past midnight.
+type dailyRange struct {
+	start, end int // minutes past midnight
+}
+
+// parseDailyRanges parses a comma-separated list of ranges like
+// "23:00-07:00,13:00-14:00".
+func parseDailyRanges(s string) ([]dailyRange, error) {
+	var rs []dailyRange
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		i := strings.Index(f, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("bad time range %q; want \"23:00-07:00\"", f)
+		}
+		var r dailyRange
+		for j, p := range []string{f[:i], f[i+1:]} {
+			t, err := time.Parse("15:04", strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("bad time range %q: %v", f, err)
+			}
+			m := t.Hour()*60 + t.Minute()
+			if j == 0 {
+				r.start = m
+			} else {
+				r.end = m
+			}
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func (r dailyRange) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return m >= r.start && m < r.end
+	}
+	return m >= r.start || m < r.end
+}
+
+func inRanges(rs []dailyRange, t time.Time) bool {
+	for _, r := range rs {
+		if r.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maxGoroutines = flag.Int("max-goroutines", 500, "warn when the daemon has more goroutines than this; 0 to disable")
+	maxCPU        = flag.Float64("max-cpu", 0, "if non-zero, percent of one CPU the daemon should stay under; when exceeded it analyzes audio less often")
+)
+
+const (
+	selfCheckEvery = 30 * time.Second
+	maxStride      = 8
+)
+
+// analysisStride is how many windows of audio pass per analyzed one.
+// It's raised above 1 only when we're over the -max-cpu budget.
+var analysisStride int32 = 1
+
+func getAnalysisStride() int { return int(atomic.LoadInt32(&analysisStride)) }
+
+// selfMonitor periodically checks the daemon's own goroutine count and
+// CPU usage against their budgets.
+func selfMonitor() {
+	lastCPU, cpuOK := cpuTime()
+	lastCheck := time.Now()
+	for range time.Tick(selfCheckEvery) {
+		if n := runtime.NumGoroutine(); *maxGoroutines > 0 && n > *maxGoroutines {
+			warnf("%d goroutines running; budget is %d", n, *maxGoroutines)
+		}
+		if *maxCPU <= 0 || !cpuOK {
+			continue
+		}
+		now := time.Now()
+		cpu, _ := cpuTime()
+		pct := 100 * float64(cpu-lastCPU) / float64(now.Sub(lastCheck))
+		lastCPU, lastCheck = cpu, now
+
+		stride := getAnalysisStride()
+		switch {
+		case pct > *maxCPU && stride < maxStride:
+			stride *= 2
+			warnf("using %.1f%% CPU; budget is %v%%. Analyzing every %d windows.", pct, *maxCPU, stride)
+		case pct > *maxCPU:
+			warnf("using %.1f%% CPU; budget is %v%%", pct, *maxCPU)
+		case pct < *maxCPU/2 && stride > 1:
+			stride /= 2
+			infof("using %.1f%% CPU; back to analyzing every %d windows", pct, stride)
+		}
+		atomic.StoreInt32(&analysisStride, int32(stride))
+	}
+}
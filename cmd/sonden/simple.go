@@ -0,0 +1,82 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// The /simple page is for old wall-mounted tablets and e-readers: no
+// JavaScript, just a big state and one button per monitor. With
+// -http-token, bookmark it as /simple?token=...
+
+var simpleTmpl = template.Must(template.New("simple").Funcs(template.FuncMap{"tr": tr}).Parse(`<!DOCTYPE html>
+<html><head>
+<meta name="viewport" content="width=device-width">
+<meta http-equiv="refresh" content="30">
+<title>{{tr "title"}}</title>
+<style>
+body { font-family: sans-serif; text-align: center; }
+.state { font-size: 5em; font-weight: bold; margin: 0.3em; }
+button { font-size: 2.5em; padding: 0.4em 1em; }
+</style>
+</head><body>
+{{range .}}
+<div>
+{{with .Name}}<h1>{{.}}</h1>{{end}}
+<div class="state">{{if .On}}{{tr "simple_on"}}{{else}}{{tr "simple_off"}}{{end}}</div>
+<p>{{if .Playing}}{{tr "simple_playing"}}{{else}}{{tr "simple_silent"}}{{end}}</p>
+<form method="POST" action="/simple/{{if .On}}off{{else}}on{{end}}">
+<input type="hidden" name="monitor" value="{{.Name}}">
+{{with .Token}}<input type="hidden" name="token" value="{{.}}">{{end}}
+<button type="submit">{{if .On}}{{tr "simple_turn_off"}}{{else}}{{tr "simple_turn_on"}}{{end}}</button>
+</form>
+</div>
+{{end}}
+</body></html>
+`))
+
+type simpleMonitor struct {
+	Name    string
+	Token   string // from the page's URL, to pass on to the button
+	On      bool   // any amp on
+	Playing bool
+}
+
+func serveSimple(w http.ResponseWriter, r *http.Request) {
+	var sms []simpleMonitor
+	for _, m := range monitors {
+		st := m.status()
+		sm := simpleMonitor{Name: st.Name, Playing: st.Playing, Token: r.FormValue("token")}
+		for _, as := range st.Amps {
+			sm.On = sm.On || as.On
+		}
+		sms = append(sms, sm)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := simpleTmpl.Execute(w, sms); err != nil {
+		errorf("rendering /simple: %v", err)
+	}
+}
+
+// serveSimpleForce handles the /simple page's button and redirects
+// back to it.
+func serveSimpleForce(state bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, m := range selectedMonitors(r) {
+			m.forceAmps(state)
+		}
+		back := "/simple"
+		if t := r.FormValue("token"); t != "" {
+			back += "?token=" + url.QueryEscape(t)
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+	}
+}
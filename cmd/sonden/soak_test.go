@@ -0,0 +1,106 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// soakAmp is an amp that's never really switched.
+type soakAmp string
+
+func (a soakAmp) Addr() string                            { return string(a) }
+func (a soakAmp) PowerCommands(on bool) []string          { return nil }
+func (a soakAmp) SendCommand(cmd string) error            { return nil }
+func (a soakAmp) QueryPower() (on bool, err error)        { return false, nil }
+func (a soakAmp) QuerySource() (source string, err error) { return "", nil }
+
+// TestSoak runs what accumulates state through simulated weeks of a
+// busy household, and checks that the state stays within its caps and
+// the heap doesn't grow from one week to the next.
+func TestSoak(t *testing.T) {
+	defer func(n int) { *levelHistoryMax = n }(*levelHistoryMax)
+	*levelHistoryMax = 60 // under -level-history's worth at a level every 5s
+	amps := []*managedAmp{
+		{Backend: soakAmp("10.0.0.5"), zone: 1},
+		{Backend: soakAmp("10.0.0.5"), zone: 2},
+	}
+	var levels levelRing
+	h := idempotent(func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	start := time.Date(2011, 6, 1, 0, 0, 0, 0, time.UTC)
+	hour := 0
+	week := func() {
+		for end := hour + 7*24; hour < end; hour++ {
+			now := start.Add(time.Duration(hour) * time.Hour)
+			for s := 0; s < 3600; s += 5 {
+				levels.add(levelSample{Time: now.Add(time.Duration(s) * time.Second), Level: float64(s)})
+			}
+			on := hour%2 == 0
+			recordTransition(transition{Time: now, Monitor: "living room", State: powerString(on), Reason: reasonIdleTimeout})
+			for _, a := range amps {
+				// A streamer reports what it's playing as its input.
+				recordUsage(a, on, fmt.Sprintf("track %d", hour), now)
+				observeAmp(a, "volume", fmt.Sprint(hour%80), "someone else")
+			}
+			req := httptest.NewRequest("POST", "/on?request_id="+fmt.Sprint(hour), nil)
+			h(httptest.NewRecorder(), req)
+		}
+	}
+	heap := func() uint64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+
+	week()
+	week()
+	before := heap()
+	for i := 0; i < 6; i++ {
+		week()
+	}
+	after := heap()
+	if after > before+512<<10 {
+		t.Errorf("heap grew from %d to %d bytes over six weeks", before, after)
+	}
+
+	transitionsMu.Lock()
+	if n := len(transitions); n > 2**transitionLogSize {
+		t.Errorf("%d transitions kept; want at most %d", n, 2**transitionLogSize)
+	}
+	transitionsMu.Unlock()
+	ampLogMu.Lock()
+	if n := len(ampLog); n > 2**ampLogSize {
+		t.Errorf("%d amp changes kept; want at most %d", n, 2**ampLogSize)
+	}
+	for _, a := range amps {
+		if n := len(ampSeen[a]); n > 3 {
+			t.Errorf("amp %s: %d last values kept; want power, input and volume at most", a.name(), n)
+		}
+	}
+	ampLogMu.Unlock()
+	idemMu.Lock()
+	if n := len(idemResults); n > *maxRequestIDs || n != len(idemOrder) {
+		t.Errorf("%d request IDs kept, %d in order; want at most %d", n, len(idemOrder), *maxRequestIDs)
+	}
+	idemMu.Unlock()
+	usageMu.Lock()
+	for _, a := range amps {
+		if n := usageInputs(a); n > *maxUsageInputs+1 {
+			t.Errorf("amp %s: on-time charged to %d inputs; want at most %d and %q", a.name(), n, *maxUsageInputs, otherInput)
+		}
+	}
+	usageMu.Unlock()
+	if n := len(levels.s); n > 2**levelHistoryMax {
+		t.Errorf("%d levels kept; want at most %d", n, 2**levelHistoryMax)
+	}
+	if n := len(levels.s) - levels.start; n != *levelHistoryMax {
+		t.Errorf("%d levels current; want %d", n, *levelHistoryMax)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+//
+// Home automation & power saving daemon.
+//
+// Listens to audio input and turns on my Denon receivers when there's
+// music and turns them off to save power when things are silent for
+// awhile.
+//
+// Author: Brad Fitzpatrick <brad@danga.com>
+//
+
+package main
+
+import (
+	"flag"
+	"os"
+	"sync"
+	"time"
+)
+
+// Flags
+var (
+	configFile    = flag.String("config", "", "optional JSON config file defining one or more monitors; see config.go. Flags give the defaults. Reloaded on SIGHUP or when it changes")
+	ampAddrs      = flag.String("amps", "", "comma-separated list of Denon amps as ip:port (or auto, for the only one on the LAN), or URLs of other amps; see parseAmpURL in config.go")
+	idle          = flag.Duration("idle", 5*time.Minute, "length of silence before turning off amps")
+	fastAttack    = flag.Float64("fast-attack", 0, "if non-zero, turn amps on at once, regardless of -playing, for a window this many times louder than the threshold (e.g. 10)")
+	window        = flag.Duration("window", time.Second, "length of each analyzed window of audio")
+	hop           = flag.Duration("hop", 0, "how often to analyze a window, for windows that overlap; 0 means the window length")
+	maxFlatness   = flag.Float64("max-flatness", 0, "if non-zero, ignore windows whose spectral flatness is over this (0 to 1), as broadband noise like fans or rain rather than music (e.g. 0.3); without a configured analysis chain")
+	playing       = flag.Duration("playing", 0, "how long music must play before turning on amps, to ignore brief noises; 0 for the first loud second")
+	alsaDev       = flag.String("alsadev", "", "If non-empty, arecord(1) is used instead of rec(1) with this ALSA device name. e.g. plughw:CARD=Audio,DEV=0 (see arecord -L), or an OSS device like /dev/dsp to read directly. On macOS, the name of the CoreAudio input device for sox(1). On Windows, part of the name of the WASAPI capture device to use, or loopback (or loopback:name) to hear what an output device plays")
+	threshold     = flag.Float64("threshold", 0, "optional sound cut-off threshold to use")
+	overrideGrace = flag.Duration("override-grace", 2*time.Hour, "after an amp's power is changed by someone else (as seen by -poll), leave it alone this long")
+	manageInputs  = flag.String("manage-inputs", "", "if non-empty, comma-separated list of amp inputs (e.g. CD,AUX1) sonden monitors; Denon amps on any other input are never turned off")
+	ampWattsFlag  = flag.String("amp-watts", "", "comma-separated power draw in watts of each amp in -amps, for -power-budget")
+	ampStandby    = flag.String("amp-standby-watts", "", "comma-separated standby power draw in watts of each amp in -amps, for the savings estimate")
+	powerBudget   = flag.Float64("power-budget", 0, "if non-zero, the most watts of amps, of all monitors together, to have on at once; amps earlier in -amps, or the config, have priority")
+	prewarmFlag   = flag.String("prewarm", "", "comma-separated routine listening times, like \"Sun 09:00,20:30\", to turn the amps on ahead of")
+	minOn         = flag.Duration("min-on", 0, "if non-zero, never automatically turn amps off sooner than this after turning them on, so a flapping detector can't cycle them and their relays")
+	minOff        = flag.Duration("min-off", 0, "if non-zero, never automatically turn amps on sooner than this after turning them off")
+	prewarmLead   = flag.Duration("prewarm-lead", 5*time.Minute, "how long before a -prewarm time to turn the amps on")
+	prewarmGrace  = flag.Duration("prewarm-grace", 15*time.Minute, "how long after a -prewarm time to wait for audio before giving up")
+	quietHours    = flag.String("quiet-hours", "", "comma-separated times of day, like 23:00-07:00, during which amps are never turned on automatically")
+	quietMode     = flag.String("quiet-mode", "block", "what -quiet-hours do: \"block\" only stops amps being turned on; \"off\" also forces them off regardless of sound")
+	zone          = flag.Int("zone", 1, "which zone of multi-zone receivers to manage: 1 is the main zone (and the unit's standby), 2 and 3 are Zone2 and Zone3")
+	httpAddr      = flag.String("http", "", "if non-empty, address (e.g. :8080) to serve the HTTP API on, including the /events stream")
+	dryRun        = flag.Bool("dry_run", false, "don't send commands to the amps; just log (and -transcript) what would be sent")
+	transcript    = flag.String("transcript", "", "if non-empty, file to append every event to as JSON lines, for reviewing decisions")
+	input         = flag.String("input", "", "if non-empty, read audio from this file (or - for stdin) instead of recording: WAV, FLAC, or raw mono S16LE at 8192 Hz. Or receive it from the network: tcp://:9000 for a stream per connection in any of those formats (like arecord -t wav | nc host 9000), or rtp://:5004 for RTP L16 (?rate=48000&channels=2 if not 44.1 kHz as its payload type says)")
+	realtime      = flag.Bool("realtime", true, "with -input, read at the recording rate; if false, as fast as possible with time simulated")
+	pollEvery     = flag.Duration("poll", time.Minute, "how often to query the amps' real power state; 0 to only trust what we last sent")
+	statusTTL     = flag.Duration("status-ttl", 30*time.Second, "how old an amp's power state in /status may get before it's refreshed in the background; 0 to only refresh on -poll")
+)
+
+const (
+	quietVarianceThreshold     = 1000 // typically ~2. occasionally as high as 16.
+	alsaQuietVarianceThreshold = 2000 // why different than previous line? dunno. wrong sample params?
+)
+
+var monitors []*monitor // set at startup
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	initLogging()
+
+	if args := flag.Args(); len(args) > 0 && args[0] == "replay" {
+		replay(args[1:])
+		return
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] == "discover" {
+		discover(args[1:])
+		return
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] == "probe" {
+		probe(args[1:])
+		return
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] != "run" {
+		runClientCommand(args)
+		return
+	}
+
+	if err := setLocale(*localeFlag); err != nil {
+		fatalf("%v", err)
+	}
+	var (
+		mcs []*monitorConfig
+		gcs []*groupConfig
+	)
+	if *configFile != "" {
+		conf, err := loadConfig(*configFile)
+		if err != nil {
+			fatalf("Error loading config: %v", err)
+		}
+		if conf.Locale != "" {
+			if err := setLocale(conf.Locale); err != nil {
+				fatalf("%v", err)
+			}
+		}
+		mcs, gcs = conf.Monitors, conf.Groups
+		setPowerBudget(conf.PowerBudget)
+		if err := startOutputs(conf); err != nil {
+			fatalf("%v", err)
+		}
+	} else {
+		mc, err := flagMonitorConfig()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		mcs = append(mcs, mc)
+		setPowerBudget(*powerBudget)
+	}
+
+	if err := openAmpLog(); err != nil {
+		fatalf("%v", err)
+	}
+	var allAmps []*managedAmp
+	for i, mc := range mcs {
+		m, err := newMonitor(mc)
+		if err != nil {
+			fatalf("monitor %d (%q): %v", i, mc.Name, err)
+		}
+		allAmps = append(allAmps, m.amps...)
+		monitors = append(monitors, m)
+	}
+	var groups []*group
+	for _, gc := range gcs {
+		g, err := newGroup(gc, monitors)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		groups = append(groups, g)
+	}
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		wg.Add(1)
+		go func(m *monitor) {
+			defer wg.Done()
+			m.run()
+		}(m)
+	}
+	if *transcript != "" {
+		f, err := os.OpenFile(*transcript, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go writeTranscript(f)
+	}
+	for _, g := range groups {
+		go g.run()
+	}
+	go pollAmpState(allAmps)
+	go selfMonitor()
+	go logSavings()
+	if *weeklySummary != "" {
+		go sendWeeklySummaries()
+	}
+	if *configFile != "" {
+		go watchConfig(*configFile)
+	}
+	if *httpAddr != "" {
+		go serveHTTP(*httpAddr)
+	}
+	if *publicAddr != "" {
+		go servePublic(*publicAddr)
+	}
+	if *hueAddr != "" {
+		go serveHue(*hueAddr)
+	}
+	go logTransitionsOnExit()
+	// Only monitors reading from -input ever finish.
+	wg.Wait()
+	logTransitions()
+}
@@ -0,0 +1,712 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/sonden/amp"
+	"github.com/bradfitz/sonden/capture"
+	"github.com/bradfitz/sonden/detect"
+)
+
+// An activitySource says whether music is playing by asking the
+// player rather than listening to it, for digital chains with
+// nowhere to tap the audio.
+type activitySource interface {
+	// watch calls playing whenever it learns the player's state,
+	// until it fails.
+	watch(playing func(bool)) error
+}
+
+// sourceConfig configures a monitor's activity source, used instead of
+// capturing audio. For example:
+//
+//	{"type": "airplay", "path": "/tmp/shairport-sync-metadata"}
+//	{"type": "http", "url": "http://roon-bridge:3000/zone/Den", "match": "\"state\":\\s*\"playing\""}
+//	{"type": "mpd", "addr": "music:6600"}
+//	{"type": "snapcast", "addr": "music:1705", "client": "den-pi"}
+//	{"type": "librespot"}
+//	{"type": "gpio", "pin": 17}
+//	{"type": "cast", "addr": "10.0.0.30"}
+//	{"type": "sonos", "addr": "10.0.0.12"}
+//	{"type": "dlna", "renderer": "Living Room"}
+//	{"type": "plug", "plug": {"type": "shelly", "addr": "10.0.0.41"}, "watts": 8}
+//	{"type": "spdif", "device": "hw:CARD=Audio", "combine": "and"}
+type sourceConfig struct {
+	// Type is "airplay", for shairport-sync's metadata pipe;
+	// "http", to poll a URL: music is playing while the response
+	// matches Match (Roon has no plain HTTP API, but an HTTP bridge
+	// extension reporting zone state does the job); "mpd", for an
+	// MPD server whose state is "play"; "snapcast", for a
+	// Snapcast client whose group's stream is playing, unmuted;
+	// "librespot", for Spotify Connect: librespot's --onevent hook
+	// runs "sonden librespot-event", which tells the daemon; or
+	// "gpio", for a GPIO input that's set while music plays, like
+	// a source component's 12V trigger through an optocoupler; or
+	// "cast", for a Chromecast or Cast speaker group that's playing;
+	// "sonos", for a Sonos player (a Port or Connect feeding the
+	// amp) whose transport state is PLAYING; "dlna", for any
+	// UPnP/DLNA media renderer that's PLAYING; or "plug", for a
+	// source component (a turntable, a CD player) on an
+	// energy-monitoring plug, playing while it draws over Watts; or
+	// "spdif", for a sound card's S/PDIF input, playing while it
+	// receives a valid signal. Most digital sources drop the signal
+	// when they stop, so it says at once that music has stopped; with
+	// "combine": "and", a signal that's there but silent is left to
+	// the audio detector, capturing from the same input.
+	Type string `json:"type"`
+
+	// Combine, for a monitor's single "source", keeps the audio
+	// detector running too: "and" counts music as playing only
+	// when both say so, "or" when either does. It's shorthand for
+	// an "on" rule of "audio and source" or "audio or source".
+	Combine string `json:"combine"`
+
+	Path     string   `json:"path"`     // airplay: metadata pipe; default /tmp/shairport-sync-metadata
+	URL      string   `json:"url"`      // http; dlna: the renderer's device description, to skip discovery
+	Match    string   `json:"match"`    // http: regexp; default "playing"
+	Poll     duration `json:"poll"`     // http, plug, spdif: how often; default 5s, 2s, 250ms
+	Addr     string   `json:"addr"`     // mpd, snapcast, cast, sonos: host:port; default localhost:6600, localhost:1705, port 8009, port 1400
+	Password string   `json:"password"` // mpd, if it needs one
+
+	// Snapcast: the client, by ID or name, or group, by ID or
+	// name. The default is the client on this host.
+	Client string `json:"client"`
+	Group  string `json:"group"`
+
+	// GPIO: the input pin, as amp.GPIO numbers them.
+	Pin       int  `json:"pin"`
+	ActiveLow bool `json:"active_low"` // set while the pin is low
+
+	// DLNA: the renderer, by friendly name or UUID, found on the
+	// LAN by SSDP. It may be left out with a URL.
+	Renderer string `json:"renderer"`
+
+	Plug  *plugConfig `json:"plug"`
+	Watts float64     `json:"watts"` // plug: more than this is playing
+
+	// S/PDIF: the card, as amixer's -D (default the default card),
+	// and its control saying whether the input has a valid signal;
+	// see capture.Mixer.SPDIFLocked.
+	Device  string `json:"device"`
+	Control string `json:"control"`
+}
+
+func newSource(sc *sourceConfig) (activitySource, error) {
+	switch sc.Type {
+	case "airplay":
+		path := sc.Path
+		if path == "" {
+			path = "/tmp/shairport-sync-metadata"
+		}
+		return &airplaySource{path: path}, nil
+	case "http":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("http source needs url")
+		}
+		match := sc.Match
+		if match == "" {
+			match = "playing"
+		}
+		re, err := regexp.Compile(match)
+		if err != nil {
+			return nil, fmt.Errorf("bad match: %v", err)
+		}
+		poll := time.Duration(sc.Poll)
+		if poll <= 0 {
+			poll = 5 * time.Second
+		}
+		return &httpSource{url: sc.URL, match: re, poll: poll}, nil
+	case "mpd":
+		addr := sc.Addr
+		if addr == "" {
+			addr = "localhost:6600"
+		}
+		return &mpdSource{addr: addr, password: sc.Password}, nil
+	case "snapcast":
+		addr := sc.Addr
+		if addr == "" {
+			addr = "localhost:1705"
+		}
+		client := sc.Client
+		if client == "" && sc.Group == "" {
+			var err error
+			if client, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("snapcast source needs client or group: %v", err)
+			}
+		}
+		return &snapcastSource{addr: addr, client: client, group: sc.Group}, nil
+	case "librespot":
+		return &librespotSource{events: make(chan string, 16)}, nil
+	case "gpio":
+		return &gpioSource{pin: sc.Pin, activeLow: sc.ActiveLow}, nil
+	case "cast":
+		if sc.Addr == "" {
+			return nil, fmt.Errorf("cast source needs addr")
+		}
+		addr := sc.Addr
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "8009")
+		}
+		return &castSource{addr: addr}, nil
+	case "sonos":
+		if sc.Addr == "" {
+			return nil, fmt.Errorf("sonos source needs addr")
+		}
+		addr := sc.Addr
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "1400")
+		}
+		return &upnpSource{eventURL: "http://" + addr + "/MediaRenderer/AVTransport/Event"}, nil
+	case "dlna":
+		if sc.Renderer == "" && sc.URL == "" {
+			return nil, fmt.Errorf("dlna source needs renderer or url")
+		}
+		return &upnpSource{renderer: sc.Renderer, location: sc.URL}, nil
+	case "plug":
+		if sc.Plug == nil || sc.Watts <= 0 {
+			return nil, fmt.Errorf("plug source needs plug and watts")
+		}
+		p, err := newPlug(sc.Plug)
+		if err != nil {
+			return nil, err
+		}
+		poll := time.Duration(sc.Poll)
+		if poll <= 0 {
+			poll = 2 * time.Second
+		}
+		return &plugSource{plug: p, watts: sc.Watts, poll: poll}, nil
+	case "spdif":
+		poll := time.Duration(sc.Poll)
+		if poll <= 0 {
+			poll = spdifPoll
+		}
+		return &spdifSource{mixer: capture.MixerFor(sc.Device, sc.Control), poll: poll}, nil
+	}
+	return nil, fmt.Errorf("unknown source type %q", sc.Type)
+}
+
+// setSources sets up m's activity sources and the rules for judging
+// them from mc. A single "source" is named "source".
+func (m *monitor) setSources(mc *monitorConfig) error {
+	scs := make(map[string]*sourceConfig)
+	for name, sc := range mc.Sources {
+		scs[name] = sc
+	}
+	on := mc.On
+	if sc := mc.Source; sc != nil {
+		if scs["source"] != nil {
+			return fmt.Errorf("both source and a source named \"source\"")
+		}
+		scs["source"] = sc
+		if on == "" {
+			switch sc.Combine {
+			case "":
+				on = "source"
+			case "and", "or":
+				on = "audio " + sc.Combine + " source"
+			default:
+				return fmt.Errorf("source: bad combine %q; want \"and\" or \"or\"", sc.Combine)
+			}
+		}
+	}
+	var names []string
+	m.sources = make(map[string]activitySource)
+	for name, sc := range scs {
+		if name == "audio" {
+			return fmt.Errorf("a source can't be called \"audio\"")
+		}
+		src, err := newSource(sc)
+		if err != nil {
+			return fmt.Errorf("source %s: %v", name, err)
+		}
+		m.sources[name] = src
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if on == "" && len(names) > 0 {
+		on = strings.Join(names, " or ")
+	}
+	m.sourcePlaying = make(map[string]bool)
+	m.sourceChanged = make(chan struct{}, 1)
+	m.usesAudio = true
+	if on == "" {
+		if mc.Off != "" {
+			return fmt.Errorf("an off rule needs sources or an on rule")
+		}
+		return nil
+	}
+	for _, r := range []struct {
+		rule string
+		e    **boolExpr
+	}{{on, &m.on}, {mc.Off, &m.off}} {
+		if r.rule == "" {
+			continue
+		}
+		e, err := parseBoolExpr(r.rule)
+		if err != nil {
+			return err
+		}
+		for _, n := range e.names {
+			if _, ok := m.sources[n]; !ok && n != "audio" {
+				return fmt.Errorf("rule %q: no source %q", r.rule, n)
+			}
+		}
+		*r.e = e
+	}
+	m.usesAudio = m.on.mentions("audio") || m.off != nil && m.off.mentions("audio")
+	return nil
+}
+
+// sourceSubsystem returns the health subsystem name of the source
+// name.
+func sourceSubsystem(name string) string {
+	if name == "source" {
+		return name
+	}
+	return "source/" + name
+}
+
+// inputsPlaying returns what each of m's sources last said. m.mu
+// must be held.
+func (m *monitor) inputsPlaying() map[string]bool {
+	playing := make(map[string]bool)
+	for name, p := range m.sourcePlaying {
+		playing[name] = p
+	}
+	return playing
+}
+
+// judge applies m's rules to what its inputs say as of end and feeds
+// the verdict to its detector: music's playing if the on rule holds,
+// and while the off rule doesn't hold, the amps don't idle off. m.mu
+// must be held.
+func (m *monitor) judge(playing map[string]bool, end time.Time) detect.Result {
+	on, hold := m.on.eval(playing), false
+	if m.off != nil {
+		hold = !m.off.eval(playing)
+	}
+	if hold && !on {
+		m.det.Touch(end)
+	}
+	return m.det.Activity(on, end)
+}
+
+// sourceTick is how often a monitor without audio re-judges its
+// sources, for idle timeouts, when none changes.
+const sourceTick = time.Second
+
+// watchSource returns a func that notes what m's source name says
+// until it fails, after which it counts as not playing.
+func (m *monitor) watchSource(name string) func() error {
+	return func() error {
+		setHealth(m.subsystem(sourceSubsystem(name)), nil)
+		err := m.sources[name].watch(func(p bool) {
+			m.logf(levelDebug, "source %q says playing = %v", name, p)
+			m.setSourcePlaying(name, p)
+		})
+		m.setSourcePlaying(name, false)
+		return err
+	}
+}
+
+func (m *monitor) setSourcePlaying(name string, p bool) {
+	m.mu.Lock()
+	m.sourcePlaying[name] = p
+	m.mu.Unlock()
+	select {
+	case m.sourceChanged <- struct{}{}:
+	default:
+	}
+}
+
+// watchSources manages m's amps from its sources alone, forever.
+func (m *monitor) watchSources() {
+	t := time.NewTicker(sourceTick)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.sourceChanged:
+		case <-t.C:
+		}
+		m.handleActivity(time.Now())
+	}
+}
+
+// airplaySource reads shairport-sync's metadata pipe, where playback
+// starting, resuming, pausing and ending are reported as items like
+//
+//	<item><type>73736e63</type><code>70626567</code><length>0</length></item>
+//
+// with the type "ssnc" and the code "pbeg", in hex.
+type airplaySource struct {
+	path string
+}
+
+var airplayItem = regexp.MustCompile(`<type>([0-9a-f]{8})</type><code>([0-9a-f]{8})</code>`)
+
+func (s *airplaySource) watch(playing func(bool)) error {
+	f, err := os.Open(s.path) // blocks until shairport-sync opens its end
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var item []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		item = append(item, bytes.TrimSpace(line)...)
+		if bytes.HasSuffix(item, []byte("</item>")) {
+			if m := airplayItem.FindSubmatch(item); m != nil && string(m[1]) == "73736e63" {
+				switch string(m[2]) {
+				case "70626567", "7072736d": // pbeg, prsm
+					playing(true)
+				case "70656e64", "70666c73": // pend, pfls
+					playing(false)
+				}
+			}
+			item = item[:0]
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%s closed", s.path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// httpSource polls a URL.
+type httpSource struct {
+	url   string
+	match *regexp.Regexp
+	poll  time.Duration
+}
+
+func (s *httpSource) watch(playing func(bool)) error {
+	c := &http.Client{Timeout: s.poll}
+	for {
+		res, err := c.Get(s.url)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", s.url, res.Status)
+		}
+		playing(s.match.Match(body))
+		time.Sleep(s.poll)
+	}
+}
+
+// mpdSource asks an MPD server for its player state, then waits in
+// "idle player" for it to change.
+type mpdSource struct {
+	addr     string
+	password string
+}
+
+func (s *mpdSource) watch(playing func(bool)) error {
+	c, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK MPD ") {
+		return fmt.Errorf("%s isn't MPD: %q", s.addr, strings.TrimSpace(line))
+	}
+	// cmd sends an MPD command and returns its "key: value" reply
+	// lines.
+	cmd := func(cmd string) (map[string]string, error) {
+		if _, err := fmt.Fprintf(c, "%s\n", cmd); err != nil {
+			return nil, err
+		}
+		kv := make(map[string]string)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			line = strings.TrimRight(line, "\n")
+			if line == "OK" {
+				return kv, nil
+			}
+			if strings.HasPrefix(line, "ACK ") {
+				return nil, fmt.Errorf("MPD %s: %s", strings.Fields(cmd)[0], line)
+			}
+			if k, v, ok := strings.Cut(line, ": "); ok {
+				kv[k] = v
+			}
+		}
+	}
+	if s.password != "" {
+		if _, err := cmd("password " + mpdQuote(s.password)); err != nil {
+			return err
+		}
+	}
+	for {
+		st, err := cmd("status")
+		if err != nil {
+			return err
+		}
+		playing(st["state"] == "play")
+		if _, err := cmd("idle player"); err != nil {
+			return err
+		}
+	}
+}
+
+// mpdQuote quotes an MPD command argument, so it can hold spaces,
+// quotes and backslashes.
+func mpdQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// snapcastSource asks a Snapcast server, over its JSON-RPC control
+// port, whether a client's group is playing, and asks again whenever
+// the server sends a notification.
+type snapcastSource struct {
+	addr   string
+	client string
+	group  string
+}
+
+type snapcastStatus struct {
+	Server struct {
+		Groups []struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Muted    bool   `json:"muted"`
+			StreamID string `json:"stream_id"`
+			Clients  []struct {
+				ID        string `json:"id"`
+				Connected bool   `json:"connected"`
+				Host      struct {
+					Name string `json:"name"`
+				} `json:"host"`
+				Config struct {
+					Name   string `json:"name"`
+					Volume struct {
+						Muted bool `json:"muted"`
+					} `json:"volume"`
+				} `json:"config"`
+			} `json:"clients"`
+		} `json:"groups"`
+		Streams []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"streams"`
+	} `json:"server"`
+}
+
+// playing reports whether s's client or group is playing in st.
+func (s *snapcastSource) playing(st *snapcastStatus) (bool, error) {
+	for _, g := range st.Server.Groups {
+		muted := g.Muted
+		found := s.group != "" && (g.ID == s.group || g.Name == s.group)
+		for _, c := range g.Clients {
+			if s.client != "" && (c.ID == s.client || c.Config.Name == s.client || c.Host.Name == s.client) {
+				found = true
+				muted = muted || c.Config.Volume.Muted || !c.Connected
+			}
+		}
+		if !found {
+			continue
+		}
+		for _, str := range st.Server.Streams {
+			if str.ID == g.StreamID {
+				return str.Status == "playing" && !muted, nil
+			}
+		}
+		return false, nil
+	}
+	if s.client != "" {
+		return false, fmt.Errorf("snapcast client %q not found", s.client)
+	}
+	return false, fmt.Errorf("snapcast group %q not found", s.group)
+}
+
+func (s *snapcastSource) watch(playing func(bool)) error {
+	c, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	dec := json.NewDecoder(c)
+	for id := 1; ; id++ {
+		if _, err := fmt.Fprintf(c, `{"id":%d,"jsonrpc":"2.0","method":"Server.GetStatus"}`+"\r\n", id); err != nil {
+			return err
+		}
+		// Read until our reply, then until any notification says
+		// something changed.
+		var replied bool
+		for {
+			var msg struct {
+				ID     int              `json:"id"`
+				Method string           `json:"method"`
+				Result *snapcastStatus  `json:"result"`
+				Error  *json.RawMessage `json:"error"`
+			}
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			if msg.ID == id {
+				if msg.Error != nil {
+					return fmt.Errorf("snapcast Server.GetStatus: %s", *msg.Error)
+				}
+				if msg.Result == nil {
+					return fmt.Errorf("snapcast Server.GetStatus: no result")
+				}
+				p, err := s.playing(msg.Result)
+				if err != nil {
+					return err
+				}
+				playing(p)
+				replied = true
+				continue
+			}
+			if replied && msg.Method != "" {
+				break
+			}
+		}
+	}
+}
+
+// librespotSource gets librespot's player events, as posted to
+// /librespot by its --onevent hook.
+type librespotSource struct {
+	events chan string
+}
+
+func (s *librespotSource) watch(playing func(bool)) error {
+	for {
+		switch <-s.events {
+		case "started", "loading", "playing":
+			playing(true)
+		case "paused", "stopped", "session_disconnected":
+			playing(false)
+		}
+	}
+}
+
+// serveLibrespot takes a librespot player event, the event parameter,
+// for the librespot sources of the selected monitors.
+func serveLibrespot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	ev := r.FormValue("event")
+	if ev == "" {
+		http.Error(w, "missing event", http.StatusBadRequest)
+		return
+	}
+	n := 0
+	for _, m := range selectedMonitors(r) {
+		for _, src := range m.sources {
+			if s, ok := src.(*librespotSource); ok {
+				select {
+				case s.events <- ev:
+				default:
+					m.logf(levelWarn, "dropping librespot event %q; too many queued", ev)
+				}
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		http.Error(w, "no monitor with a librespot source", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
+
+// gpioSource polls a GPIO input.
+type gpioSource struct {
+	pin       int
+	activeLow bool
+}
+
+const gpioPoll = 100 * time.Millisecond
+
+func (s *gpioSource) watch(playing func(bool)) error {
+	value, err := amp.ExportGPIO(s.pin, "in", s.activeLow)
+	if err != nil {
+		return err
+	}
+	var last, known bool
+	for {
+		p, err := amp.ReadGPIO(value)
+		if err != nil {
+			return err
+		}
+		if !known || p != last {
+			playing(p)
+			last, known = p, true
+		}
+		time.Sleep(gpioPoll)
+	}
+}
+
+// plugSource polls an energy-monitoring plug.
+type plugSource struct {
+	plug  *plug
+	watts float64
+	poll  time.Duration
+}
+
+func (s *plugSource) watch(playing func(bool)) error {
+	for {
+		w, err := s.plug.watts()
+		if err != nil {
+			return err
+		}
+		playing(w > s.watts)
+		time.Sleep(s.poll)
+	}
+}
+
+// spdifSource polls an S/PDIF input's signal status.
+type spdifSource struct {
+	mixer capture.Mixer
+	poll  time.Duration
+}
+
+const spdifPoll = 250 * time.Millisecond
+
+func (s *spdifSource) watch(playing func(bool)) error {
+	var last, known bool
+	for {
+		p, err := s.mixer.SPDIFLocked()
+		if err != nil {
+			return err
+		}
+		if !known || p != last {
+			playing(p)
+			last, known = p, true
+		}
+		time.Sleep(s.poll)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import "testing"
+
+func TestMPDQuote(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"hunter2", `"hunter2"`},
+		{"two words", `"two words"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+	} {
+		if got := mpdQuote(tt.in); got != tt.want {
+			t.Errorf("mpdQuote(%q) = %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
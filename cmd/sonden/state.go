@@ -0,0 +1,111 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// What sonden learns about its inputs is kept across restarts in the
+// -state file.
+
+var stateFile = flag.String("state", "", "if non-empty, file to keep learned parameters in across restarts")
+
+// monitorState is what's remembered about one monitor.
+type monitorState struct {
+	Threshold  float64   `json:"threshold,omitempty"` // learned by -auto-threshold
+	NoiseFloor float64   `json:"noise_floor,omitempty"`
+	LearnedAt  time.Time `json:"learned_at,omitempty"`
+
+	Amps map[string]*ampPower `json:"amps,omitempty"` // by amp name; see measure
+
+	KeptOffHours map[string]float64 `json:"kept_off_hours,omitempty"` // by amp name; see savings.go
+
+	Tuned *tunedState `json:"tuned,omitempty"` // by /tune?persist=1
+}
+
+// tunedState is the detection parameters tuned and kept, which
+// override the configured ones.
+type tunedState struct {
+	Threshold float64  `json:"threshold,omitempty"`
+	Idle      duration `json:"idle,omitempty"`
+	Playing   duration `json:"playing,omitempty"`
+	Window    duration `json:"window,omitempty"`
+	Hop       duration `json:"hop,omitempty"`
+}
+
+func (ts *tunedState) tuning() tuning {
+	return tuning{
+		threshold: ts.Threshold,
+		idle:      time.Duration(ts.Idle),
+		playing:   time.Duration(ts.Playing),
+		window:    time.Duration(ts.Window),
+		hop:       time.Duration(ts.Hop),
+	}
+}
+
+var (
+	stateMu sync.Mutex
+	state   map[string]*monitorState // by monitor name; nil until loaded
+)
+
+// loadState returns the remembered state of the named monitor, or nil.
+// It mustn't be changed; see updateState.
+func loadState(name string) *monitorState {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return loadStateLocked(name)
+}
+
+// loadStateLocked is loadState with stateMu held.
+func loadStateLocked(name string) *monitorState {
+	if state == nil {
+		state = make(map[string]*monitorState)
+		if *stateFile != "" {
+			if b, err := os.ReadFile(*stateFile); err == nil {
+				if err := json.Unmarshal(b, &state); err != nil {
+					warnf("ignoring bad -state file %s: %v", *stateFile, err)
+				}
+			} else if !os.IsNotExist(err) {
+				warnf("reading -state file: %v", err)
+			}
+		}
+	}
+	return state[name]
+}
+
+// updateState changes the remembered state of the named monitor with
+// f, which gets a copy of it to change, and saves it. f runs with
+// stateMu held, so that concurrent updates of different fields don't
+// undo each other; it mustn't take mu. Maps in the copy are shared
+// with the old state, so f must replace rather than change them.
+func updateState(name string, f func(*monitorState)) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	ms := new(monitorState)
+	if old := loadStateLocked(name); old != nil {
+		*ms = *old
+	}
+	f(ms)
+	state[name] = ms
+	if *stateFile == "" {
+		return
+	}
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err == nil {
+		tmp := filepath.Join(filepath.Dir(*stateFile), "."+filepath.Base(*stateFile)+".tmp")
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, *stateFile)
+		}
+	}
+	setHealth("state", err)
+	if err != nil {
+		errorf("saving -state: %v", err)
+	}
+}
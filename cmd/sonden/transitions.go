@@ -0,0 +1,102 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every time a monitor switches its amps, it records why: the reason
+// code, the rule that fired, and the level and threshold it fired on,
+// for answering "why did it turn off during the quiet movement?". They're
+// served as /transitions and logged when the daemon exits.
+
+var transitionLogSize = flag.Int("transition-log", 1000, "how many of the amps' last transitions to keep in memory for /transitions")
+
+// A transition is a monitor switching its amps on or off.
+type transition struct {
+	Time      time.Time `json:"time"`
+	Monitor   string    `json:"monitor,omitempty"`
+	State     string    `json:"state"` // "on" or "off"
+	Reason    string    `json:"reason"`
+	Rule      string    `json:"rule"`                // what fired, like "silent for 5m0s (idle 5m0s)"
+	Level     float64   `json:"level,omitempty"`     // of the window it fired on, if audio
+	Threshold float64   `json:"threshold,omitempty"` // in effect then
+}
+
+// A decision is why act is about to switch the amps, for the
+// transition setAmps records if they do switch.
+type decision struct {
+	reason    string
+	rule      string
+	level     float64
+	threshold float64
+}
+
+var (
+	transitionsMu sync.Mutex
+	transitions   []transition // oldest first
+)
+
+func recordTransition(t transition) {
+	transitionsMu.Lock()
+	defer transitionsMu.Unlock()
+	transitions = append(transitions, t)
+	if n := *transitionLogSize; len(transitions) > 2*n {
+		transitions = append([]transition(nil), transitions[len(transitions)-n:]...)
+	}
+}
+
+// serveTransitions returns the transitions as JSON, oldest first: the
+// last n (default all kept), optionally only those of one monitor.
+func serveTransitions(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.FormValue("n"))
+	name := r.FormValue("monitor")
+	transitionsMu.Lock()
+	ts := []transition{}
+	for _, t := range transitions {
+		if name == "" || t.Monitor == name {
+			ts = append(ts, t)
+		}
+	}
+	transitionsMu.Unlock()
+	if n > 0 && len(ts) > n {
+		ts = ts[len(ts)-n:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ts)
+}
+
+// logTransitions logs the last transitions kept, oldest first.
+func logTransitions() {
+	transitionsMu.Lock()
+	defer transitionsMu.Unlock()
+	ts := transitions
+	if len(ts) > *transitionLogSize {
+		ts = ts[len(ts)-*transitionLogSize:]
+	}
+	for _, t := range ts {
+		j, _ := json.Marshal(t)
+		infof("transition: %s", j)
+	}
+}
+
+// logTransitionsOnExit logs the transitions when the daemon is
+// interrupted or terminated, then exits.
+func logTransitionsOnExit() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	infof("%v; exiting", sig)
+	logTransitions()
+	os.Exit(0)
+}
@@ -0,0 +1,291 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upnpSource watches a UPnP media renderer's AVTransport service. It
+// subscribes to the service's events (GENA), serving the callback
+// itself, and music's playing while the LastChange events say the
+// TransportState is PLAYING or TRANSITIONING.
+type upnpSource struct {
+	eventURL string // the AVTransport service's eventSubURL
+
+	// Without an eventURL, the renderer's found each time it's
+	// watched, so it may change address: the one with friendly
+	// name or UDN renderer, described at location, else found by
+	// SSDP.
+	renderer string
+	location string
+}
+
+const upnpTimeout = 30 * time.Minute // asked for; renewed at half what's granted
+
+var upnpClient = &http.Client{Timeout: 10 * time.Second}
+
+func (s *upnpSource) watch(playing func(bool)) error {
+	eventURL := s.eventURL
+	if eventURL == "" {
+		var err error
+		if eventURL, err = s.find(); err != nil {
+			return err
+		}
+	}
+	u, err := url.Parse(eventURL)
+	if err != nil {
+		return err
+	}
+	// Listen on the address the renderer will see us at.
+	c, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return err
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+	ln, err := net.Listen("tcp", net.JoinHostPort(local.String(), "0"))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	states := make(chan string)
+	done := make(chan bool)
+	defer close(done)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "NOTIFY" {
+				http.Error(w, "NOTIFY required", http.StatusMethodNotAllowed)
+				return
+			}
+			b, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			st := upnpTransportState(b)
+			if st == "" {
+				return // something else changed
+			}
+			select {
+			case states <- st:
+			case <-done:
+			}
+		}))
+	}()
+
+	sid, granted, err := upnpSubscribe(eventURL, "", "http://"+ln.Addr().String()+"/")
+	if err != nil {
+		return err
+	}
+	defer upnpUnsubscribe(eventURL, sid)
+	renew := time.NewTimer(granted / 2)
+	defer renew.Stop()
+	for {
+		select {
+		case st := <-states:
+			playing(st == "PLAYING" || st == "TRANSITIONING")
+		case err := <-errc:
+			return err
+		case <-renew.C:
+			if sid, granted, err = upnpSubscribe(eventURL, sid, ""); err != nil {
+				return fmt.Errorf("renewing subscription: %v", err)
+			}
+			renew.Reset(granted / 2)
+		}
+	}
+}
+
+// upnpSubscribe subscribes to eventURL's events, sent to callback, or
+// with callback empty renews subscription sid. It returns the
+// subscription's ID and how long it lasts.
+func upnpSubscribe(eventURL, sid, callback string) (string, time.Duration, error) {
+	req, err := http.NewRequest("SUBSCRIBE", eventURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if callback != "" {
+		req.Header.Set("CALLBACK", "<"+callback+">")
+		req.Header.Set("NT", "upnp:event")
+	} else {
+		req.Header.Set("SID", sid)
+	}
+	req.Header.Set("TIMEOUT", fmt.Sprintf("Second-%d", int(upnpTimeout/time.Second)))
+	res, err := upnpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("SUBSCRIBE %s: %s", eventURL, res.Status)
+	}
+	if sid = res.Header.Get("SID"); sid == "" {
+		return "", 0, fmt.Errorf("SUBSCRIBE %s: no SID in reply", eventURL)
+	}
+	d := upnpTimeout
+	if n, err := strconv.Atoi(strings.TrimPrefix(res.Header.Get("TIMEOUT"), "Second-")); err == nil && n > 0 {
+		d = time.Duration(n) * time.Second
+	}
+	return sid, d, nil
+}
+
+func upnpUnsubscribe(eventURL, sid string) {
+	req, err := http.NewRequest("UNSUBSCRIBE", eventURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("SID", sid)
+	if res, err := upnpClient.Do(req); err == nil {
+		res.Body.Close()
+	}
+}
+
+var upnpStateRx = regexp.MustCompile(`<TransportState\s+val="([A-Z_]+)"`)
+
+// upnpTransportState returns the TransportState in an AVTransport
+// event's LastChange, or "" if it has none.
+func upnpTransportState(body []byte) string {
+	var ps struct {
+		Property []struct {
+			LastChange string
+		} `xml:"property"`
+	}
+	if xml.Unmarshal(body, &ps) != nil {
+		return ""
+	}
+	for _, p := range ps.Property {
+		if m := upnpStateRx.FindStringSubmatch(p.LastChange); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+const upnpAVTransport = "urn:schemas-upnp-org:service:AVTransport:1"
+
+// A upnpDevice is the part of a UPnP device description we use.
+type upnpDevice struct {
+	FriendlyName string `xml:"friendlyName"`
+	Manufacturer string `xml:"manufacturer"`
+	ModelName    string `xml:"modelName"`
+	UDN          string `xml:"UDN"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		EventSubURL string `xml:"eventSubURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the AVTransport eventSubURL of s's renderer.
+func (s *upnpSource) find() (string, error) {
+	locs := []string{s.location}
+	if s.location == "" {
+		var err error
+		if locs, err = ssdpSearch(upnpAVTransport); err != nil {
+			return "", err
+		}
+	}
+	var seen []string
+	for _, loc := range locs {
+		res, err := upnpClient.Get(loc)
+		if err != nil {
+			continue
+		}
+		var desc struct {
+			URLBase string     `xml:"URLBase"`
+			Device  upnpDevice `xml:"device"`
+		}
+		err = xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&desc)
+		res.Body.Close()
+		if err != nil {
+			continue
+		}
+		base, err := url.Parse(loc)
+		if err != nil {
+			continue
+		}
+		if desc.URLBase != "" {
+			if b, err := base.Parse(desc.URLBase); err == nil {
+				base = b
+			}
+		}
+		var found string
+		var walk func(d *upnpDevice)
+		walk = func(d *upnpDevice) {
+			for _, sv := range d.Services {
+				if found != "" || sv.ServiceType != upnpAVTransport {
+					continue
+				}
+				seen = append(seen, fmt.Sprintf("%q (%s)", d.FriendlyName, d.UDN))
+				if s.renderer == "" || strings.EqualFold(d.FriendlyName, s.renderer) ||
+					d.UDN == s.renderer || d.UDN == "uuid:"+s.renderer {
+					if u, err := base.Parse(sv.EventSubURL); err == nil {
+						found = u.String()
+					}
+				}
+			}
+			for i := range d.Devices {
+				walk(&d.Devices[i])
+			}
+		}
+		walk(&desc.Device)
+		if found != "" {
+			return found, nil
+		}
+	}
+	if len(seen) == 0 {
+		return "", fmt.Errorf("no DLNA renderers found")
+	}
+	return "", fmt.Errorf("no DLNA renderer %q; found %s", s.renderer, strings.Join(seen, ", "))
+}
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// ssdpSearch multicasts an SSDP search for devices with the service
+// st and returns the description URLs of those that answer.
+func ssdpSearch(st string) ([]string, error) {
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + st + "\r\n\r\n"
+	for i := 0; i < 2; i++ { // it's UDP; say it twice
+		if _, err := c.WriteTo([]byte(req), ssdpAddr); err != nil {
+			return nil, err
+		}
+	}
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var locs []string
+	have := make(map[string]bool)
+	buf := make([]byte, 8<<10)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			break // the deadline
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if loc := res.Header.Get("Location"); loc != "" && !have[loc] {
+			have[loc] = true
+			locs = append(locs, loc)
+		}
+	}
+	return locs, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage accounting: how long each amp has been on, charged to the
+// input it was on, from what -poll sees. It settles arguments about
+// who leaves the stereo on.
+
+var weeklySummary = flag.String("weekly-summary", "Sun 18:00", "when to send the weekly_summary event of how long the amps were on for each input; empty for never")
+
+var maxUsageInputs = flag.Int("max-usage-inputs", 32, "most inputs of each amp to account on-time to separately; the rest is charged to \"other\"")
+
+// unknownInput is what on-time is charged to when the amp's input
+// couldn't be queried, and otherInput what it's charged to once an
+// amp has had -max-usage-inputs inputs, which for a streamer that
+// reports what it's playing as its input could be any number.
+const (
+	unknownInput = "unknown"
+	otherInput   = "other"
+)
+
+type usageKey struct {
+	addr  string
+	zone  int
+	input string
+}
+
+type usageSample struct {
+	t     time.Time
+	on    bool
+	input string
+}
+
+var (
+	usageMu    sync.Mutex
+	usageTotal = make(map[usageKey]time.Duration) // since startup, for /metrics
+	usageWeek  = make(map[usageKey]time.Duration) // since the last weekly summary
+	weekStart  = time.Now()                       // of usageWeek
+	usageLast  = make(map[*managedAmp]usageSample)
+)
+
+// recordUsage notes that at t amp was on or off, and on input,
+// charging the time since its previous sample to the input it was on
+// then.
+func recordUsage(amp *managedAmp, on bool, input string, t time.Time) {
+	if input == "" {
+		input = unknownInput
+	}
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if last, ok := usageLast[amp]; ok && last.on && t.After(last.t) {
+		k := usageKey{amp.Addr(), amp.zone, last.input}
+		if _, ok := usageTotal[k]; !ok && usageInputs(amp) >= *maxUsageInputs {
+			k.input = otherInput
+		}
+		usageTotal[k] += t.Sub(last.t)
+		usageWeek[k] += t.Sub(last.t)
+	}
+	usageLast[amp] = usageSample{t, on, input}
+}
+
+// usageInputs returns how many inputs amp has been charged on-time
+// to. usageMu must be held.
+func usageInputs(amp *managedAmp) int {
+	n := 0
+	for k := range usageTotal {
+		if k.addr == amp.Addr() && k.zone == amp.zone {
+			n++
+		}
+	}
+	return n
+}
+
+// inputUsage returns the on-time per input of all amps in u.
+func inputUsage(u map[usageKey]time.Duration) map[string]time.Duration {
+	byInput := make(map[string]time.Duration)
+	for k, d := range u {
+		byInput[k.input] += d
+	}
+	return byInput
+}
+
+// sendWeeklySummaries publishes a weekly_summary event at each
+// occurrence of the -weekly-summary time.
+func sendWeeklySummaries() {
+	wt, err := parseWeeklyTime(*weeklySummary)
+	if err != nil {
+		errorf("bad -weekly-summary: %v", err)
+		return
+	}
+	for {
+		time.Sleep(time.Until(wt.next(time.Now())))
+		now := time.Now()
+		usageMu.Lock()
+		week := inputUsage(usageWeek)
+		kwh := energyUsed(usageWeek, now.Sub(weekStart))
+		usageWeek = make(map[usageKey]time.Duration)
+		weekStart = now
+		usageMu.Unlock()
+		ev := event{Type: "weekly_summary", Usage: make(map[string]float64), Energy: kwh}
+		for in, d := range week {
+			ev.Usage[in] = d.Seconds()
+		}
+		infof("Weekly summary: %s; %.1f kWh", formatUsage(ev.Usage), kwh)
+		publish(ev)
+	}
+}
+
+// energyUsed estimates the kWh the amps used over a period of length
+// d in which they were on as in u, from their on and standby watts.
+func energyUsed(u map[usageKey]time.Duration, d time.Duration) float64 {
+	var wh float64
+	for _, m := range monitors {
+		for _, amp := range m.amps {
+			var on time.Duration
+			for k, t := range u {
+				if k.addr == amp.Addr() && k.zone == amp.zone {
+					on += t
+				}
+			}
+			if on > d {
+				on = d
+			}
+			wh += on.Hours()*amp.onWatts() + (d-on).Hours()*amp.standbyWatts()
+		}
+	}
+	return wh / 1000
+}
+
+// formatUsage formats seconds per input like "CD 3h20m, TV 1h5m",
+// biggest first.
+func formatUsage(u map[string]float64) string {
+	var ins []string
+	for in := range u {
+		ins = append(ins, in)
+	}
+	sort.Slice(ins, func(i, j int) bool { return u[ins[i]] > u[ins[j]] })
+	var parts []string
+	for _, in := range ins {
+		d := time.Duration(u[in] * float64(time.Second)).Round(time.Minute)
+		s := strings.TrimSuffix(d.String(), "0s")
+		if s == "" {
+			s = "0m"
+		}
+		parts = append(parts, in+" "+s)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// serveMetrics serves counters in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	usageMu.Lock()
+	var keys []usageKey
+	for k := range usageTotal {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.addr != b.addr {
+			return a.addr < b.addr
+		}
+		if a.zone != b.zone {
+			return a.zone < b.zone
+		}
+		return a.input < b.input
+	})
+	fmt.Fprintf(w, "# HELP sonden_amp_on_seconds_total Time each amp has been on, by the input it was on.\n")
+	fmt.Fprintf(w, "# TYPE sonden_amp_on_seconds_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "sonden_amp_on_seconds_total{amp=%q,zone=\"%d\",input=%q} %v\n", k.addr, k.zone, k.input, usageTotal[k].Seconds())
+	}
+	usageMu.Unlock()
+	fmt.Fprintf(w, "# HELP sonden_amp_watts Power each amp draws on and in standby, as measured or configured.\n")
+	fmt.Fprintf(w, "# TYPE sonden_amp_watts gauge\n")
+	for _, m := range monitors {
+		for _, amp := range m.amps {
+			fmt.Fprintf(w, "sonden_amp_watts{amp=%q,zone=\"%d\",state=\"on\"} %v\n", amp.Addr(), amp.zone, amp.onWatts())
+			fmt.Fprintf(w, "sonden_amp_watts{amp=%q,zone=\"%d\",state=\"standby\"} %v\n", amp.Addr(), amp.zone, amp.standbyWatts())
+		}
+	}
+	fmt.Fprintf(w, "# HELP sonden_input_clip_events_total Times each monitor's audio input started clipping.\n")
+	fmt.Fprintf(w, "# TYPE sonden_input_clip_events_total counter\n")
+	for _, m := range monitors {
+		if st := m.inputStatus(time.Now()); st != nil {
+			fmt.Fprintf(w, "sonden_input_clip_events_total{monitor=%q} %v\n", m.name, st.ClipEvents)
+		}
+	}
+	fmt.Fprintf(w, "# HELP sonden_input_clipped_samples_total Samples of each monitor's audio input at full scale.\n")
+	fmt.Fprintf(w, "# TYPE sonden_input_clipped_samples_total counter\n")
+	for _, m := range monitors {
+		if st := m.inputStatus(time.Now()); st != nil {
+			fmt.Fprintf(w, "sonden_input_clipped_samples_total{monitor=%q} %v\n", m.name, st.Clipped)
+		}
+	}
+	fmt.Fprintf(w, "# HELP sonden_energy_saved_kwh_total Estimated energy saved by keeping each amp off.\n")
+	fmt.Fprintf(w, "# TYPE sonden_energy_saved_kwh_total counter\n")
+	for _, s := range savings(time.Now()).Amps {
+		fmt.Fprintf(w, "sonden_energy_saved_kwh_total{amp=%q} %v\n", s.Amp, s.SavedKWh)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhookConfig is a URL to POST to when certain events happen.
+type webhookConfig struct {
+	URL string `json:"url"`
+
+	// Events lists the event types to send, like "amps_on". The
+	// pseudo-type "error" matches any event with an error. Empty
+	// means amps_on, amps_off and errors.
+	Events []string `json:"events"`
+
+	// Body is an optional text/template for the request body,
+	// executed with the event. The default is the event as JSON. The
+	// "json" function quotes a value as JSON, e.g.
+	//   {"text": {{printf "amps %s: %s" .Type .Reason | json}}}
+	Body string `json:"body"`
+
+	ContentType string `json:"content_type"` // default application/json
+}
+
+const (
+	webhookAttempts   = 5
+	webhookTimeout    = 10 * time.Second
+	webhookMaxBackoff = time.Minute
+	webhookBuffer     = 32 // events queued while retrying
+)
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+}
+
+type webhook struct {
+	url         string
+	events      map[string]bool
+	body        *template.Template // or nil
+	contentType string
+}
+
+func newWebhook(wc *webhookConfig) (*webhook, error) {
+	wh := &webhook{
+		url:         wc.URL,
+		events:      make(map[string]bool),
+		contentType: wc.ContentType,
+	}
+	if wh.url == "" {
+		return nil, fmt.Errorf("webhook has no url")
+	}
+	events := wc.Events
+	if len(events) == 0 {
+		events = []string{"amps_on", "amps_off", "error"}
+	}
+	for _, e := range events {
+		wh.events[e] = true
+	}
+	if wc.Body != "" {
+		t, err := template.New(wc.URL).Funcs(webhookFuncs).Parse(wc.Body)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %v", wc.URL, err)
+		}
+		wh.body = t
+	}
+	if wh.contentType == "" {
+		wh.contentType = "application/json"
+	}
+	return wh, nil
+}
+
+func (wh *webhook) wants(ev event) bool {
+	return wh.events[ev.Type] || (ev.Error != "" && wh.events["error"])
+}
+
+// start delivers events to the webhook until its subscription,
+// which it returns, is cancelled.
+func (wh *webhook) start() *subscriber {
+	sub := subscribe("webhook "+wh.url, webhookBuffer, dropOldest, wh.wants)
+	go func() {
+		for ev := range sub.C {
+			wh.deliver(ev)
+		}
+	}()
+	return sub
+}
+
+// deliver POSTs ev, retrying with exponential backoff on failure.
+func (wh *webhook) deliver(ev event) {
+	var body bytes.Buffer
+	if wh.body != nil {
+		if err := wh.body.Execute(&body, ev); err != nil {
+			errorf("webhook %s: executing body template: %v", wh.url, err)
+			return
+		}
+	} else {
+		json.NewEncoder(&body).Encode(ev)
+	}
+	err := withRetry("webhook "+wh.url, func() error {
+		req, err := http.NewRequest("POST", wh.url, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", wh.contentType)
+		return doRequest(req)
+	})
+	if err != nil {
+		errorf("webhook %s: giving up on %s event: %v", wh.url, ev.Type, err)
+		return
+	}
+	debugf("webhook %s: sent %s event", wh.url, ev.Type)
+}
+
+// withRetry calls f until it succeeds, up to webhookAttempts times
+// with exponential backoff, and returns its last error.
+func withRetry(what string, f func() error) error {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		warnf("%s: %v; retrying in %v", what, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// A Stage is one step of an analysis Chain. It takes values one at a
+// time and returns its output as it has some: filters return a value
+// for every input, and window stages one per window.
+type Stage interface {
+	Process(x float64) (y float64, ok bool)
+}
+
+// A Chain is an analysis pipeline from samples to the levels a
+// Detector compares against its threshold.
+type Chain []Stage
+
+// Process feeds sample x through the chain, returning a level if the
+// last stage produced one.
+func (c Chain) Process(x float64) (level float64, ok bool) {
+	for _, s := range c {
+		if x, ok = s.Process(x); !ok {
+			return 0, false
+		}
+	}
+	return x, true
+}
+
+// Migrate carries over as much of old's state into c as is still
+// valid, so changing the analysis doesn't start from an empty window
+// (and look like silence). Stages are migrated in order until one
+// whose output differs from before: the stages after it see different
+// input, so their history means nothing. A window stage keeps its most
+// recent inputs even if its length changed. Migrate returns how many
+// stages kept state.
+func (c Chain) Migrate(old Chain) int {
+	for i, s := range c {
+		m, ok := s.(migrator)
+		if !ok || i >= len(old) {
+			return i
+		}
+		kept, same := m.migrateFrom(old[i])
+		if !kept {
+			return i
+		}
+		if !same {
+			return i + 1
+		}
+	}
+	return len(c)
+}
+
+// A migrator is a Stage that can take over the state of the Stage it
+// replaces. It reports whether it kept any state and whether its
+// output will be the same as old's would have been.
+type migrator interface {
+	migrateFrom(old Stage) (kept, same bool)
+}
+
+// DefaultChain returns the classic analysis: the variance of windows
+// of n samples, every hop samples.
+func DefaultChain(n, hop int) Chain {
+	return Chain{newWindowStage("variance", n, hop)}
+}
+
+// A StageConfig names a stage type and its parameters, as in
+//
+//	{"type": "band-filter", "low": 40, "high": 4000}
+//
+// The types are:
+//
+//	dc-block     remove any DC offset; "r" (default 0.995) is the pole
+//	band-filter  pass only "low" to "high" Hz; either may be left out
+//	gate         replace values below "floor" with zero
+//	variance     variance of each window
+//	rms          root mean square of each window
+//	window       mean of each window
+//	music        variance of each window, or zero if its spectrum is too
+//	             flat for music: if its spectral flatness (see
+//	             Ring.Flatness) is over "max_flatness" (default 0.3), it's
+//	             broadband noise like a fan or rain. Mains hum is tonal;
+//	             filter it out first with a band-filter.
+//	vad          the fraction of each window's 10 ms frames WebRTC's voice
+//	             activity detector finds active, from 0 to 1; "mode" (0 to
+//	             3, default 3) is how aggressively it rejects noise. It's
+//	             only in binaries built with -tags fvad, which need
+//	             libfvad.
+//
+// Window stages take "ms", the window length (default 1000), and
+// "hop_ms", how often to emit a window (default the window length).
+// Times are at the rate of the stage's input, so a window after an
+// rms stage averages levels, not samples.
+type StageConfig struct {
+	Type   string
+	Params map[string]float64
+}
+
+// NewChain builds a chain of stages for samples at rate Hz. It must
+// have at least one window stage.
+func NewChain(stages []StageConfig, rate int) (Chain, error) {
+	var c Chain
+	windowed := false
+	r := float64(rate)
+	for i, sc := range stages {
+		s, hop, err := newStage(sc, r)
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %v", i, sc.Type, err)
+		}
+		if hop > 0 {
+			windowed = true
+			r /= float64(hop)
+		}
+		c = append(c, s)
+	}
+	if !windowed {
+		return nil, errors.New("analysis chain needs a variance, rms, window, music or vad stage")
+	}
+	return c, nil
+}
+
+var stageParams = map[string][]string{
+	"dc-block":    {"r"},
+	"band-filter": {"low", "high"},
+	"gate":        {"floor"},
+	"variance":    {"ms", "hop_ms"},
+	"rms":         {"ms", "hop_ms"},
+	"window":      {"ms", "hop_ms"},
+	"music":       {"ms", "hop_ms", "max_flatness"},
+	"vad":         {"ms", "hop_ms", "mode"},
+}
+
+// newStage returns the stage sc describes for input at rate values
+// per second. For window stages it also returns how many inputs there
+// are per output.
+func newStage(sc StageConfig, rate float64) (s Stage, hop int, err error) {
+	known, ok := stageParams[sc.Type]
+	if !ok {
+		var types []string
+		for t := range stageParams {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return nil, 0, fmt.Errorf("unknown stage type; want one of %s", strings.Join(types, ", "))
+	}
+	for p := range sc.Params {
+		found := false
+		for _, k := range known {
+			found = found || k == p
+		}
+		if !found {
+			return nil, 0, fmt.Errorf("unknown parameter %q", p)
+		}
+	}
+	param := func(name string, def float64) float64 {
+		if v, ok := sc.Params[name]; ok {
+			return v
+		}
+		return def
+	}
+	switch sc.Type {
+	case "dc-block":
+		return &dcBlock{r: param("r", 0.995)}, 0, nil
+	case "band-filter":
+		var f bandFilter
+		if low := param("low", 0); low > 0 {
+			f = append(f, newBiquad(true, low, rate))
+		}
+		if high := param("high", 0); high > 0 {
+			if high >= rate/2 {
+				return nil, 0, fmt.Errorf("high %v Hz is above the Nyquist frequency", high)
+			}
+			f = append(f, newBiquad(false, high, rate))
+		}
+		return f, 0, nil
+	case "gate":
+		return gate(param("floor", 0)), 0, nil
+	}
+	n := int(param("ms", 1000) * rate / 1000)
+	hop = int(param("hop_ms", param("ms", 1000)) * rate / 1000)
+	if n < 1 || hop < 1 {
+		return nil, 0, errors.New("window shorter than one input")
+	}
+	if sc.Type == "vad" {
+		s, err := newVAD(rate, param("ms", 1000), param("hop_ms", param("ms", 1000)), int(param("mode", 3)))
+		return s, hop, err
+	}
+	w := newWindowStage(sc.Type, n, hop)
+	if sc.Type == "music" {
+		w.param = param("max_flatness", 0.3)
+		w.f = func(r *Ring) float64 {
+			if r.Flatness() > w.param {
+				return 0
+			}
+			return r.Variance()
+		}
+	}
+	return w, hop, nil
+}
+
+var windowFuncs = map[string]func(*Ring) float64{
+	"variance": (*Ring).Variance,
+	"rms":      (*Ring).RMS,
+	"window":   (*Ring).Mean,
+}
+
+// windowStage reduces each window of its input to one value.
+type windowStage struct {
+	kind  string // key of windowFuncs
+	ring  *Ring
+	hop   int
+	n     int // inputs since the last output
+	f     func(*Ring) float64
+	param float64 // of f, if any
+}
+
+func newWindowStage(kind string, size, hop int) *windowStage {
+	return &windowStage{kind: kind, ring: NewRing(size), hop: hop, f: windowFuncs[kind]}
+}
+
+func (w *windowStage) migrateFrom(old Stage) (kept, same bool) {
+	o, ok := old.(*windowStage)
+	if !ok {
+		return false, false
+	}
+	for _, v := range o.ring.recent(len(w.ring.vals)) {
+		w.ring.Add(v)
+	}
+	w.n = o.n
+	if w.n >= w.hop {
+		w.n = w.hop - 1
+	}
+	return true, o.kind == w.kind && len(o.ring.vals) == len(w.ring.vals) && o.hop == w.hop && o.param == w.param
+}
+
+func (w *windowStage) Process(x float64) (float64, bool) {
+	w.ring.Add(x)
+	w.n++
+	if w.ring.size < len(w.ring.vals) || w.n < w.hop {
+		return 0, false
+	}
+	w.n = 0
+	return w.f(w.ring), true
+}
+
+// dcBlock is a one-pole DC blocking filter.
+type dcBlock struct {
+	r      float64
+	x1, y1 float64
+}
+
+func (f *dcBlock) migrateFrom(old Stage) (kept, same bool) {
+	o, ok := old.(*dcBlock)
+	if !ok {
+		return false, false
+	}
+	f.x1, f.y1 = o.x1, o.y1
+	return true, o.r == f.r
+}
+
+func (f *dcBlock) Process(x float64) (float64, bool) {
+	y := x - f.x1 + f.r*f.y1
+	f.x1, f.y1 = x, y
+	return y, true
+}
+
+type gate float64
+
+func (g gate) migrateFrom(old Stage) (kept, same bool) {
+	return true, old == Stage(g)
+}
+
+func (g gate) Process(x float64) (float64, bool) {
+	if math.Abs(x) < float64(g) {
+		return 0, true
+	}
+	return x, true
+}
+
+// bandFilter is a high-pass and/or low-pass filter.
+type bandFilter []*biquad
+
+func (f bandFilter) migrateFrom(old Stage) (kept, same bool) {
+	o, ok := old.(bandFilter)
+	if !ok || len(o) != len(f) {
+		return false, false
+	}
+	same = true
+	for i, b := range f {
+		ob := o[i]
+		b.x1, b.x2, b.y1, b.y2 = ob.x1, ob.x2, ob.y1, ob.y2
+		same = same && b.b0 == ob.b0 && b.b1 == ob.b1 && b.b2 == ob.b2 && b.a1 == ob.a1 && b.a2 == ob.a2
+	}
+	return true, same
+}
+
+func (f bandFilter) Process(x float64) (float64, bool) {
+	for _, b := range f {
+		x = b.filter(x)
+	}
+	return x, true
+}
+
+// biquad is a second order Butterworth filter, from the Audio EQ
+// Cookbook.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func newBiquad(highPass bool, freq, rate float64) *biquad {
+	w0 := 2 * math.Pi * freq / rate
+	cos, alpha := math.Cos(w0), math.Sin(w0)/math.Sqrt2 // Q of 1/√2
+	b := new(biquad)
+	if highPass {
+		b.b0, b.b1, b.b2 = (1+cos)/2, -(1 + cos), (1+cos)/2
+	} else {
+		b.b0, b.b1, b.b2 = (1-cos)/2, 1-cos, (1-cos)/2
+	}
+	a0 := 1 + alpha
+	b.b0, b.b1, b.b2 = b.b0/a0, b.b1/a0, b.b2/a0
+	b.a1, b.a2 = -2*cos/a0, (1-alpha)/a0
+	return b
+}
+
+func (b *biquad) filter(x float64) float64 {
+	y := b.b0*x + b.b1*b.x1 + b.b2*b.x2 - b.a1*b.y1 - b.a2*b.y2
+	b.x2, b.x1 = b.x1, x
+	b.y2, b.y1 = b.y1, y
+	return y
+}
@@ -0,0 +1,152 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The fixtures in testdata are three seconds of mono S16LE at
+// fixtureRate:
+//
+//	quiet.pcm  faint hiss
+//	music.pcm  hiss, with a chord swelling three times a second from 1s to 2.5s
+//	hum.pcm    50 Hz mains hum on a DC offset, and hiss
+//	noise.pcm  loud white noise, like a fan
+const fixtureRate = 8000
+
+var goldenChains = map[string][]StageConfig{
+	"variance": {
+		{Type: "variance", Params: map[string]float64{"ms": 250}},
+	},
+	"rms": {
+		{Type: "rms", Params: map[string]float64{"ms": 250}},
+	},
+	"filtered": {
+		{Type: "dc-block"},
+		{Type: "band-filter", Params: map[string]float64{"low": 100, "high": 3000}},
+		{Type: "variance", Params: map[string]float64{"ms": 250}},
+	},
+	"gated": {
+		{Type: "gate", Params: map[string]float64{"floor": 100}},
+		{Type: "rms", Params: map[string]float64{"ms": 100}},
+		{Type: "window", Params: map[string]float64{"ms": 500, "hop_ms": 250}},
+	},
+	"music": {
+		{Type: "music", Params: map[string]float64{"ms": 250}},
+	},
+}
+
+// TestChainGolden runs each chain over each fixture and compares what
+// every stage output with testdata/<fixture>.<chain>.golden. Run with
+// -update to rewrite those after changing a stage on purpose.
+func TestChainGolden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.pcm")
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+	for _, fixture := range fixtures {
+		samples := readFixture(t, fixture)
+		for name, stages := range goldenChains {
+			golden := strings.TrimSuffix(fixture, ".pcm") + "." + name + ".golden"
+			t.Run(filepath.Base(golden), func(t *testing.T) {
+				c, err := NewChain(stages, fixtureRate)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := traceChain(c, stages, samples)
+				if *update {
+					if err := os.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run with -update to create it)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("output differs from %s:\n%s", golden, diffLines(string(want), string(got)))
+				}
+			})
+		}
+	}
+}
+
+func readFixture(t *testing.T, name string) []int16 {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]int16, len(b)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return samples
+}
+
+// traceChain feeds samples through c a stage at a time and describes
+// each stage's output: every value of a window stage, and a summary of
+// a per-sample one. Values are rounded to six significant digits, so
+// that floating point that differs only by an FMA doesn't fail.
+func traceChain(c Chain, stages []StageConfig, samples []int16) []byte {
+	outs := make([][]float64, len(c))
+	for _, s := range samples {
+		x, ok := float64(s), true
+		for i, st := range c {
+			if x, ok = st.Process(x); !ok {
+				break
+			}
+			outs[i] = append(outs[i], x)
+		}
+	}
+	var buf bytes.Buffer
+	for i, out := range outs {
+		fmt.Fprintf(&buf, "stage %d %s: %d values\n", i, stages[i].Type, len(out))
+		if len(out) == len(samples) {
+			min, max, sum, sq := math.Inf(1), math.Inf(-1), 0.0, 0.0
+			for _, v := range out {
+				min, max = math.Min(min, v), math.Max(max, v)
+				sum += v
+				sq += v * v
+			}
+			n := float64(len(out))
+			fmt.Fprintf(&buf, "\tmin %.6g max %.6g mean %.6g rms %.6g\n", min, max, sum/n, math.Sqrt(sq/n))
+			continue
+		}
+		for _, v := range out {
+			fmt.Fprintf(&buf, "\t%.6g\n", v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// diffLines returns the lines of got that differ from want's.
+func diffLines(want, got string) string {
+	wl, gl := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var b strings.Builder
+	for i := 0; i < len(wl) || i < len(gl); i++ {
+		var w, g string
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if w != g {
+			fmt.Fprintf(&b, "line %d: got %q, want %q\n", i+1, g, w)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,17 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import "time"
+
+// A Clock tells a Detector the time, so tests and replays can run it
+// in simulated time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time { return f() }
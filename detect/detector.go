@@ -0,0 +1,96 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import "time"
+
+// A Detector is the on/off state machine: fed the variance of each
+// window of audio, it says when music has played long enough to turn
+// the amps on and when it's been quiet long enough to turn them off.
+// It does no I/O and gets the time only from Clock, so it can be
+// driven deterministically. It's not safe for concurrent use.
+type Detector struct {
+	Threshold float64       // variance above which a window is playing
+	Playing   time.Duration // how long music must play before TurnOn; zero means the first playing window
+	Attack    float64       // if non-zero, a window louder than Threshold times this is TurnOn at once
+	Idle      time.Duration // how long quiet before Idle
+	Clock     Clock         // nil means the wall clock
+
+	playing      bool
+	playingSince time.Time // when the current run of playing windows started
+	lastPlaying  time.Time
+	lastEnd      time.Time // end of the previous window
+}
+
+// A Result is what a Detector made of one window.
+type Result struct {
+	Playing   bool          // the window's variance was above Threshold
+	Changed   bool          // Playing differs from the previous window
+	StartedAt time.Time     // if Playing, when the current run of playing windows started
+	StoppedAt time.Time     // if Changed and not Playing, the end of the last playing window
+	TurnOn    bool          // music has been playing for at least the Playing duration
+	Fast      bool          // TurnOn early because the window was over the Attack level
+	Idle      bool          // nothing has played for longer than Idle
+	OffIn     time.Duration // if neither Playing nor Idle, how long until Idle
+}
+
+// Now returns the time according to d's Clock.
+func (d *Detector) Now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+	return d.Clock.Now()
+}
+
+// Window handles a window of audio with level v whose last sample was
+// captured at end.
+func (d *Detector) Window(v float64, end time.Time) Result {
+	res := d.Activity(v > d.Threshold, end)
+	if res.Playing && !res.TurnOn && d.Attack > 0 && v > d.Threshold*d.Attack {
+		res.TurnOn, res.Fast = true, true
+	}
+	return res
+}
+
+// Activity is like Window for an input that knows whether music is
+// playing instead of having a level, like a music player's state.
+func (d *Detector) Activity(playing bool, end time.Time) Result {
+	now := d.Now()
+	res := Result{Playing: playing}
+	res.Changed = res.Playing != d.playing
+	d.playing = res.Playing
+	start := d.lastEnd
+	if start.IsZero() {
+		start = end
+	}
+	d.lastEnd = end
+	if res.Playing {
+		if res.Changed {
+			d.playingSince = start
+		}
+		d.lastPlaying = end
+		res.StartedAt = d.playingSince
+		res.TurnOn = end.Sub(d.playingSince) >= d.Playing
+		return res
+	}
+	if res.Changed {
+		res.StoppedAt = d.lastPlaying
+	}
+	quiet := now.Sub(d.lastPlaying)
+	if quiet > d.Idle {
+		res.Idle = true
+	} else {
+		res.OffIn = d.Idle - quiet
+	}
+	return res
+}
+
+// IsPlaying reports whether the last window was playing.
+func (d *Detector) IsPlaying() bool { return d.playing }
+
+// LastPlaying returns when the last playing window ended.
+func (d *Detector) LastPlaying() time.Time { return d.lastPlaying }
+
+// Touch restarts the idle timer as though music played until t.
+func (d *Detector) Touch(t time.Time) { d.lastPlaying = t }
@@ -0,0 +1,195 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A window is one call to Detector.Window in a test: a window of level
+// v ending at second at, while the Clock says late seconds after that.
+type window struct {
+	at   float64
+	v    float64
+	late float64
+	want string // see describe
+}
+
+// describe summarizes res as "play", "play on", "play on fast",
+// "quiet <OffIn>" or "idle".
+func describe(res Result) string {
+	switch {
+	case res.Playing && res.Fast:
+		return "play on fast"
+	case res.Playing && res.TurnOn:
+		return "play on"
+	case res.Playing:
+		return "play"
+	case res.Idle:
+		return "idle"
+	}
+	return fmt.Sprintf("quiet %v", res.OffIn)
+}
+
+func TestDetector(t *testing.T) {
+	const loud, silent = 2, 0
+	tests := []struct {
+		name    string
+		d       Detector
+		windows []window
+	}{
+		{
+			name: "first playing window turns on",
+			d:    Detector{Threshold: 1, Idle: 5 * time.Second},
+			windows: []window{
+				{at: 1, v: silent, want: "quiet 4s"},
+				{at: 2, v: loud, want: "play on"},
+			},
+		},
+		{
+			name: "7s of music turns on",
+			d:    Detector{Threshold: 1, Playing: 7 * time.Second, Idle: 5 * time.Minute},
+			windows: []window{
+				{at: 1, v: silent, want: "quiet 4m59s"},
+				{at: 2, v: loud, want: "play"},
+				{at: 3, v: loud, want: "play"},
+				{at: 7, v: loud, want: "play"},
+				{at: 8, v: loud, want: "play on"},
+				{at: 9, v: loud, want: "play on"},
+			},
+		},
+		{
+			name: "a quiet window restarts the playing debounce",
+			d:    Detector{Threshold: 1, Playing: 3 * time.Second, Idle: time.Minute},
+			windows: []window{
+				{at: 1, v: loud, want: "play"},
+				{at: 2, v: loud, want: "play"},
+				{at: 3, v: silent, want: "quiet 59s"},
+				{at: 4, v: loud, want: "play"}, // from 3s, when the window began
+				{at: 5, v: loud, want: "play"},
+				{at: 6, v: loud, want: "play on"},
+			},
+		},
+		{
+			name: "quiet, then idle after Idle",
+			d:    Detector{Threshold: 1, Idle: 5 * time.Second},
+			windows: []window{
+				{at: 1, v: loud, want: "play on"},
+				{at: 2, v: silent, want: "quiet 4s"},
+				{at: 4, v: silent, want: "quiet 2s"},
+				{at: 6, v: silent, want: "quiet 0s"},
+				{at: 7, v: silent, want: "idle"},
+				{at: 8, v: loud, want: "play on"},
+				{at: 9, v: silent, want: "quiet 4s"},
+			},
+		},
+		{
+			name: "5min of silence turns off",
+			d:    Detector{Threshold: 1, Playing: 7 * time.Second, Idle: 5 * time.Minute},
+			windows: []window{
+				{at: 0, v: loud, want: "play"},
+				{at: 10, v: loud, want: "play on"},
+				{at: 11, v: silent, want: "quiet 4m59s"},
+				{at: 310, v: silent, want: "quiet 0s"},
+				{at: 311, v: silent, want: "idle"},
+			},
+		},
+		{
+			name: "idle goes by the clock, not window ends",
+			d:    Detector{Threshold: 1, Idle: 5 * time.Second},
+			windows: []window{
+				{at: 1, v: loud, want: "play on"},
+				{at: 2, v: silent, late: 3, want: "quiet 1s"},
+				{at: 3, v: silent, late: 4, want: "idle"},
+			},
+		},
+		{
+			name: "fast attack",
+			d:    Detector{Threshold: 1, Playing: 5 * time.Second, Attack: 10, Idle: time.Minute},
+			windows: []window{
+				{at: 1, v: 5, want: "play"},
+				{at: 2, v: 10, want: "play"},
+				{at: 3, v: 11, want: "play on fast"},
+				{at: 6, v: 5, want: "play on"},
+			},
+		},
+		{
+			name: "no fast attack without Attack",
+			d:    Detector{Threshold: 1, Playing: 5 * time.Second, Idle: time.Minute},
+			windows: []window{
+				{at: 1, v: 1000, want: "play"},
+				{at: 2, v: 1e9, want: "play"},
+			},
+		},
+		{
+			name: "threshold is exclusive",
+			d:    Detector{Threshold: 1, Idle: time.Minute},
+			windows: []window{
+				{at: 1, v: 1, want: "quiet 59s"},
+				{at: 2, v: 1.01, want: "play on"},
+			},
+		},
+	}
+	epoch := time.Date(2011, 6, 1, 20, 0, 0, 0, time.UTC)
+	at := func(s float64) time.Time { return epoch.Add(time.Duration(s * float64(time.Second))) }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var now time.Time
+			d := tt.d
+			d.Clock = ClockFunc(func() time.Time { return now })
+			d.Touch(epoch)
+			for _, w := range tt.windows {
+				now = at(w.at + w.late)
+				if got := describe(d.Window(w.v, at(w.at))); got != w.want {
+					t.Errorf("window at %vs of %v: got %q, want %q", w.at, w.v, got, w.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorTransitions(t *testing.T) {
+	epoch := time.Date(2011, 6, 1, 20, 0, 0, 0, time.UTC)
+	sec := func(s int) time.Time { return epoch.Add(time.Duration(s) * time.Second) }
+	now := epoch
+	d := Detector{Threshold: 1, Idle: time.Minute, Clock: ClockFunc(func() time.Time { return now })}
+	d.Touch(epoch)
+
+	now = sec(1)
+	if res := d.Window(0, sec(1)); res.Changed {
+		t.Errorf("first quiet window: Changed")
+	}
+	now = sec(2)
+	res := d.Window(2, sec(2))
+	if !res.Changed || !res.StartedAt.Equal(sec(1)) {
+		t.Errorf("first playing window: Changed %v, StartedAt %v; want true, %v", res.Changed, res.StartedAt, sec(1))
+	}
+	now = sec(3)
+	res = d.Window(2, sec(3))
+	if res.Changed || !res.StartedAt.Equal(sec(1)) || !d.IsPlaying() {
+		t.Errorf("second playing window: Changed %v, StartedAt %v, IsPlaying %v", res.Changed, res.StartedAt, d.IsPlaying())
+	}
+	now = sec(4)
+	res = d.Window(0, sec(4))
+	if !res.Changed || !res.StoppedAt.Equal(sec(3)) || d.IsPlaying() {
+		t.Errorf("quiet again: Changed %v, StoppedAt %v, IsPlaying %v; want true, %v, false", res.Changed, res.StoppedAt, d.IsPlaying(), sec(3))
+	}
+	if !d.LastPlaying().Equal(sec(3)) {
+		t.Errorf("LastPlaying = %v; want %v", d.LastPlaying(), sec(3))
+	}
+
+	// Touch puts off going idle, as when the amps are turned on by
+	// hand.
+	now = sec(100)
+	d.Touch(sec(90))
+	if res := d.Activity(false, sec(100)); res.Idle || res.OffIn != 50*time.Second {
+		t.Errorf("after Touch: Idle %v, OffIn %v; want false, 50s", res.Idle, res.OffIn)
+	}
+	now = sec(151)
+	if res := d.Activity(false, sec(151)); !res.Idle {
+		t.Errorf("a minute after Touch: not Idle")
+	}
+}
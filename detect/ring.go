@@ -0,0 +1,80 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+// Package detect decides from audio samples whether music is playing,
+// and when it's been quiet long enough to turn the amps off.
+package detect
+
+import "math"
+
+// A Ring holds the most recent window of values.
+type Ring struct {
+	i    int
+	size int
+	vals []float64
+	sum  float64
+}
+
+// NewRing returns a Ring holding windows of n values.
+func NewRing(n int) *Ring {
+	return &Ring{vals: make([]float64, n)}
+}
+
+func (r *Ring) Add(v float64) {
+	if r.size == len(r.vals) {
+		r.sum -= r.vals[r.i]
+	} else {
+		r.size++
+	}
+	r.sum += v
+	r.vals[r.i] = v
+	r.i++
+	if r.i == len(r.vals) {
+		r.i = 0
+	}
+}
+
+// Full reports whether the last value added completed a window of
+// values not seen in any previous window.
+func (r *Ring) Full() bool {
+	return r.i == 0
+}
+
+// Len returns how many values r holds, up to its window size.
+func (r *Ring) Len() int { return r.size }
+
+// recent returns the last n values added, oldest first, or fewer if
+// r doesn't hold that many.
+func (r *Ring) recent(n int) []float64 {
+	if n > r.size {
+		n = r.size
+	}
+	vals := make([]float64, n)
+	for j := range vals {
+		vals[j] = r.vals[(r.i-n+j+len(r.vals))%len(r.vals)]
+	}
+	return vals
+}
+
+func (r *Ring) Mean() float64 {
+	return r.sum / float64(r.size)
+}
+
+func (r *Ring) Variance() float64 {
+	mean := r.Mean()
+	v := 0.0
+	for _, x := range r.vals {
+		v += math.Pow(math.Abs(mean-x), 2)
+	}
+	v /= float64(r.size)
+	return v
+}
+
+// RMS returns the root mean square of the values.
+func (r *Ring) RMS() float64 {
+	v := 0.0
+	for _, x := range r.vals {
+		v += x * x
+	}
+	return math.Sqrt(v / float64(r.size))
+}
@@ -0,0 +1,77 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+package detect
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// flatnessFrame is how many samples each spectrum of a window's
+// spectral flatness is taken over; a power of two for fft.
+const flatnessFrame = 256
+
+// Flatness returns the spectral flatness of the values: the geometric
+// mean of their power spectrum over its arithmetic mean, from near 0
+// for a pure tone to 1 for white noise. Music, with its harmonics,
+// sits well below broadband noise like fans and rain. The spectrum is
+// averaged over frames of flatnessFrame values; a window shorter than
+// one frame is taken as a single, zero-padded one.
+func (r *Ring) Flatness() float64 {
+	vals := r.recent(r.size)
+	power := make([]float64, flatnessFrame/2)
+	frame := make([]complex128, flatnessFrame)
+	frames := 0
+	for off := 0; off == 0 || off+flatnessFrame <= len(vals); off += flatnessFrame {
+		for i := range frame {
+			x := 0.0
+			if off+i < len(vals) {
+				x = vals[off+i]
+			}
+			// Hann window
+			frame[i] = complex(x*0.5*(1-math.Cos(2*math.Pi*float64(i)/flatnessFrame)), 0)
+		}
+		fft(frame)
+		for k := range power {
+			power[k] += real(frame[k+1])*real(frame[k+1]) + imag(frame[k+1])*imag(frame[k+1])
+		}
+		frames++
+	}
+	const eps = 1e-10 // so silent bins don't make the geometric mean zero
+	logSum, sum := 0.0, 0.0
+	for _, p := range power {
+		p = p/float64(frames) + eps
+		logSum += math.Log(p)
+		sum += p
+	}
+	n := float64(len(power))
+	return math.Exp(logSum/n) / (sum / n)
+}
+
+// fft replaces x, whose length is a power of two, with its discrete
+// Fourier transform.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build fvad
+
+package detect
+
+/*
+#cgo LDFLAGS: -lfvad
+#include <fvad.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"math"
+	"runtime"
+)
+
+// The vad stage runs libfvad, WebRTC's voice activity detector, for
+// rooms whose noise defeats the energy-based stages. It's built only
+// with -tags fvad.
+
+const (
+	vadRate  = 8000          // Hz; libfvad doesn't do SampleHz
+	vadFrame = vadRate / 100 // samples in each 10 ms frame
+)
+
+// vadStage resamples its input to vadRate and outputs, per window, the
+// fraction of frames the detector found active.
+type vadStage struct {
+	vad   *C.Fvad
+	step  float64 // inputs per resampled sample
+	pos   float64 // of the next resampled sample, after prev
+	prev  float64 // the last input
+	frame [vadFrame]C.int16_t
+	nf    int   // samples in frame
+	ring  *Ring // of each frame, 1 if active, else 0
+	hop   int   // frames per output
+	n     int   // frames since the last output
+}
+
+func newVAD(rate, ms, hopMS float64, mode int) (Stage, error) {
+	if mode < 0 || mode > 3 {
+		return nil, errors.New("mode must be 0 to 3")
+	}
+	frames, hop := int(ms/10), int(hopMS/10)
+	if frames < 1 || hop < 1 {
+		return nil, errors.New("window shorter than a 10 ms frame")
+	}
+	vad := C.fvad_new()
+	if vad == nil {
+		return nil, errors.New("fvad_new failed")
+	}
+	if C.fvad_set_mode(vad, C.int(mode)) != 0 || C.fvad_set_sample_rate(vad, vadRate) != 0 {
+		C.fvad_free(vad)
+		return nil, errors.New("configuring libfvad failed")
+	}
+	s := &vadStage{vad: vad, step: rate / vadRate, ring: NewRing(frames), hop: hop}
+	runtime.SetFinalizer(s, func(s *vadStage) { C.fvad_free(s.vad) })
+	return s, nil
+}
+
+func (s *vadStage) Process(x float64) (float64, bool) {
+	// Linear interpolation between prev and x.
+	out, ok := 0.0, false
+	for ; s.pos <= 1; s.pos += s.step {
+		v := s.prev + (x-s.prev)*s.pos
+		s.frame[s.nf] = C.int16_t(math.Max(math.MinInt16, math.Min(math.MaxInt16, v)))
+		if s.nf++; s.nf < vadFrame {
+			continue
+		}
+		s.nf = 0
+		active := C.fvad_process(s.vad, &s.frame[0], vadFrame)
+		s.ring.Add(math.Max(0, float64(active)))
+		if s.n++; s.ring.size == len(s.ring.vals) && s.n >= s.hop {
+			s.n = 0
+			out, ok = s.ring.Mean(), true
+		}
+	}
+	s.pos -= 1
+	s.prev = x
+	return out, ok
+}
@@ -0,0 +1,14 @@
+// Copyright 2011 Google Inc.
+// See LICENSE file.
+
+//go:build !fvad
+
+package detect
+
+import "errors"
+
+// Without -tags fvad there's no voice activity detector.
+
+func newVAD(rate, ms, hopMS float64, mode int) (Stage, error) {
+	return nil, errors.New("not built with -tags fvad")
+}